@@ -0,0 +1,195 @@
+package main
+
+import (
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// UpdateProfileData struct, missing fields are kept
+type UpdateProfileData struct {
+	Username *string `json:"username" normalize:"line" validate:"min=3,max=15"`
+	Email    *string `json:"email" normalize:"line" validate:"email,max=35"`
+	Password string  `json:"password"` // Current password, required to change the email
+}
+
+// ChangePasswordData struct
+type ChangePasswordData struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword" validate:"required,min=8,max=72,maxbytes=72"`
+}
+
+// DeleteAccountData struct
+type DeleteAccountData struct {
+	Password string `json:"password"`
+	Reviews  string `json:"reviews" validate:"oneof=anonymize delete"`
+}
+
+// Profile of the user as JSON
+func profile(user *User) map[string]interface{} {
+	return map[string]interface{}{
+		"id":            user.ID,
+		"username":      user.Username,
+		"email":         user.Email,
+		"role":          user.Role,
+		"emailVerified": user.EmailVerified,
+	}
+}
+
+// Gets the user of the access token
+func currentUser(ctx *fiber.Ctx) (*User, error) {
+	user, err := store.GetUserByID(userIDFromToken(ctx))
+	if err == errNotFound {
+		return nil, errUnauthorized
+	}
+
+	return user, err
+}
+
+// GetMe gets the profile of the user
+func GetMe(ctx *fiber.Ctx) error {
+	user, err := currentUser(ctx)
+	if err != nil {
+		return err
+	}
+
+	return ctx.Status(200).JSON(profile(user))
+}
+
+// UpdateMe changes the username or email of the user, a new email has to be verified again
+func UpdateMe(ctx *fiber.Ctx) error {
+	user, err := currentUser(ctx)
+	if err != nil {
+		return err
+	}
+
+	data := new(UpdateProfileData)
+	if err := parseBody(ctx, data); err != nil {
+		return err
+	}
+
+	// Change username
+	if data.Username != nil && *data.Username != user.Username {
+		if exists, err := store.UsernameExists(*data.Username); err != nil {
+			return err
+		} else if exists {
+			return errUsernameTaken
+		}
+
+		user.Username = *data.Username
+	}
+
+	// Change email
+	emailChanged := data.Email != nil && *data.Email != user.Email
+	if emailChanged {
+		if !compareHashAndPassword(data.Password, user.Password) {
+			return errWrongPassword
+		}
+
+		if exists, err := store.EmailExists(*data.Email); err != nil {
+			return err
+		} else if exists {
+			return errEmailTaken
+		}
+
+		user.Email = *data.Email
+		user.EmailVerified = false
+	}
+
+	if err := store.UpdateUser(user); err != nil {
+		return err
+	}
+
+	// Links sent to the old email stop working and a verification link goes to the new one
+	if emailChanged {
+		if err := store.RevokeUserEmailTokens(user.ID); err != nil {
+			return err
+		}
+
+		go sendEmailToken(user, verifyEmailPurpose)
+	}
+
+	return ctx.Status(200).JSON(profile(user))
+}
+
+// ChangePassword changes the password of the user, every other session is signed out and new tokens are returned
+func ChangePassword(ctx *fiber.Ctx) error {
+	user, err := currentUser(ctx)
+	if err != nil {
+		return err
+	}
+
+	data := new(ChangePasswordData)
+	if err := parseBody(ctx, data); err != nil {
+		return err
+	}
+
+	if !compareHashAndPassword(data.CurrentPassword, user.Password) {
+		return errWrongPassword
+	}
+
+	hashedPassword, err := hashPassword(data.NewPassword)
+	if err != nil {
+		return err
+	}
+
+	if err = store.SetUserPassword(user.ID, hashedPassword); err != nil {
+		return err
+	}
+
+	// Sign out every session, this one continues with a new login
+	if err = store.RevokeUserRefreshTokens(user.ID); err != nil {
+		return err
+	}
+
+	accessTokenString, err := generateAccessToken(user)
+	if err != nil {
+		return err
+	}
+
+	refreshTokenString, err := generateRefreshToken(user.ID, user.Username, user.Email, "", ctx.Get(fiber.HeaderUserAgent))
+	if err != nil {
+		return err
+	}
+
+	return ctx.Status(200).JSON(map[string]string{
+		"accessToken":  accessTokenString,
+		"refreshToken": refreshTokenString,
+	})
+}
+
+// DeleteMe deletes the account of the user, their reviews are anonymized or deleted as chosen
+func DeleteMe(ctx *fiber.Ctx) error {
+	user, err := currentUser(ctx)
+	if err != nil {
+		return err
+	}
+
+	data := new(DeleteAccountData)
+	if err := parseBody(ctx, data); err != nil {
+		return err
+	}
+
+	if !compareHashAndPassword(data.Password, user.Password) {
+		return errWrongPassword
+	}
+
+	changedMovies, err := store.DeleteUser(user.ID, data.Reviews == "anonymize")
+	if err == errNotFound {
+		return errUnauthorized
+	} else if err != nil {
+		return err
+	}
+
+	log.Printf("User %d deleted their account, reviews %sd\n", user.ID, data.Reviews)
+	dataExports.Remove(user.ID)
+
+	// Refresh the ratings in the search index
+	for _, movieID := range changedMovies {
+		if err = reindexMovie(movieID); err != nil {
+			log.Println(err.Error())
+		}
+	}
+
+	return ctx.SendStatus(204)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestUpdateMe(t *testing.T) {
+	app, mailer := newTestApp(t)
+	access, _ := registerTestUser(t, app, "alice")
+	registerTestUser(t, app, "bob")
+	mailer.waitForToken(t, "alice@example.com")
+
+	// Steps run in order on the same account
+	for _, step := range []struct {
+		name   string
+		body   map[string]string
+		status int
+	}{
+		{"taken username", map[string]string{"username": "bob"}, 409},
+		{"new username", map[string]string{"username": "alicia"}, 200},
+		{"email without the password", map[string]string{"email": "alicia@example.com"}, 403},
+		{"taken email", map[string]string{"email": "bob@example.com", "password": "password1"}, 409},
+		{"new email", map[string]string{"email": "alicia@example.com", "password": "password1"}, 200},
+	} {
+		if response, body := testRequest(t, app, "PATCH", "/api/v1/me", access, step.body); response.StatusCode != step.status {
+			t.Errorf("%s: got %d %v, want %d", step.name, response.StatusCode, body, step.status)
+		}
+	}
+
+	// The new address has to be verified again
+	_, me := testRequest(t, app, "GET", "/api/v1/me", access, nil)
+	if me["username"] != "alicia" || me["email"] != "alicia@example.com" || me["emailVerified"] != false {
+		t.Errorf("got %v", me)
+	}
+	mailer.waitForToken(t, "alicia@example.com")
+}
+
+func TestChangePassword(t *testing.T) {
+	app, _ := newTestApp(t)
+	access, refresh := registerTestUser(t, app, "alice")
+
+	if response, _ := testRequest(t, app, "POST", "/api/v1/me/password", access, map[string]string{"currentPassword": "wrong password", "newPassword": "password2"}); response.StatusCode != 403 {
+		t.Errorf("wrong current password responded with %d", response.StatusCode)
+	}
+	response, body := testRequest(t, app, "POST", "/api/v1/me/password", access, map[string]string{"currentPassword": "password1", "newPassword": "password2"})
+	if response.StatusCode != 200 {
+		t.Fatalf("change password responded with %d %v", response.StatusCode, body)
+	}
+
+	// Other sessions are signed out, this one continues with the returned tokens
+	if response, _ := testRequest(t, app, "GET", "/api/v1/refresh", refresh, nil); response.StatusCode != 401 {
+		t.Errorf("refresh of another session responded with %d", response.StatusCode)
+	}
+	if response, _ := testRequest(t, app, "GET", "/api/v1/refresh", body["refreshToken"].(string), nil); response.StatusCode != 200 {
+		t.Errorf("refresh of the new session responded with %d", response.StatusCode)
+	}
+	if response, _ := testRequest(t, app, "POST", "/api/v1/login", "", map[string]string{"email": "alice@example.com", "password": "password2"}); response.StatusCode != 200 {
+		t.Errorf("login with the new password responded with %d", response.StatusCode)
+	}
+}
+
+func TestDeleteMe(t *testing.T) {
+	app, _ := newTestApp(t)
+	access, _ := registerTestUser(t, app, "alice")
+
+	for _, step := range []struct {
+		name   string
+		body   map[string]string
+		status int
+	}{
+		{"wrong password", map[string]string{"password": "wrong password", "reviews": "delete"}, 403},
+		{"unknown choice for the reviews", map[string]string{"password": "password1", "reviews": "keep"}, 400},
+		{"delete", map[string]string{"password": "password1", "reviews": "delete"}, 204},
+		{"deleted account", map[string]string{"password": "password1", "reviews": "delete"}, 401},
+	} {
+		if response, body := testRequest(t, app, "DELETE", "/api/v1/me", access, step.body); response.StatusCode != step.status {
+			t.Errorf("%s: got %d %v, want %d", step.name, response.StatusCode, body, step.status)
+		}
+	}
+
+	if response, _ := testRequest(t, app, "POST", "/api/v1/login", "", map[string]string{"email": "alice@example.com", "password": "password1"}); response.StatusCode != 401 {
+		t.Errorf("login to the deleted account responded with %d", response.StatusCode)
+	}
+}
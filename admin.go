@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// NewRole struct
+type NewRole struct {
+	Role string `json:"role" validate:"oneof=user moderator admin"`
+}
+
+// Gives the admin role to the user if ADMIN_EMAILS lists their email and they verified it, so nobody becomes admin by registering with a listed email
+func promoteListedAdmin(user *User) error {
+	if !user.EmailVerified || user.Role == "admin" || !config.AdminEmails[user.Email] {
+		return nil
+	}
+
+	if err := store.SetUserRole(user.ID, "admin"); err != nil {
+		return err
+	}
+	user.Role = "admin"
+
+	log.Printf("User %d (%s) promoted to admin by ADMIN_EMAILS\n", user.ID, user.Username)
+	return nil
+}
+
+// Promotes the existing accounts ADMIN_EMAILS lists, run at startup
+func promoteListedAdmins() error {
+	for email := range config.AdminEmails {
+		user, err := store.GetUserByEmail(email)
+		if err == errNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if err = promoteListedAdmin(user); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RemoveReview deletes a review of any user, for moderators
+func RemoveReview(ctx *fiber.Ctx) error {
+	reviewID, err := strconv.Atoi(ctx.Params("reviewId"))
+	if err != nil {
+		return errInvalidReviewID
+	}
+
+	// Get the movie of the review
+	review, err := store.GetReview(reviewID)
+	if err == errNotFound {
+		return errReviewNotFound
+	} else if err != nil {
+		return err
+	}
+
+	// Delete review and update the movie rating
+	err = store.RemoveReview(reviewID)
+	if err == errNotFound {
+		return errReviewNotFound
+	} else if err != nil {
+		return err
+	}
+
+	log.Printf("Review %d of %s removed by user %d\n", reviewID, review.Username, userIDFromToken(ctx))
+
+	// Refresh the rating in the search index
+	if err = reindexMovie(review.MovieID); err != nil {
+		log.Println(err.Error())
+	}
+
+	return ctx.SendStatus(204)
+}
+
+// SetUserRole changes the role of a user, for admins
+func SetUserRole(ctx *fiber.Ctx) error {
+	userID, err := strconv.Atoi(ctx.Params("id"))
+	if err != nil {
+		return validationError("id", "Invalid user ID")
+	}
+
+	newRole := new(NewRole)
+	if err := parseBody(ctx, newRole); err != nil {
+		return err
+	}
+
+	// Keep at least the admin making the change
+	if userID == userIDFromToken(ctx) && newRole.Role != "admin" {
+		return newAPIError(400, "CANNOT_DEMOTE_SELF", "Admins cannot demote themselves")
+	}
+
+	err = store.SetUserRole(userID, newRole.Role)
+	if err == errNotFound {
+		return newAPIError(404, "USER_NOT_FOUND", "User does not exist")
+	} else if err != nil {
+		return err
+	}
+
+	log.Printf("User %d set to %s by user %d\n", userID, newRole.Role, userIDFromToken(ctx))
+
+	return ctx.Status(200).JSON(map[string]interface{}{
+		"id":   userID,
+		"role": newRole.Role,
+	})
+}
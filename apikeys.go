@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gofiber/fiber/v2"
+)
+
+// API keys start with this, so they are told apart from JWTs and found by secret scanners
+const apiKeyPrefix = "mr_"
+
+// Scopes API keys can be given, each allows the routes protected by ScopeProtected with it
+var apiKeyScopes = []string{"profile:read", "movies:read", "movies:write", "reviews:read", "reviews:write", "reviews:moderate"}
+
+// The last use of a key is recorded at most this often
+const apiKeyLastUsedInterval = time.Minute
+
+// AddAPIKeyData struct
+type AddAPIKeyData struct {
+	Name   string   `json:"name" normalize:"line" validate:"required,max=64"`
+	Scopes []string `json:"scopes" validate:"required"`
+}
+
+// Checks the scopes are known
+func (data *AddAPIKeyData) validate() []FieldError {
+	for _, scope := range data.Scopes {
+		validScope := false
+		for _, known := range apiKeyScopes {
+			validScope = validScope || known == scope
+		}
+		if !validScope {
+			return []FieldError{{Field: "scopes", Message: "scopes must be any of " + strings.Join(apiKeyScopes, ", ")}}
+		}
+	}
+
+	return nil
+}
+
+// Generates a random API key
+func generateAPIKey() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+
+	return apiKeyPrefix + hex.EncodeToString(bytes), nil
+}
+
+// Hashes an API key, keys are random so a fast hash is enough
+func hashAPIKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// Reports whether the key has the scope
+func (key *APIKey) hasScope(scope string) bool {
+	for _, keyScope := range key.Scopes {
+		if keyScope == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// API key as JSON, without the hash
+func apiKeyJSON(key *APIKey) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         key.ID,
+		"name":       key.Name,
+		"prefix":     key.Prefix,
+		"scopes":     key.Scopes,
+		"createdAt":  key.CreatedAt,
+		"lastUsedAt": key.LastUsedAt,
+	}
+}
+
+// Authenticates a request with an API key in place of an access token, the user's claims are set as if from one
+func apiKeyProtected(ctx *fiber.Ctx) error {
+	secret := ctx.Get(fiber.HeaderAuthorization)[len("Bearer "):]
+	key, err := store.GetAPIKeyByHash(hashAPIKey(secret))
+	if err == errNotFound {
+		return unauthorized(ctx, err)
+	} else if err != nil {
+		return err
+	}
+
+	// The current user, so a changed role or email applies at once
+	user, err := store.GetUserByID(key.UserID)
+	if err == errNotFound {
+		return unauthorized(ctx, err)
+	} else if err != nil {
+		return err
+	}
+
+	if key.LastUsedAt == nil || time.Since(*key.LastUsedAt) > apiKeyLastUsedInterval {
+		if err = store.SetAPIKeyLastUsed(key.ID, time.Now()); err != nil {
+			log.Println(err.Error())
+		}
+	}
+
+	ctx.Locals("apiKey", key)
+	ctx.Locals("user", &jwt.Token{
+		Valid: true,
+		Claims: jwt.MapClaims{
+			"id":            float64(user.ID),
+			"username":      user.Username,
+			"email":         user.Email,
+			"role":          user.Role,
+			"emailVerified": user.EmailVerified,
+			"mfa":           user.TOTPEnabled,
+			"typ":           accessTokenType,
+		},
+	})
+	return ctx.Next()
+}
+
+// ScopeProtected lets API keys use the route only if they have the scope, access tokens may use it anyway
+func ScopeProtected(scope string) func(*fiber.Ctx) error {
+	return func(ctx *fiber.Ctx) error {
+		if key, ok := ctx.Locals("apiKey").(*APIKey); ok && !key.hasScope(scope) {
+			return newAPIError(403, "API_KEY_SCOPE_MISSING", "API key lacks the "+scope+" scope")
+		}
+
+		return ctx.Next()
+	}
+}
+
+// SessionProtected refuses API keys on every route after it, those need an access token of a login
+func SessionProtected() func(*fiber.Ctx) error {
+	return func(ctx *fiber.Ctx) error {
+		if ctx.Locals("apiKey") != nil {
+			return newAPIError(403, "API_KEY_NOT_ALLOWED", "API keys cannot use this endpoint")
+		}
+
+		return ctx.Next()
+	}
+}
+
+// GetAPIKeys gets the API keys of the user
+func GetAPIKeys(ctx *fiber.Ctx) error {
+	keys, err := store.GetUserAPIKeys(userIDFromToken(ctx))
+	if err != nil {
+		return err
+	}
+
+	result := []map[string]interface{}{}
+	for i := range keys {
+		result = append(result, apiKeyJSON(&keys[i]))
+	}
+
+	return ctx.Status(200).JSON(map[string]interface{}{
+		"apiKeys": result,
+	})
+}
+
+// AddAPIKey creates an API key with the scopes, the key is returned only this once
+func AddAPIKey(ctx *fiber.Ctx) error {
+	data := new(AddAPIKeyData)
+	if err := parseBody(ctx, data); err != nil {
+		return err
+	}
+
+	secret, err := generateAPIKey()
+	if err != nil {
+		return err
+	}
+
+	key := APIKey{
+		UserID:    userIDFromToken(ctx),
+		Name:      data.Name,
+		Prefix:    secret[:len(apiKeyPrefix)+8],
+		Hash:      hashAPIKey(secret),
+		Scopes:    data.Scopes,
+		CreatedAt: time.Now().UTC(),
+	}
+	if key.ID, err = store.CreateAPIKey(key); err == errNotFound {
+		return errUnauthorized
+	} else if err != nil {
+		return err
+	}
+
+	result := apiKeyJSON(&key)
+	result["key"] = secret
+	return ctx.Status(201).JSON(result)
+}
+
+// RevokeAPIKey deletes an API key of the user
+func RevokeAPIKey(ctx *fiber.Ctx) error {
+	keyID, err := strconv.Atoi(ctx.Params("id"))
+	if err != nil {
+		return validationError("id", "Invalid API key ID")
+	}
+
+	if err = store.DeleteAPIKey(keyID, userIDFromToken(ctx)); err == errNotFound {
+		return newAPIError(404, "API_KEY_NOT_FOUND", "API key does not exist")
+	} else if err != nil {
+		return err
+	}
+
+	return ctx.SendStatus(204)
+}
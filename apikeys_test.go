@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestAPIKeys(t *testing.T) {
+	app, _ := newTestApp(t)
+	access, _ := registerTestUser(t, app, "alice")
+
+	if response, _ := testRequest(t, app, "POST", "/api/v1/me/api-keys", access, map[string]interface{}{"name": "script", "scopes": []string{"everything"}}); response.StatusCode != 400 {
+		t.Errorf("unknown scope responded with %d", response.StatusCode)
+	}
+	response, body := testRequest(t, app, "POST", "/api/v1/me/api-keys", access, map[string]interface{}{"name": "script", "scopes": []string{"movies:read"}})
+	if response.StatusCode != 201 {
+		t.Fatalf("add key responded with %d %v", response.StatusCode, body)
+	}
+	key := body["key"].(string)
+	keyPath := fmt.Sprintf("/api/v1/me/api-keys/%v", body["id"])
+
+	// Keys are taken in place of access tokens on the routes of their scopes only
+	for _, test := range []struct {
+		method, path string
+		status       int
+	}{
+		{"GET", "/api/v1/movies", 200},
+		{"GET", "/api/v1/me", 403},
+		{"GET", "/api/v1/me/api-keys", 403},
+		{"DELETE", keyPath, 403},
+	} {
+		if response, body := testRequest(t, app, test.method, test.path, key, nil); response.StatusCode != test.status {
+			t.Errorf("%s %s: got %d %v, want %d", test.method, test.path, response.StatusCode, body, test.status)
+		}
+	}
+
+	// Listed without their secrets
+	_, body = testRequest(t, app, "GET", "/api/v1/me/api-keys", access, nil)
+	keys, _ := body["apiKeys"].([]interface{})
+	if len(keys) != 1 || keys[0].(map[string]interface{})["key"] != nil || keys[0].(map[string]interface{})["lastUsedAt"] == nil {
+		t.Errorf("got keys %v", body)
+	}
+
+	if response, _ := testRequest(t, app, "DELETE", keyPath, access, nil); response.StatusCode != 204 {
+		t.Errorf("revoke responded with %d", response.StatusCode)
+	}
+	if response, _ := testRequest(t, app, "GET", "/api/v1/movies", key, nil); response.StatusCode != 401 {
+		t.Errorf("revoked key responded with %d", response.StatusCode)
+	}
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"log"
-	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
@@ -11,23 +14,17 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
-// Secret key for access token
-var secretKey = []byte("Lorem ipsum dolor sit amet, consectetur adipiscing elit, sed do eiusmod tempor incididunt ut labore et dolore magna aliqua.")
-
-// Secret key for refresh token
-var refreshKey = []byte("Quisque sagittis purus sit amet volutpat consequat. Duis at consectetur lorem donec massa. Diam vel quam elementum pulvinar etiam.")
-
 // RegisterData struct
 type RegisterData struct {
-	Username string `json:"username"`
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Username string `json:"username" normalize:"line" validate:"required,min=3,max=15"`
+	Email    string `json:"email" normalize:"line" validate:"required,email,max=35"`
+	Password string `json:"password" validate:"required,min=8,max=72,maxbytes=72"`
 }
 
 // LoginData struct
 type LoginData struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email    string `json:"email" normalize:"line" validate:"required"`
+	Password string `json:"password" validate:"required"`
 }
 
 // Encrypts password
@@ -36,42 +33,110 @@ func hashPassword(password string) (string, error) {
 	return string(bytes), err
 }
 
+// Hash compared against for unknown emails
+var dummyHash struct {
+	once sync.Once
+	hash string
+}
+
+// Gets a hash of a random password with the cost of real ones
+func dummyPasswordHash() string {
+	dummyHash.once.Do(func() {
+		password, _ := generateTokenID()
+		dummyHash.hash, _ = hashPassword(password)
+	})
+
+	return dummyHash.hash
+}
+
 // Compares input pasword with encrypted passord
 func compareHashAndPassword(password, hash string) bool {
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 	return err == nil
 }
 
-//GenerateRefreshToken generates refresh token
-func generateRefreshToken(id int, username string, email string) (string, error) {
-	token := jwt.New(jwt.SigningMethodHS256)
-	claims := token.Claims.(jwt.MapClaims)
+// Values of the typ claim, so one kind of token is not accepted as the other
+const (
+	accessTokenType  = "access"
+	refreshTokenType = "refresh"
+	mfaChallengeType = "mfa_challenge"
+)
+
+// Lifetime of refresh tokens
+const refreshTokenLifetime = time.Hour * 24 * 7 * 4 // A Month
+
+// Generates a random ID for refresh tokens and their families
+func generateTokenID() (string, error) {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(bytes), nil
+}
+
+//GenerateRefreshToken generates refresh token and records it, a new token family is started if familyID is empty
+func generateRefreshToken(id int, username string, email string, familyID string, device string) (string, error) {
+	jti, err := generateTokenID()
+	if err != nil {
+		return "", err
+	}
+
+	if familyID == "" {
+		if familyID, err = generateTokenID(); err != nil {
+			return "", err
+		}
+	}
+
+	if len(device) > 100 {
+		device = device[:100]
+	}
+
+	expiresAt := time.Now().Add(refreshTokenLifetime)
+	claims := jwt.MapClaims{}
 
 	claims["id"] = id
 	claims["username"] = username
 	claims["email"] = email
-	claims["exp"] = time.Now().Add(time.Hour * 24 * 7 * 4).Unix() // A Month
+	claims["typ"] = refreshTokenType
+	claims["jti"] = jti
+	claims["exp"] = expiresAt.Unix()
 
-	tokenString, err := token.SignedString(refreshKey)
+	tokenString, err := signToken(claims)
 
 	if err != nil {
 		return "", err
 	}
 
+	// Record token so it can be rotated and revoked
+	err = store.CreateRefreshToken(RefreshToken{
+		ID:        jti,
+		FamilyID:  familyID,
+		UserID:    id,
+		Device:    device,
+		ExpiresAt: expiresAt.UTC(),
+	})
+	if err != nil {
+		return "", err
+	}
+
 	return tokenString, nil
 }
 
 // GenerateAccessToken generates Token
-func generateAccessToken(id int, username string, email string) (string, error) {
-	token := jwt.New(jwt.SigningMethodHS256)
-	claims := token.Claims.(jwt.MapClaims)
-
-	claims["id"] = id
-	claims["username"] = username
-	claims["email"] = email
+func generateAccessToken(user *User) (string, error) {
+	claims := jwt.MapClaims{}
+
+	claims["id"] = user.ID
+	claims["username"] = user.Username
+	claims["email"] = user.Email
+	claims["role"] = user.Role
+	claims["emailVerified"] = user.EmailVerified
+	claims["mfa"] = user.TOTPEnabled
+	claims["typ"] = accessTokenType
 	claims["exp"] = time.Now().Add(time.Minute * 5).Unix() // 5 Minutes
 
-	tokenString, err := token.SignedString(secretKey)
+	tokenString, err := signToken(claims)
 
 	if err != nil {
 		return "", err
@@ -80,48 +145,178 @@ func generateAccessToken(id int, username string, email string) (string, error)
 	return tokenString, nil
 }
 
-// RefreshProtected protects routes
-func RefreshProtected() func(*fiber.Ctx) error {
+// Generates the short-lived token that proves the password was right until the second factor is given
+func generateMFAChallengeToken(id int) (string, error) {
+	claims := jwt.MapClaims{}
+
+	claims["id"] = id
+	claims["typ"] = mfaChallengeType
+	claims["exp"] = time.Now().Add(time.Minute * 5).Unix() // 5 Minutes
+
+	return signToken(claims)
+}
+
+// Creates access and refresh tokens of a new login of the user, the body of login responses
+func loginTokens(ctx *fiber.Ctx, user *User) (map[string]interface{}, error) {
+	// Create access token
+	accessTokenString, err := generateAccessToken(user)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create refresh token
+	refreshTokenString, err := generateRefreshToken(user.ID, user.Username, user.Email, "", ctx.Get(fiber.HeaderUserAgent))
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"accessToken":   accessTokenString,
+		"refreshToken":  refreshTokenString,
+		"username":      user.Username,
+		"email":         user.Email,
+		"role":          user.Role,
+		"emailVerified": user.EmailVerified,
+	}, nil
+}
+
+// Creates the body of login responses once the user is authenticated, users with 2FA get a challenge for the second factor instead of tokens
+func loginBody(ctx *fiber.Ctx, user *User) (map[string]interface{}, error) {
+	if !user.TOTPEnabled {
+		return loginTokens(ctx, user)
+	}
+
+	challengeTokenString, err := generateMFAChallengeToken(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"mfaRequired":    true,
+		"challengeToken": challengeTokenString,
+	}, nil
+}
+
+// Responds with new access and refresh tokens of a new login of the user
+func respondWithTokens(ctx *fiber.Ctx, user *User) error {
+	body, err := loginTokens(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	return ctx.Status(200).JSON(body)
+}
+
+// Gets the user ID from the token validated by AccessProtected
+func userIDFromToken(ctx *fiber.Ctx) int {
+	user := ctx.Locals("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+	return int(claims["id"].(float64))
+}
+
+// Responds to requests without a valid token
+func unauthorized(ctx *fiber.Ctx, err error) error {
+	return errUnauthorized
+}
+
+// Creates middleware that accepts tokens of the type signed by any verification key, picked by the kid header
+func tokenProtected(tokenType string) func(*fiber.Ctx) error {
 	return jwtware.New(jwtware.Config{
-		SigningKey: refreshKey,
-		ErrorHandler: func(ctx *fiber.Ctx, err error) error {
-			return ctx.Status(401).JSON(map[string]string{
-				"error": "Unauthorized",
-			})
+		SigningKeys:   verificationKeys(),
+		SigningMethod: "RS256",
+		SuccessHandler: func(ctx *fiber.Ctx) error {
+			claims := ctx.Locals("user").(*jwt.Token).Claims.(jwt.MapClaims)
+			if claims["typ"] != tokenType {
+				return unauthorized(ctx, nil)
+			}
+
+			return ctx.Next()
 		},
+		ErrorHandler: unauthorized,
 	})
 }
 
-// AccessProtected protects routes
+// RoleProtected protects routes behind AccessProtected so only users with at least minRole can use them
+func RoleProtected(minRole string) func(*fiber.Ctx) error {
+	return func(ctx *fiber.Ctx) error {
+		claims := ctx.Locals("user").(*jwt.Token).Claims.(jwt.MapClaims)
+		role, _ := claims["role"].(string)
+		if !hasRole(role, minRole) {
+			return errForbidden
+		}
+
+		// Privileged users may be required to use 2FA
+		if mfa, _ := claims["mfa"].(bool); !mfa && config.TwoFactorRole != "" && hasRole(role, config.TwoFactorRole) {
+			return newAPIError(403, "TWO_FACTOR_REQUIRED", "Two-factor authentication required, enrol at /api/v1/me/2fa/setup")
+		}
+
+		return ctx.Next()
+	}
+}
+
+// VerifiedProtected protects routes behind AccessProtected so only users with a verified email can use them, if the config requires it for the action
+func VerifiedProtected(action string) func(*fiber.Ctx) error {
+	return func(ctx *fiber.Ctx) error {
+		claims := ctx.Locals("user").(*jwt.Token).Claims.(jwt.MapClaims)
+		if verified, _ := claims["emailVerified"].(bool); !verified && config.VerifiedEmailRequired[action] {
+			return newAPIError(403, "EMAIL_NOT_VERIFIED", "Email not verified")
+		}
+
+		return ctx.Next()
+	}
+}
+
+// RefreshProtected protects routes
+func RefreshProtected() func(*fiber.Ctx) error {
+	return tokenProtected(refreshTokenType)
+}
+
+// AccessProtected protects routes, they take an access token or an API key
 func AccessProtected() func(*fiber.Ctx) error {
-	return jwtware.New(jwtware.Config{
-		SigningKey: secretKey,
-		ErrorHandler: func(ctx *fiber.Ctx, err error) error {
-			return ctx.Status(401).JSON(map[string]string{
-				"error": "Unauthorized",
-			})
-		},
-	})
+	accessProtected := tokenProtected(accessTokenType)
+	return func(ctx *fiber.Ctx) error {
+		if strings.HasPrefix(ctx.Get(fiber.HeaderAuthorization), "Bearer "+apiKeyPrefix) {
+			return apiKeyProtected(ctx)
+		}
+
+		return accessProtected(ctx)
+	}
 }
 
-// Refresh checks for authorization
+// Refresh checks for authorization, the refresh token is used up and a new one of the same family is returned
 func Refresh(ctx *fiber.Ctx) error {
 	user := ctx.Locals("user").(*jwt.Token)
 	claims := user.Claims.(jwt.MapClaims)
 	userID := claims["id"].(float64)
-	username := claims["username"].(string)
-	userEmail := claims["email"].(string)
+	jti, _ := claims["jti"].(string)
+
+	// Use up the refresh token, a reused token revokes its whole family
+	refreshToken, err := store.UseRefreshToken(jti)
+	if err == errNotFound || err == errTokenReused {
+		if err == errTokenReused {
+			log.Printf("Refresh token reuse detected for user %d, token family revoked\n", int(userID))
+		}
+		return errUnauthorized
+	} else if err != nil {
+		return err
+	}
 
-	accessTokenString, err := generateAccessToken(int(userID), username, userEmail)
+	// Get the current user, the role may have changed since login
+	account, err := store.GetUserByID(int(userID))
+	if err == errNotFound {
+		return errUnauthorized
+	} else if err != nil {
+		return err
+	}
+
+	accessTokenString, err := generateAccessToken(account)
 	if err != nil {
-		log.Println(err.Error())
-		return ctx.SendStatus(500)
+		return err
 	}
 
-	refreshTokenString, err := generateRefreshToken(int(userID), username, userEmail)
+	refreshTokenString, err := generateRefreshToken(account.ID, account.Username, account.Email, refreshToken.FamilyID, refreshToken.Device)
 	if err != nil {
-		log.Println(err.Error())
-		return ctx.SendStatus(500)
+		return err
 	}
 
 	return ctx.Status(200).JSON(map[string]string{
@@ -130,78 +325,90 @@ func Refresh(ctx *fiber.Ctx) error {
 	})
 }
 
+// Logout revokes the refresh token and every token rotated from the same login
+func Logout(ctx *fiber.Ctx) error {
+	user := ctx.Locals("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+	jti, _ := claims["jti"].(string)
+
+	err := store.RevokeRefreshTokenFamily(jti)
+	if err != nil && err != errNotFound {
+		return err
+	}
+
+	return ctx.SendStatus(204)
+}
+
+// LogoutAll revokes every refresh token of the user
+func LogoutAll(ctx *fiber.Ctx) error {
+	if err := store.RevokeUserRefreshTokens(userIDFromToken(ctx)); err != nil {
+		return err
+	}
+
+	return ctx.SendStatus(204)
+}
+
 // Login logins to the app with email and password
 func Login(ctx *fiber.Ctx) error {
 	loginData := new(LoginData)
 
 	// Parse body (input data)
-	if err := ctx.BodyParser(loginData); err != nil {
-		log.Println(err.Error())
-		return ctx.Status(400).JSON(map[string]string{
-			"error": "Cannot parse JSON",
-		})
+	if err := parseBody(ctx, loginData); err != nil {
+		return err
 	}
 
-	// Validate email & password
-	if len(loginData.Email) == 0 || len(loginData.Password) == 0 {
-		return ctx.Status(400).JSON(map[string]string{
-			"error": "Empty email or password",
-		})
+	// Refuse attempts while the account or IP is throttled
+	ip := ctx.IP()
+	for _, throttle := range []struct {
+		policy throttlePolicy
+		value  string
+	}{{accountThrottle, loginData.Email}, {ipThrottle, ip}} {
+		wait, err := throttle.policy.retryAfter(throttle.value)
+		if err != nil {
+			return err
+		} else if wait > 0 {
+			return tooManyAttempts(ctx, wait)
+		}
 	}
 
 	// Get id, email, password from database
-	result, err := db.Query("SELECT id, username, email, password FROM users WHERE email = ?", loginData.Email)
-	if err != nil {
-		log.Println(err.Error())
-		return ctx.Status(500).JSON(map[string]string{
-			"error": "Internal server error",
-		})
-	}
-
-	// Process data from database
-	isUserExist := false
-	var userID int
-	var username string
-	var userEmail string
-	var userPassword string
-	for result.Next() {
-		if err = result.Scan(&userID, &username, &userEmail, &userPassword); err != nil {
-			log.Println(err)
-			return ctx.Status(500).JSON(map[string]string{
-				"error": "Internal server error",
-			})
-		}
+	user, err := store.GetUserByEmail(loginData.Email)
+	if err != nil && err != errNotFound {
+		return err
+	}
 
-		isUserExist = true
+	// Authenticate email and password, unknown emails are checked against a dummy hash to take as long
+	hash := dummyPasswordHash()
+	if user != nil {
+		hash = user.Password
 	}
+	if !compareHashAndPassword(loginData.Password, hash) || user == nil {
+		userID := anyUser
+		if user != nil {
+			userID = user.ID
+		}
+		if err = accountThrottle.fail(loginData.Email, userID, ip); err == nil {
+			err = ipThrottle.fail(ip, userID, ip)
+		}
+		if err != nil {
+			log.Println(err.Error())
+		}
 
-	// Authenticate email and password
-	if !isUserExist || !compareHashAndPassword(loginData.Password, userPassword) {
-		return ctx.Status(401).JSON(map[string]string{
-			"error": "Bad credentials",
-		})
+		return newAPIError(401, "BAD_CREDENTIALS", "Bad credentials")
 	}
 
-	// Create access token
-	accessTokenString, err := generateAccessToken(userID, username, userEmail)
-	if err != nil {
+	// Forget failures of the account, the IP keeps its count so one account cannot reset it
+	if err = store.ClearLoginFailures(accountThrottle.key(loginData.Email)); err != nil {
 		log.Println(err.Error())
-		return ctx.SendStatus(500)
 	}
 
-	// Create refresh token
-	refreshTokenString, err := generateRefreshToken(userID, username, userEmail)
+	// Ask for the second factor before issuing tokens
+	body, err := loginBody(ctx, user)
 	if err != nil {
-		log.Println(err.Error())
-		return ctx.SendStatus(500)
+		return err
 	}
 
-	return ctx.Status(200).JSON(map[string]string{
-		"accessToken":  accessTokenString,
-		"refreshToken": refreshTokenString,
-		"username":     username,
-		"email":        userEmail,
-	})
+	return ctx.Status(200).JSON(body)
 }
 
 // Register registers new user to the app with email and password
@@ -209,117 +416,39 @@ func Register(ctx *fiber.Ctx) error {
 	registerData := new(RegisterData)
 
 	// Parse body (input data)
-	if err := ctx.BodyParser(registerData); err != nil {
-		return ctx.Status(400).JSON(map[string]string{
-			"error": "Cannot parse JSON",
-		})
-	}
-
-	// Validate email
-	if len(registerData.Email) == 0 {
-		return ctx.Status(400).JSON(map[string]string{
-			"error": "Empty email",
-		})
-	} else if regex, _ := regexp.Compile(`\b[\w\.-]+@[\w\.-]+\.\w{2,4}\b`); !regex.MatchString(registerData.Email) {
-		return ctx.Status(400).JSON(map[string]string{
-			"error": "Invalid email format",
-		})
-	}
-
-	// Validate password
-	if len(registerData.Password) < 8 {
-		return ctx.Status(400).JSON(map[string]string{
-			"error": "Password too short (must be at least 8 characters)",
-		})
-	}
-
-	// Validate username
-	if len(registerData.Username) < 3 {
-		return ctx.Status(400).JSON(map[string]string{
-			"error": "Username too short (must be at least 3 characters)",
-		})
+	if err := parseBody(ctx, registerData); err != nil {
+		return err
 	}
 
 	// Check if username exist
-	result, err := db.Query("SELECT id FROM users WHERE username = ?", registerData.Username)
-	if err != nil {
-		log.Println(err.Error())
-		return ctx.Status(500).JSON(map[string]string{
-			"error": "Internal server error",
-		})
-	} else if result.Next() {
-		return ctx.Status(409).JSON(map[string]string{
-			"error": "Username already exist",
-		})
+	if exists, err := store.UsernameExists(registerData.Username); err != nil {
+		return err
+	} else if exists {
+		return errUsernameTaken
 	}
 
 	// Check if email has been used
-	result, err = db.Query("SELECT id FROM users WHERE email = ?", registerData.Email)
-	if err != nil {
-		log.Println(err.Error())
-		return ctx.Status(500).JSON(map[string]string{
-			"error": "Internal server error",
-		})
-	} else if result.Next() {
-		return ctx.Status(409).JSON(map[string]string{
-			"error": "Email has been used",
-		})
+	if exists, err := store.EmailExists(registerData.Email); err != nil {
+		return err
+	} else if exists {
+		return errEmailTaken
 	}
 
 	// Encrypt password
 	hashedPassword, err := hashPassword(registerData.Password)
 	if err != nil {
-		log.Println(err.Error())
-		return ctx.Status(500).JSON(map[string]string{
-			"error": "Internal Server Error",
-		})
+		return err
 	}
 
 	// Create user in database
-	_, err = db.Exec("INSERT INTO users (username, email, password) values (?,?,?)", registerData.Username, registerData.Email, hashedPassword)
+	userID, err := store.CreateUser(registerData.Username, registerData.Email, hashedPassword)
 	if err != nil {
-		log.Println(err.Error())
-		return ctx.Status(500).JSON(map[string]string{
-			"error": "Internal Sever Error",
-		})
+		return err
 	}
+	user := &User{ID: userID, Username: registerData.Username, Email: registerData.Email, Role: "user"}
 
-	// Get user ID
-	result, err = db.Query("SELECT id FROM users WHERE email = ?", registerData.Email)
-	if err != nil {
-		log.Println(err.Error())
-		return ctx.Status(500).JSON(map[string]string{
-			"error": "Internal Sever Error",
-		})
-	}
-	var userID int
-	result.Next()
-	err = result.Scan(&userID)
-	if err != nil {
-		log.Println(err.Error())
-		return ctx.Status(500).JSON(map[string]string{
-			"error": "Internal Sever Error",
-		})
-	}
-
-	// Create access token
-	accessTokenString, err := generateAccessToken(userID, registerData.Username, registerData.Email)
-	if err != nil {
-		log.Println(err.Error())
-		return ctx.SendStatus(500)
-	}
+	// Send email verification link
+	go sendEmailToken(user, verifyEmailPurpose)
 
-	// Create refresh token
-	refreshTokenString, err := generateRefreshToken(userID, registerData.Username, registerData.Email)
-	if err != nil {
-		log.Println(err.Error())
-		return ctx.SendStatus(500)
-	}
-
-	return ctx.Status(200).JSON(map[string]string{
-		"accessToken":  accessTokenString,
-		"refreshToken": refreshTokenString,
-		"username":     registerData.Username,
-		"email":        registerData.Email,
-	})
+	return respondWithTokens(ctx, user)
 }
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRefreshTokenRotation(t *testing.T) {
+	app, _ := newTestApp(t)
+	_, first := registerTestUser(t, app, "alice")
+	_, other := registerTestUser(t, app, "bob")
+
+	response, body := testRequest(t, app, "GET", "/api/v1/refresh", first, nil)
+	if response.StatusCode != 200 {
+		t.Fatalf("refresh responded with %d %v", response.StatusCode, body)
+	}
+	second := body["refreshToken"].(string)
+
+	// Steps run in order, reusing the first token revokes the one rotated from it but not other logins
+	for _, step := range []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"reused token", first, 401},
+		{"token rotated from the reused one", second, 401},
+		{"other login", other, 200},
+		{"access token", "not a refresh token", 401},
+	} {
+		if response, body := testRequest(t, app, "GET", "/api/v1/refresh", step.token, nil); response.StatusCode != step.status {
+			t.Errorf("%s: got %d %v, want %d", step.name, response.StatusCode, body, step.status)
+		}
+	}
+}
+
+func TestLogout(t *testing.T) {
+	app, _ := newTestApp(t)
+	access, first := registerTestUser(t, app, "alice")
+	_, body := testRequest(t, app, "GET", "/api/v1/refresh", first, nil)
+	second := body["refreshToken"].(string)
+	_, other := registerTestUser(t, app, "bob")
+
+	// Logging out ends the session of the token, logging out everywhere ends every session of the user
+	if response, _ := testRequest(t, app, "POST", "/api/v1/logout", second, nil); response.StatusCode != 204 {
+		t.Fatalf("logout responded with %d", response.StatusCode)
+	}
+	if response, _ := testRequest(t, app, "GET", "/api/v1/refresh", second, nil); response.StatusCode != 401 {
+		t.Errorf("refresh after the logout responded with %d", response.StatusCode)
+	}
+
+	_, body = testRequest(t, app, "POST", "/api/v1/login", "", map[string]string{"email": "alice@example.com", "password": "password1"})
+	if response, _ := testRequest(t, app, "POST", "/api/v1/logout-all", access, nil); response.StatusCode != 204 {
+		t.Fatalf("logout-all responded with %d", response.StatusCode)
+	}
+	if response, _ := testRequest(t, app, "GET", "/api/v1/refresh", body["refreshToken"].(string), nil); response.StatusCode != 401 {
+		t.Errorf("refresh of another session after logout-all responded with %d", response.StatusCode)
+	}
+	if response, _ := testRequest(t, app, "GET", "/api/v1/refresh", other, nil); response.StatusCode != 200 {
+		t.Errorf("refresh of another user after logout-all responded with %d", response.StatusCode)
+	}
+}
+
+func TestRoleProtection(t *testing.T) {
+	app, _ := newTestApp(t)
+	access, _ := registerTestUser(t, app, "alice")
+
+	tests := []struct {
+		method, path string
+		body         interface{}
+	}{
+		{"POST", "/api/v1/movies", map[string]interface{}{"title": "Dune"}},
+		{"DELETE", "/api/v1/movies/1", nil},
+		{"DELETE", "/api/v1/moderation/reviews/1", nil},
+		{"PUT", "/api/v1/admin/users/1/role", map[string]string{"role": "admin"}},
+	}
+
+	for _, test := range tests {
+		if response, body := testRequest(t, app, test.method, test.path, access, test.body); response.StatusCode != 403 {
+			t.Errorf("%s %s responded with %d %v", test.method, test.path, response.StatusCode, body)
+		}
+		if response, _ := testRequest(t, app, test.method, test.path, "", test.body); response.StatusCode != 401 {
+			t.Errorf("%s %s without a token responded with %d", test.method, test.path, response.StatusCode)
+		}
+	}
+}
+
+func TestSetUserRole(t *testing.T) {
+	app, _ := newTestApp(t)
+	_, adminRefresh := registerTestUser(t, app, "alice")
+	_, refresh := registerTestUser(t, app, "bob")
+	admin, err := store.GetUserByEmail("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := store.GetUserByEmail("bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Roles are read again when tokens are refreshed
+	if err = store.SetUserRole(admin.ID, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	_, body := testRequest(t, app, "GET", "/api/v1/refresh", adminRefresh, nil)
+	adminAccess := body["accessToken"].(string)
+
+	response, body := testRequest(t, app, "PUT", fmt.Sprintf("/api/v1/admin/users/%d/role", user.ID), adminAccess, map[string]string{"role": "moderator"})
+	if response.StatusCode != 200 || body["role"] != "moderator" {
+		t.Fatalf("set role responded with %d %v", response.StatusCode, body)
+	}
+	if response, body := testRequest(t, app, "PUT", fmt.Sprintf("/api/v1/admin/users/%d/role", admin.ID), adminAccess, map[string]string{"role": "user"}); response.StatusCode != 400 {
+		t.Errorf("admin demoting themselves responded with %d %v", response.StatusCode, body)
+	}
+
+	_, body = testRequest(t, app, "GET", "/api/v1/refresh", refresh, nil)
+	if response, body := testRequest(t, app, "POST", "/api/v1/movies", body["accessToken"].(string), map[string]interface{}{"title": "Dune"}); response.StatusCode != 201 {
+		t.Errorf("moderator adding a movie responded with %d %v", response.StatusCode, body)
+	}
+}
+
+func TestLoginThrottling(t *testing.T) {
+	app, _ := newTestApp(t)
+	registerTestUser(t, app, "alice")
+
+	login := func(email, password string) (int, string) {
+		response, _ := testRequest(t, app, "POST", "/api/v1/login", "", map[string]string{"email": email, "password": password})
+		return response.StatusCode, response.Header.Get("Retry-After")
+	}
+
+	if status, _ := login("alice@example.com", "password1"); status != 200 {
+		t.Fatalf("login responded with %d", status)
+	}
+
+	for i := 0; i <= accountThrottle.FreeAttempts; i++ {
+		if status, _ := login("alice@example.com", "wrong password"); status != 401 {
+			t.Fatalf("failure %d responded with %d", i+1, status)
+		}
+		if status, _ := login("nobody@example.com", "password1"); status != 401 {
+			t.Fatalf("failure %d of an unknown email responded with %d", i+1, status)
+		}
+	}
+
+	// Even the right password has to wait once the account is throttled, unknown emails are throttled alike
+	if status, retryAfter := login("alice@example.com", "password1"); status != 429 || retryAfter != "2" {
+		t.Errorf("throttled login responded with %d, Retry-After %q", status, retryAfter)
+	}
+	if status, retryAfter := login("nobody@example.com", "password1"); status != 429 || retryAfter != "2" {
+		t.Errorf("throttled login of an unknown email responded with %d, Retry-After %q", status, retryAfter)
+	}
+}
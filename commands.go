@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// Usage of the command line
+const usage = `usage: movie_rater [command]
+
+Without a command the API server is started.
+
+Commands:
+  migrate up       apply every pending migration
+  migrate down     revert the latest migration
+  migrate status   list migrations and whether they are applied
+  recompute-ratings
+                   rebuild every movie's average rating and rater count from its reviews
+  promote-admin <email>
+                   give the account with the email the admin role`
+
+// Runs a command line subcommand
+func runCommand(args []string) error {
+	switch args[0] {
+	case "migrate":
+		return runMigrate(args[1:])
+	case "recompute-ratings":
+		if err := store.RecomputeRatings(); err != nil {
+			return err
+		}
+		log.Println("Ratings recomputed")
+		return nil
+	case "promote-admin":
+		if len(args) != 2 {
+			return errors.New(usage)
+		}
+		if config.DatabaseDriver == "memory" {
+			return errors.New("the memory driver keeps no accounts between runs, list the email in ADMIN_EMAILS instead")
+		}
+		return promoteAdmin(args[1])
+	case "help", "-h", "--help":
+		fmt.Println(usage)
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q\n%s", args[0], usage)
+	}
+}
+
+// Runs the migrate subcommand
+func runMigrate(args []string) error {
+	db := storeDB(store)
+	if db == nil {
+		return errors.New("the " + config.DatabaseDriver + " driver has no schema to migrate")
+	}
+
+	if len(args) != 1 {
+		return errors.New(usage)
+	}
+
+	switch args[0] {
+	case "up":
+		return migrateUp(db)
+	case "down":
+		return migrateDown(db)
+	case "status":
+		return migrationStatus(db)
+	default:
+		return fmt.Errorf("unknown migrate command %q\n%s", args[0], usage)
+	}
+}
+
+// Gives an existing account the admin role, used to bootstrap the first admin
+func promoteAdmin(email string) error {
+	user, err := store.GetUserByEmail(email)
+	if err == errNotFound {
+		return fmt.Errorf("no account with email %q", email)
+	} else if err != nil {
+		return err
+	}
+
+	if err := store.SetUserRole(user.ID, "admin"); err != nil {
+		return err
+	}
+	log.Printf("User %d (%s) promoted to admin\n", user.ID, user.Username)
+	return nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Config holds every setting the app reads at startup
+type Config struct {
+	Port           string
+	DatabaseDriver string
+	DatabaseDSN    string
+	JWTKeys        *JWTKeys
+	ReplaceReviews bool
+	Mailer         MailSender
+	// Base URL of the client app, links in emails point at it
+	AppURL string
+	// Actions accounts with an unverified email cannot take, out of verifiedActions
+	VerifiedEmailRequired map[string]bool
+	// Users with at least this role must enrol in 2FA before using role protected routes, none if empty
+	TwoFactorRole string
+	// Base URL the API is reached at, OIDC providers redirect back to it
+	APIURL string
+	// OpenID Connect providers users can login with, by name
+	OIDCProviders map[string]*OIDCProvider
+	// Emails of accounts made admins once verified
+	AdminEmails map[string]bool
+}
+
+// Actions REQUIRE_VERIFIED_EMAIL can restrict to verified accounts
+var verifiedActions = []string{"review", "movie"}
+
+// Config file used when CONFIG_FILE is not set
+const defaultConfigFile = ".env"
+
+// Loads config from an optional .env style file, then from environment variables
+func loadConfig() (*Config, error) {
+	values := map[string]string{}
+
+	// Read config file (environment variables take precedence)
+	path, explicit := os.LookupEnv("CONFIG_FILE")
+	if !explicit {
+		path = defaultConfigFile
+	}
+	if err := readConfigFile(path, values); err != nil {
+		if explicit || !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	for _, key := range []string{"PORT", "DB_DRIVER", "DB_DSN", "JWT_SIGNING_KEY_FILE", "JWT_VERIFICATION_KEY_FILES", "REVIEW_CONFLICT",
+		"MAIL_DRIVER", "MAIL_FILE", "MAIL_FROM", "SMTP_ADDR", "SMTP_USERNAME", "SMTP_PASSWORD", "APP_URL", "REQUIRE_VERIFIED_EMAIL", "REQUIRE_2FA_ROLE",
+		"API_URL", "OIDC_PROVIDERS", "ADMIN_EMAILS"} {
+		if value, ok := os.LookupEnv(key); ok {
+			values[key] = value
+		}
+	}
+
+	cfg := &Config{
+		Port:           values["PORT"],
+		DatabaseDriver: values["DB_DRIVER"],
+		DatabaseDSN:    values["DB_DSN"],
+		AppURL:         strings.TrimSuffix(values["APP_URL"], "/"),
+		APIURL:         strings.TrimSuffix(values["API_URL"], "/"),
+	}
+
+	if cfg.Port == "" {
+		cfg.Port = "8080"
+	}
+	if cfg.DatabaseDriver == "" {
+		cfg.DatabaseDriver = "mysql"
+	}
+	if cfg.AppURL == "" {
+		cfg.AppURL = "http://localhost:" + cfg.Port
+	}
+	if cfg.APIURL == "" {
+		cfg.APIURL = "http://localhost:" + cfg.Port
+	}
+
+	var problems []string
+
+	// Keys tokens are signed and verified with
+	if values["JWT_SIGNING_KEY_FILE"] == "" {
+		problems = append(problems, "JWT_SIGNING_KEY_FILE is required")
+	} else if keys, err := loadJWTKeys(values["JWT_SIGNING_KEY_FILE"], splitFileList(values["JWT_VERIFICATION_KEY_FILES"])); err != nil {
+		problems = append(problems, "cannot load JWT keys: "+err.Error())
+	} else {
+		cfg.JWTKeys = keys
+	}
+
+	// What a second review of the same movie by the same user does
+	switch values["REVIEW_CONFLICT"] {
+	case "", "reject":
+	case "replace":
+		cfg.ReplaceReviews = true
+	default:
+		problems = append(problems, "REVIEW_CONFLICT must be reject or replace")
+	}
+
+	// How emails are sent, required as the log driver writes the links of reset and verification emails to the log
+	switch values["MAIL_DRIVER"] {
+	case "":
+		problems = append(problems, "MAIL_DRIVER is required")
+	case "log":
+		cfg.Mailer = &FileSender{}
+	case "file":
+		if values["MAIL_FILE"] == "" {
+			problems = append(problems, "MAIL_FILE is required when MAIL_DRIVER is file")
+		}
+		cfg.Mailer = &FileSender{Path: values["MAIL_FILE"]}
+	case "smtp":
+		if values["SMTP_ADDR"] == "" || values["MAIL_FROM"] == "" {
+			problems = append(problems, "SMTP_ADDR and MAIL_FROM are required when MAIL_DRIVER is smtp")
+		}
+		cfg.Mailer = &SMTPSender{
+			Addr:     values["SMTP_ADDR"],
+			Username: values["SMTP_USERNAME"],
+			Password: values["SMTP_PASSWORD"],
+			From:     values["MAIL_FROM"],
+		}
+	default:
+		problems = append(problems, "MAIL_DRIVER must be log, file or smtp")
+	}
+
+	// What accounts with an unverified email cannot do
+	cfg.VerifiedEmailRequired = map[string]bool{}
+	required, ok := values["REQUIRE_VERIFIED_EMAIL"]
+	if !ok {
+		required = "review"
+	}
+	for _, action := range strings.Split(required, ",") {
+		action = strings.TrimSpace(action)
+		if action == "" || action == "none" {
+			continue
+		}
+		for _, known := range verifiedActions {
+			if action == known {
+				cfg.VerifiedEmailRequired[action] = true
+			}
+		}
+		if !cfg.VerifiedEmailRequired[action] {
+			problems = append(problems, "REQUIRE_VERIFIED_EMAIL must list any of "+strings.Join(verifiedActions, ", ")+" or be none")
+			break
+		}
+	}
+
+	// Who has to use 2FA
+	switch role := values["REQUIRE_2FA_ROLE"]; role {
+	case "", "none":
+	case "moderator", "admin":
+		cfg.TwoFactorRole = role
+	default:
+		problems = append(problems, "REQUIRE_2FA_ROLE must be moderator, admin or none")
+	}
+
+	// OpenID Connect providers, each configured by OIDC_<NAME>_ISSUER, OIDC_<NAME>_CLIENT_ID and OIDC_<NAME>_CLIENT_SECRET
+	cfg.OIDCProviders = map[string]*OIDCProvider{}
+	for _, name := range splitFileList(values["OIDC_PROVIDERS"]) {
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		for _, setting := range []string{"ISSUER", "CLIENT_ID", "CLIENT_SECRET"} {
+			if value, ok := os.LookupEnv(prefix + setting); ok {
+				values[prefix+setting] = value
+			}
+		}
+
+		if !oidcProviderName.MatchString(name) {
+			problems = append(problems, "OIDC_PROVIDERS names must be lower case letters and digits: "+name)
+		} else if values[prefix+"ISSUER"] == "" || values[prefix+"CLIENT_ID"] == "" {
+			problems = append(problems, prefix+"ISSUER and "+prefix+"CLIENT_ID are required")
+		} else {
+			cfg.OIDCProviders[name] = &OIDCProvider{
+				Name:         name,
+				Issuer:       strings.TrimSuffix(values[prefix+"ISSUER"], "/"),
+				ClientID:     values[prefix+"CLIENT_ID"],
+				ClientSecret: values[prefix+"CLIENT_SECRET"],
+			}
+		}
+	}
+
+	// Accounts bootstrapped as admins
+	cfg.AdminEmails = map[string]bool{}
+	for _, email := range splitFileList(values["ADMIN_EMAILS"]) {
+		if !validationPatterns["email"].Regexp.MatchString(email) {
+			problems = append(problems, "ADMIN_EMAILS must be comma separated email addresses: "+email)
+		}
+		cfg.AdminEmails[email] = true
+	}
+
+	if err := cfg.validate(problems); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Reads KEY=VALUE lines into values, ignoring blank lines and # comments
+func readConfigFile(path string, values map[string]string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		line = strings.TrimPrefix(line, "export ")
+		sep := strings.Index(line, "=")
+		if sep < 1 {
+			return fmt.Errorf("%s:%d: expected KEY=VALUE", path, lineNum)
+		}
+
+		key := strings.TrimSpace(line[:sep])
+		value := strings.TrimSpace(line[sep+1:])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		values[key] = value
+	}
+
+	return scanner.Err()
+}
+
+// Checks that every required setting is present and sane, problems found while loading are reported too
+func (cfg *Config) validate(problems []string) error {
+	if port, err := strconv.Atoi(cfg.Port); err != nil || port < 1 || port > 65535 {
+		problems = append(problems, "PORT must be a number between 1 and 65535")
+	}
+
+	switch cfg.DatabaseDriver {
+	case "mysql":
+		if cfg.DatabaseDSN == "" {
+			problems = append(problems, "DB_DSN is required when DB_DRIVER is mysql")
+		}
+	case "memory":
+	default:
+		problems = append(problems, "DB_DRIVER must be mysql or memory")
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid config:\n  " + strings.Join(problems, "\n  "))
+	}
+
+	return nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMailDriverRequired(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".env")
+	if err := os.WriteFile(path, []byte("DB_DRIVER=memory\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+
+	for driver, required := range map[string]bool{"": true, "log": false} {
+		t.Setenv("MAIL_DRIVER", driver)
+
+		_, err := loadConfig()
+		if err == nil || strings.Contains(err.Error(), "MAIL_DRIVER is required") != required {
+			t.Errorf("MAIL_DRIVER %q: got %v", driver, err)
+		}
+	}
+}
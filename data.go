@@ -2,36 +2,94 @@ package main
 
 import (
 	"log"
-	"math"
+	"strconv"
+	"time"
 
-	"github.com/dgrijalva/jwt-go"
 	"github.com/gofiber/fiber/v2"
 )
 
 // Movie struct
 type Movie struct {
-	ID        int
-	Title     string
-	AvgRating float64
+	ID               int      `json:"id"`
+	Title            string   `json:"title"`
+	ReleaseYear      int      `json:"releaseYear"`
+	Runtime          int      `json:"runtime"`
+	Synopsis         string   `json:"synopsis"`
+	OriginalLanguage string   `json:"originalLanguage"`
+	Genres           []string `json:"genres"`
+	PosterURL        string   `json:"posterUrl"`
+	IMDbID           string   `json:"imdbId"`
+	TMDbID           int      `json:"tmdbId"`
+	AvgRating        float64  `json:"avgRating"`
+	RaterNum         int      `json:"raterNum"`
 }
 
 // Review struct
 type Review struct {
-	ID       int
-	Rating   int
-	Comment  string
-	Username string
+	ID        int       `json:"id"`
+	MovieID   int       `json:"movieId"`
+	Rating    int       `json:"rating"`
+	Comment   string    `json:"comment"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
 }
 
-// NewMovie struct
+// UserReview is a review of a user with the title of the movie
+type UserReview struct {
+	Review
+	MovieTitle string `json:"movieTitle"`
+}
+
+// ReviewPage struct
+type ReviewPage struct {
+	Movie *Movie `json:"movie"`
+	Page
+}
+
+// NewMovie struct, zero values mean unknown
 type NewMovie struct {
-	Title string `json:"title"`
+	Title            string   `json:"title" normalize:"line" validate:"required,min=3,max=75"`
+	ReleaseYear      int      `json:"releaseYear" validate:"omitempty,min=1870"`
+	Runtime          int      `json:"runtime" validate:"min=0,max=1000"` // Minutes
+	Synopsis         string   `json:"synopsis" normalize:"text" validate:"max=2000"`
+	OriginalLanguage string   `json:"originalLanguage" normalize:"line,lower" validate:"omitempty,pattern=language"` // ISO 639-1 code
+	Genres           []string `json:"genres" normalize:"line,lower" validate:"dive,required,max=30"`
+	PosterURL        string   `json:"posterUrl" normalize:"line" validate:"omitempty,url,max=500"`
+	IMDbID           string   `json:"imdbId" normalize:"line" validate:"omitempty,pattern=imdbId"`
+	TMDbID           int      `json:"tmdbId" validate:"min=0"`
 }
 
 // NewReview struct
 type NewReview struct {
-	Rating  int    `json:"rating"`
-	Comment string `json:"comment"`
+	Rating  *int   `json:"rating" validate:"required,min=0,max=5"`
+	Comment string `json:"comment" normalize:"text" validate:"max=500"`
+}
+
+// Validates what the tags of the movie cannot, genres are stored without duplicates
+func (newMovie *NewMovie) validate() []FieldError {
+	problems := []FieldError{}
+
+	if newMovie.ReleaseYear > time.Now().Year()+10 {
+		problems = append(problems, FieldError{Field: "releaseYear", Message: "releaseYear must be at most " + strconv.Itoa(time.Now().Year()+10)})
+	}
+
+	genres := []string{}
+	for _, genre := range newMovie.Genres {
+		duplicate := false
+		for _, other := range genres {
+			duplicate = duplicate || other == genre
+		}
+		if !duplicate {
+			genres = append(genres, genre)
+		}
+	}
+	if len(genres) > 10 {
+		problems = append(problems, FieldError{Field: "genres", Message: "genres must be at most 10 items"})
+	}
+	newMovie.Genres = genres
+
+	return problems
 }
 
 // Home shows message
@@ -40,166 +98,378 @@ func Home(ctx *fiber.Ctx) error {
 	return nil
 }
 
-// GetMovies gets all movie data from database
+// GetMovies gets a page of movie data from database
 func GetMovies(ctx *fiber.Ctx) error {
-	result, err := db.Query("SELECT id, title, avgRating FROM movies;")
+	page, limit, err := parsePagination(ctx)
 	if err != nil {
-		log.Println(err.Error())
-		return ctx.Status(500).JSON(fiber.Map{
-			"error": "Internal server error",
-		})
+		return err
+	}
+
+	query := MovieQuery{
+		Sort:   ctx.Query("sort", "newest"),
+		Limit:  limit,
+		Offset: (page - 1) * limit,
 	}
 
-	var movies []Movie
-	for result.Next() {
-		var movie Movie
-		err = result.Scan(&movie.ID, &movie.Title, &movie.AvgRating)
-		if err != nil {
-			log.Println(err)
-			return ctx.Status(500).JSON(map[string]string{
-				"error": "Internal server error",
-			})
+	// Validate sort
+	validSort := false
+	for _, sort := range movieSorts {
+		validSort = validSort || sort == query.Sort
+	}
+	if !validSort {
+		return validationError("sort", "sort must be one of newest, rating, title, most_rated")
+	}
+
+	// Validate filters
+	if value := ctx.Query("minRating"); value != "" {
+		if query.MinRating, err = strconv.ParseFloat(value, 64); err != nil || query.MinRating < 0 || query.MinRating > 5 {
+			return validationError("minRating", "minRating must be a number between 0 and 5")
 		}
+	}
+	if value := ctx.Query("minRaters"); value != "" {
+		if query.MinRaters, err = strconv.Atoi(value); err != nil || query.MinRaters < 0 {
+			return validationError("minRaters", "minRaters must be a non-negative number")
+		}
+	}
+
+	movies, total, err := store.GetMovies(query)
+	if err != nil {
+		return err
+	}
+
+	return ctx.Status(200).JSON(versionedBody(ctx, newPage(ctx, movies, page, limit, total)))
+}
+
+// SearchMovies finds movies matching the q query, most relevant first
+func SearchMovies(ctx *fiber.Ctx) error {
+	page, limit, err := parsePagination(ctx)
+	if err != nil {
+		return err
+	}
+
+	query := ctx.Query("q")
+	if err = validateSearchQuery(query); err != nil {
+		return err
+	}
+	if len(tokenize(query)) == 0 {
+		return validationError("q", "q must contain at least one word")
+	}
+
+	movies, total := searchIndex.Search(query, limit, (page-1)*limit)
+	return ctx.Status(200).JSON(versionedBody(ctx, newPage(ctx, movies, page, limit, total)))
+}
+
+// SuggestMovies suggests movie titles starting with the q query
+func SuggestMovies(ctx *fiber.Ctx) error {
+	limit, err := strconv.Atoi(ctx.Query("limit", "10"))
+	if err != nil || limit < 1 || limit > 20 {
+		return validationError("limit", "limit must be a number between 1 and 20")
+	}
 
-		movies = append(movies, movie)
+	query := ctx.Query("q")
+	if err = validateSearchQuery(query); err != nil {
+		return err
 	}
 
-	return ctx.Status(200).JSON(movies)
+	return ctx.Status(200).JSON(versionedBody(ctx, searchIndex.Suggest(query, limit)))
+}
+
+// Validates the size of the q query of search and suggest
+func validateSearchQuery(query string) error {
+	if len(query) > maxQueryBytes {
+		return validationError("q", "q must be at most 200 bytes")
+	} else if len(tokenize(query)) > maxQueryTokens {
+		return validationError("q", "q must contain at most 10 words")
+	}
+	return nil
 }
 
-// GetReviews gets all review data from database
+// GetReviews gets a page of review data of a movie from database
 func GetReviews(ctx *fiber.Ctx) error {
-	movieID := ctx.Params("id")
-	result, err := db.Query("SELECT reviews.id, rating, comment, username FROM reviews INNER JOIN users ON userId = users.id WHERE movieId = ?;", movieID)
+	movieID, err := strconv.Atoi(ctx.Params("id"))
 	if err != nil {
-		log.Println(err.Error())
-		return ctx.Status(500).JSON(map[string]string{
-			"error": "Internal server error",
-		})
+		return errInvalidMovieID
+	}
+
+	page, limit, err := parsePagination(ctx)
+	if err != nil {
+		return err
+	}
+
+	query := ReviewQuery{
+		MovieID: movieID,
+		Sort:    ctx.Query("sort", "newest"),
+		Limit:   limit,
+		Offset:  (page - 1) * limit,
 	}
 
-	var reviews []Review
-	for result.Next() {
-		var review Review
-		err = result.Scan(&review.ID, &review.Rating, &review.Comment, &review.Username)
+	// Validate sort
+	validSort := false
+	for _, sort := range reviewSorts {
+		validSort = validSort || sort == query.Sort
+	}
+	if !validSort {
+		return validationError("sort", "sort must be one of newest, oldest, highest, lowest")
+	}
 
-		if err != nil {
-			log.Println(err.Error())
-			return ctx.Status(500).JSON(map[string]string{
-				"error": "Internal server error",
-			})
+	// Validate filter
+	if value := ctx.Query("rating"); value != "" {
+		rating, err := strconv.Atoi(value)
+		if err != nil || rating < 0 || rating > 5 {
+			return validationError("rating", "rating must be a number between 0 and 5")
 		}
+		query.Rating = &rating
+	}
 
-		reviews = append(reviews, review)
+	// Get the movie summary
+	movie, err := store.GetMovie(movieID)
+	if err == errNotFound {
+		return errMovieNotFound
+	} else if err != nil {
+		return err
+	}
+
+	reviews, total, err := store.GetReviews(query)
+	if err != nil {
+		return err
 	}
 
-	return ctx.Status(200).JSON(reviews)
+	return ctx.Status(200).JSON(versionedBody(ctx, ReviewPage{
+		Movie: movie,
+		Page:  newPage(ctx, reviews, page, limit, total),
+	}))
 }
 
 // AddMovie adds a new movie to database
 func AddMovie(ctx *fiber.Ctx) error {
 	newMovie := new(NewMovie)
-	if err := ctx.BodyParser(newMovie); err != nil {
-		log.Println(err.Error())
-		return ctx.Status(500).JSON(map[string]string{
-			"error": "Internal server error",
-		})
+	if err := parseBody(ctx, newMovie); err != nil {
+		return err
 	}
 
-	// Validate movie title
-	if len(newMovie.Title) < 3 {
-		return ctx.Status(400).JSON(map[string]string{
-			"error": "Movie title too short (must be at least 3 characters)",
-		})
+	// Inserts new movie to database
+	movieID, err := store.CreateMovie(*newMovie)
+	if err != nil {
+		return err
 	}
 
-	// Inserts new movie to database
-	_, err := db.Exec("INSERT INTO movies (title) values (?);", newMovie.Title)
+	// Get the created movie
+	movie, err := store.GetMovie(movieID)
 	if err != nil {
-		log.Println(err.Error())
-		return ctx.Status(500).JSON(map[string]string{
-			"error": "Internal server error",
-		})
+		return err
 	}
-	return ctx.Status(201).JSON(map[string]string{
-		"success": "Movie successfully inserted",
-	})
+
+	searchIndex.Add(*movie)
+
+	ctx.Location(apiV1Prefix + "/movies/" + strconv.Itoa(movieID))
+	return ctx.Status(201).JSON(versionedBody(ctx, movie))
+}
+
+// GetMovie gets a movie from database
+func GetMovie(ctx *fiber.Ctx) error {
+	movieID, err := strconv.Atoi(ctx.Params("id"))
+	if err != nil {
+		return errInvalidMovieID
+	}
+
+	movie, err := store.GetMovie(movieID)
+	if err == errNotFound {
+		return errMovieNotFound
+	} else if err != nil {
+		return err
+	}
+
+	return ctx.Status(200).JSON(versionedBody(ctx, movie))
+}
+
+// UpdateMovie updates a movie in database, fields missing from the body are kept
+func UpdateMovie(ctx *fiber.Ctx) error {
+	movieID, err := strconv.Atoi(ctx.Params("id"))
+	if err != nil {
+		return errInvalidMovieID
+	}
+
+	// Get the current movie
+	movie, err := store.GetMovie(movieID)
+	if err == errNotFound {
+		return errMovieNotFound
+	} else if err != nil {
+		return err
+	}
+
+	// Parse body over the current movie
+	newMovie := &NewMovie{
+		Title:            movie.Title,
+		ReleaseYear:      movie.ReleaseYear,
+		Runtime:          movie.Runtime,
+		Synopsis:         movie.Synopsis,
+		OriginalLanguage: movie.OriginalLanguage,
+		Genres:           movie.Genres,
+		PosterURL:        movie.PosterURL,
+		IMDbID:           movie.IMDbID,
+		TMDbID:           movie.TMDbID,
+	}
+	if err := parseBody(ctx, newMovie); err != nil {
+		return err
+	}
+
+	// Update movie in database
+	err = store.UpdateMovie(movieID, *newMovie)
+	if err == errNotFound {
+		return errMovieNotFound
+	} else if err != nil {
+		return err
+	}
+
+	// Get the updated movie
+	movie, err = store.GetMovie(movieID)
+	if err != nil {
+		return err
+	}
+
+	searchIndex.Add(*movie)
+
+	return ctx.Status(200).JSON(versionedBody(ctx, movie))
+}
+
+// DeleteMovie deletes a movie and its reviews from database
+func DeleteMovie(ctx *fiber.Ctx) error {
+	movieID, err := strconv.Atoi(ctx.Params("id"))
+	if err != nil {
+		return errInvalidMovieID
+	}
+
+	err = store.DeleteMovie(movieID)
+	if err == errNotFound {
+		return errMovieNotFound
+	} else if err != nil {
+		return err
+	}
+
+	searchIndex.Remove(movieID)
+
+	return ctx.SendStatus(204)
 }
 
 // AddReview adds a new review to database
 func AddReview(ctx *fiber.Ctx) error {
-	user := ctx.Locals("user").(*jwt.Token)
-	claims := user.Claims.(jwt.MapClaims)
-	userID := claims["id"].(float64)
-	movieID := ctx.Params("id")
+	userID := userIDFromToken(ctx)
+	movieID, err := strconv.Atoi(ctx.Params("id"))
+	if err != nil {
+		return errInvalidMovieID
+	}
+
 	newReview := new(NewReview)
-	if err := ctx.BodyParser(newReview); err != nil {
-		log.Println(err.Error())
-		return ctx.Status(400).JSON(err.Error())
+	if err := parseBody(ctx, newReview); err != nil {
+		return err
 	}
 
-	// Validate rating
-	if newReview.Rating < 0.0 || newReview.Rating > 5.0 {
-		return ctx.Status(400).JSON(map[string]string{
-			"error": "Rating out of range (should be 0 - 5)",
-		})
+	// Insert new review and update the movie rating
+	_, replaced, err := store.CreateReview(movieID, userID, *newReview.Rating, newReview.Comment, config.ReplaceReviews)
+	// Check movie existance
+	if err == errNotFound {
+		return errMovieNotFound
+	} else if err == errDuplicate {
+		return newAPIError(409, "REVIEW_EXISTS", "Movie already reviewed (edit the existing review instead)")
+	} else if err != nil {
+		return err
 	}
 
-	// Validate comment
-	if len(newReview.Comment) > 500 {
-		return ctx.Status(400).JSON(map[string]string{
-			"error": "Comment exceeded limit (500 characters)",
+	// Refresh the rating in the search index
+	if err = reindexMovie(movieID); err != nil {
+		log.Println(err.Error())
+	}
+
+	if replaced {
+		return ctx.Status(200).JSON(map[string]string{
+			"success": "Review successfully replaced",
 		})
 	}
 
-	// Get movie from the database
-	result, err := db.Query("SELECT avgRating, raterNum FROM movies WHERE id = ?", movieID)
+	return ctx.Status(201).JSON(map[string]string{
+		"success": "Review successfully inserted",
+	})
+}
+
+// UpdateReview changes a review written by the user
+func UpdateReview(ctx *fiber.Ctx) error {
+	userID := userIDFromToken(ctx)
+	reviewID, err := strconv.Atoi(ctx.Params("reviewId"))
 	if err != nil {
-		log.Println(err.Error())
-		return ctx.Status(500).JSON(map[string]string{
-			"error": "Internal server error",
-		})
+		return errInvalidReviewID
 	}
 
-	var avgRating float64
-	var raterNum int
-	isMovieExist := result.Next() // Returns false if no data within result (which means movie is not found)
-	// Check movie existance
-	if !isMovieExist {
-		return ctx.Status(500).JSON(map[string]string{
-			"error": "Movie does not exist",
-		})
+	// Get the current review
+	review, err := store.GetReview(reviewID)
+	if err == errNotFound {
+		return errReviewNotFound
+	} else if err != nil {
+		return err
 	}
 
-	if err = result.Scan(&avgRating, &raterNum); err != nil {
-		log.Println(err.Error())
-		return ctx.Status(500).JSON(map[string]string{
-			"error": "Internal server error",
-		})
+	// Parse body over the current review
+	newReview := &NewReview{
+		Rating:  &review.Rating,
+		Comment: review.Comment,
+	}
+	if err := parseBody(ctx, newReview); err != nil {
+		return err
 	}
 
-	// Calculate the new average rating
-	newAvgRating := (avgRating*float64(raterNum) + float64(newReview.Rating)) / float64(raterNum+1)
+	// Update review and the movie rating
+	err = store.UpdateReview(reviewID, userID, *newReview.Rating, newReview.Comment)
+	if err == errNotFound {
+		return errReviewNotFound
+	} else if err == errNotOwner {
+		return newAPIError(403, "NOT_REVIEW_AUTHOR", "Only the author can change a review")
+	} else if err != nil {
+		return err
+	}
 
-	// Update the avgRating and raterNum in the database
-	_, err = db.Exec("UPDATE movies SET avgRating = ?, raterNum = ? WHERE id = ?", math.Round(newAvgRating*10)/10, raterNum+1, movieID)
+	// Get the updated review
+	review, err = store.GetReview(reviewID)
 	if err != nil {
+		return err
+	}
+
+	// Refresh the rating in the search index
+	if err = reindexMovie(review.MovieID); err != nil {
 		log.Println(err.Error())
-		return ctx.Status(500).JSON(map[string]string{
-			"error": "Internal server error",
-		})
 	}
 
-	// Insert new review to database
-	_, err = db.Exec("INSERT INTO reviews (rating, comment, movieId, userId) VALUES (?, ?, ?, ?);", newReview.Rating, newReview.Comment, movieID, int(userID))
+	return ctx.Status(200).JSON(versionedBody(ctx, review))
+}
+
+// DeleteReview deletes a review written by the user
+func DeleteReview(ctx *fiber.Ctx) error {
+	userID := userIDFromToken(ctx)
+	reviewID, err := strconv.Atoi(ctx.Params("reviewId"))
 	if err != nil {
+		return errInvalidReviewID
+	}
+
+	// Get the movie of the review
+	review, err := store.GetReview(reviewID)
+	if err == errNotFound {
+		return errReviewNotFound
+	} else if err != nil {
+		return err
+	}
+
+	// Delete review and update the movie rating
+	err = store.DeleteReview(reviewID, userID)
+	if err == errNotFound {
+		return errReviewNotFound
+	} else if err == errNotOwner {
+		return newAPIError(403, "NOT_REVIEW_AUTHOR", "Only the author can delete a review")
+	} else if err != nil {
+		return err
+	}
+
+	// Refresh the rating in the search index
+	if err = reindexMovie(review.MovieID); err != nil {
 		log.Println(err.Error())
-		return ctx.Status(500).JSON(map[string]string{
-			"error": "Internal server error",
-		})
 	}
 
-	return ctx.Status(201).JSON(map[string]string{
-		"success": "Review successfully inserted",
-	})
+	return ctx.SendStatus(204)
 }
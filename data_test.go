@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestUpdateReview(t *testing.T) {
+	app, _ := newTestApp(t)
+	author, _ := registerTestUser(t, app, "alice")
+	other, _ := registerTestUser(t, app, "bob")
+
+	movieID, err := store.CreateMovie(NewMovie{Title: "Dune"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, body := testRequest(t, app, "POST", fmt.Sprintf("/api/v1/movies/%d/reviews", movieID), author, map[string]interface{}{"rating": 4, "comment": "Great"})
+	if response.StatusCode != 201 {
+		t.Fatalf("add review responded with %d %v", response.StatusCode, body)
+	}
+	user, err := store.GetUserByEmail("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reviews, err := store.GetUserReviews(user.ID)
+	if err != nil || len(reviews) != 1 {
+		t.Fatalf("got reviews %v, %v", reviews, err)
+	}
+	path := fmt.Sprintf("/api/v1/reviews/%d", reviews[0].ID)
+
+	// Steps run in order on the same review, fields left out keep their value
+	for _, step := range []struct {
+		name    string
+		token   string
+		path    string
+		body    map[string]interface{}
+		status  int
+		rating  float64
+		comment string
+	}{
+		{"only the comment", author, path, map[string]interface{}{"comment": "Long"}, 200, 4, "Long"},
+		{"only a zero rating", author, path, map[string]interface{}{"rating": 0}, 200, 0, "Long"},
+		{"nothing", author, path, map[string]interface{}{}, 200, 0, "Long"},
+		{"both", author, path, map[string]interface{}{"rating": 5, "comment": ""}, 200, 5, ""},
+		{"rating out of range", author, path, map[string]interface{}{"rating": 6}, 400, 0, ""},
+		{"not the author", other, path, map[string]interface{}{"rating": 1}, 403, 0, ""},
+		{"missing review", author, "/api/v1/reviews/999", map[string]interface{}{"rating": 1}, 404, 0, ""},
+	} {
+		response, body := testRequest(t, app, "PATCH", step.path, step.token, step.body)
+		if response.StatusCode != step.status {
+			t.Errorf("%s: got %d %v, want %d", step.name, response.StatusCode, body, step.status)
+		} else if step.status == 200 && (body["rating"] != step.rating || body["comment"] != step.comment) {
+			t.Errorf("%s: got %v", step.name, body)
+		}
+	}
+}
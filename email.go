@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Lifetimes of email tokens
+const (
+	verifyEmailLifetime   = time.Hour * 24
+	resetPasswordLifetime = time.Hour
+)
+
+// EmailTokenData struct
+type EmailTokenData struct {
+	Token string `json:"token"`
+}
+
+// ResetPasswordData struct
+type ResetPasswordData struct {
+	Token    string `json:"token"`
+	Password string `json:"password" validate:"required,min=8,max=72,maxbytes=72"`
+}
+
+// ForgotPasswordData struct
+type ForgotPasswordData struct {
+	Email string `json:"email" normalize:"line" validate:"required"`
+}
+
+// Hashes an email token, only hashes are stored so a leaked database does not leak usable tokens
+func hashEmailToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// Creates a single use token for the purpose and emails its link to the user, errors are logged as it runs in the background
+func sendEmailToken(user *User, purpose string) {
+	token, err := generateTokenID()
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	var subject, body string
+	var lifetime time.Duration
+	switch purpose {
+	case verifyEmailPurpose:
+		lifetime = verifyEmailLifetime
+		subject = "Verify your email"
+		body = "Hi " + user.Username + ",\n\n" +
+			"Confirm your email address by opening this link within 24 hours:\n\n" +
+			config.AppURL + "/verify-email?token=" + token + "\n"
+	case resetPasswordPurpose:
+		lifetime = resetPasswordLifetime
+		subject = "Reset your password"
+		body = "Hi " + user.Username + ",\n\n" +
+			"Choose a new password by opening this link within an hour:\n\n" +
+			config.AppURL + "/reset-password?token=" + token + "\n\n" +
+			"If you did not ask for a new password you can ignore this email.\n"
+	}
+
+	err = store.CreateEmailToken(EmailToken{
+		Hash:      hashEmailToken(token),
+		UserID:    user.ID,
+		Purpose:   purpose,
+		Email:     user.Email,
+		ExpiresAt: time.Now().Add(lifetime).UTC(),
+	})
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	if err = config.Mailer.Send(user.Email, subject, body); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// Uses up an email token of the purpose and gets its user, a token sent to an address the user no longer has is invalid
+func useEmailToken(rawToken, purpose string) (*User, error) {
+	token, err := store.UseEmailToken(hashEmailToken(rawToken), purpose)
+	if err == errNotFound {
+		return nil, errInvalidToken
+	} else if err != nil {
+		return nil, err
+	}
+
+	user, err := store.GetUserByID(token.UserID)
+	if err == errNotFound {
+		return nil, errInvalidToken
+	} else if err != nil {
+		return nil, err
+	}
+
+	if user.Email != token.Email {
+		return nil, errInvalidToken
+	}
+
+	return user, nil
+}
+
+// Refuses the request while the address or IP has asked for too many emails, otherwise counts it
+func throttleEmail(ctx *fiber.Ctx, email string, userID int) error {
+	ip := ctx.IP()
+	for _, throttle := range []struct {
+		policy throttlePolicy
+		value  string
+	}{{emailThrottle, email}, {emailIPThrottle, ip}} {
+		wait, err := throttle.policy.retryAfter(throttle.value)
+		if err != nil {
+			return err
+		} else if wait > 0 {
+			return tooManyAttempts(ctx, wait)
+		}
+	}
+
+	if err := emailThrottle.fail(email, userID, ip); err != nil {
+		return err
+	}
+	return emailIPThrottle.fail(ip, userID, ip)
+}
+
+// VerifyEmail marks the email of the user the verification token was sent to as verified
+func VerifyEmail(ctx *fiber.Ctx) error {
+	data := new(EmailTokenData)
+	if err := parseBody(ctx, data); err != nil {
+		return err
+	}
+
+	user, err := useEmailToken(data.Token, verifyEmailPurpose)
+	if err != nil {
+		return err
+	}
+
+	if err = store.SetEmailVerified(user.ID); err != nil {
+		return err
+	}
+	user.EmailVerified = true
+
+	if err = promoteListedAdmin(user); err != nil {
+		log.Println(err.Error())
+	}
+
+	return ctx.SendStatus(204)
+}
+
+// ResendVerification emails a new verification link to the user
+func ResendVerification(ctx *fiber.Ctx) error {
+	user, err := currentUser(ctx)
+	if err != nil {
+		return err
+	}
+
+	if user.EmailVerified {
+		return newAPIError(409, "EMAIL_ALREADY_VERIFIED", "Email already verified")
+	}
+
+	if err = throttleEmail(ctx, user.Email, user.ID); err != nil {
+		return err
+	}
+
+	go sendEmailToken(user, verifyEmailPurpose)
+
+	return ctx.SendStatus(202)
+}
+
+// ForgotPassword emails a password reset link if an account uses the email, the response is the same either way
+func ForgotPassword(ctx *fiber.Ctx) error {
+	data := new(ForgotPasswordData)
+	if err := parseBody(ctx, data); err != nil {
+		return err
+	}
+
+	// Counted whether or not an account uses the email, so throttling does not tell either
+	if err := throttleEmail(ctx, data.Email, anyUser); err != nil {
+		return err
+	}
+
+	// Look up and send in the background so the response time does not tell whether the account exists
+	go func(email string) {
+		user, err := store.GetUserByEmail(email)
+		if err == errNotFound {
+			return
+		} else if err != nil {
+			log.Println(err.Error())
+			return
+		}
+
+		sendEmailToken(user, resetPasswordPurpose)
+	}(data.Email)
+
+	return ctx.SendStatus(202)
+}
+
+// ResetPassword sets a new password with a reset token, every refresh token of the user is revoked
+func ResetPassword(ctx *fiber.Ctx) error {
+	data := new(ResetPasswordData)
+	if err := parseBody(ctx, data); err != nil {
+		return err
+	}
+
+	user, err := useEmailToken(data.Token, resetPasswordPurpose)
+	if err != nil {
+		return err
+	}
+
+	hashedPassword, err := hashPassword(data.Password)
+	if err != nil {
+		return err
+	}
+
+	if err = store.SetUserPassword(user.ID, hashedPassword); err != nil {
+		return err
+	}
+
+	// The reset link was sent to the email, so it is verified too
+	if err = store.SetEmailVerified(user.ID); err != nil {
+		log.Println(err.Error())
+	} else {
+		user.EmailVerified = true
+		if err = promoteListedAdmin(user); err != nil {
+			log.Println(err.Error())
+		}
+	}
+
+	// Sign out every session, whoever knew the old password included
+	if err = store.RevokeUserRefreshTokens(user.ID); err != nil {
+		return err
+	}
+
+	return ctx.SendStatus(204)
+}
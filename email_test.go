@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestVerifyEmail(t *testing.T) {
+	app, mailer := newTestApp(t)
+	registerTestUser(t, app, "alice")
+	token := mailer.waitForToken(t, "alice@example.com")
+
+	if response, body := testRequest(t, app, "POST", "/api/v1/verify-email", "", map[string]string{"token": token}); response.StatusCode != 204 {
+		t.Fatalf("verify responded with %d %v", response.StatusCode, body)
+	}
+	if user, err := store.GetUserByEmail("alice@example.com"); err != nil || !user.EmailVerified {
+		t.Errorf("email is not verified: %+v %v", user, err)
+	}
+	if response, _ := testRequest(t, app, "POST", "/api/v1/verify-email", "", map[string]string{"token": token}); response.StatusCode != 400 {
+		t.Errorf("reused token responded with %d", response.StatusCode)
+	}
+}
+
+func TestVerifiedEmailRequired(t *testing.T) {
+	app, mailer := newTestApp(t)
+	config.VerifiedEmailRequired["review"] = true
+	access, refresh := registerTestUser(t, app, "alice")
+	movieID, err := store.CreateMovie(NewMovie{Title: "Dune"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := fmt.Sprintf("/api/v1/movies/%d/reviews", movieID)
+
+	if response, _ := testRequest(t, app, "POST", path, access, map[string]interface{}{"rating": 4}); response.StatusCode != 403 {
+		t.Errorf("review of an unverified account responded with %d", response.StatusCode)
+	}
+
+	// Tokens issued after the verification carry it
+	testRequest(t, app, "POST", "/api/v1/verify-email", "", map[string]string{"token": mailer.waitForToken(t, "alice@example.com")})
+	_, body := testRequest(t, app, "GET", "/api/v1/refresh", refresh, nil)
+	if response, body := testRequest(t, app, "POST", path, body["accessToken"].(string), map[string]interface{}{"rating": 4}); response.StatusCode != 201 {
+		t.Errorf("review of a verified account responded with %d %v", response.StatusCode, body)
+	}
+}
+
+func TestVerifyEmailAfterChange(t *testing.T) {
+	app, mailer := newTestApp(t)
+	access, _ := registerTestUser(t, app, "eve")
+	oldToken := mailer.waitForToken(t, "eve@example.com")
+
+	// A token sent to the old address must not verify the address the account uses now
+	response, body := testRequest(t, app, "PATCH", "/api/v1/me", access, map[string]string{"email": "victim@example.com", "password": "password1"})
+	if response.StatusCode != 200 {
+		t.Fatalf("email change responded with %d %v", response.StatusCode, body)
+	}
+	if response, _ := testRequest(t, app, "POST", "/api/v1/verify-email", "", map[string]string{"token": oldToken}); response.StatusCode != 400 {
+		t.Errorf("token of the old address responded with %d", response.StatusCode)
+	}
+
+	newToken := mailer.waitForToken(t, "victim@example.com")
+	if response, _ := testRequest(t, app, "POST", "/api/v1/verify-email", "", map[string]string{"token": newToken}); response.StatusCode != 204 {
+		t.Errorf("token of the new address responded with %d", response.StatusCode)
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	app, mailer := newTestApp(t)
+	_, refresh := registerTestUser(t, app, "alice")
+	mailer.waitForToken(t, "alice@example.com")
+
+	if response, _ := testRequest(t, app, "POST", "/api/v1/password/forgot", "", map[string]string{"email": "alice@example.com"}); response.StatusCode != 202 {
+		t.Fatalf("forgot responded with %d", response.StatusCode)
+	}
+	token := mailer.waitForToken(t, "alice@example.com")
+
+	response, body := testRequest(t, app, "POST", "/api/v1/password/reset", "", map[string]string{"token": token, "password": "password2"})
+	if response.StatusCode != 204 {
+		t.Fatalf("reset responded with %d %v", response.StatusCode, body)
+	}
+
+	// Every session is signed out and only the new password works
+	if response, _ := testRequest(t, app, "GET", "/api/v1/refresh", refresh, nil); response.StatusCode != 401 {
+		t.Errorf("refresh after the reset responded with %d", response.StatusCode)
+	}
+	for password, status := range map[string]int{"password1": 401, "password2": 200} {
+		response, _ := testRequest(t, app, "POST", "/api/v1/login", "", map[string]string{"email": "alice@example.com", "password": password})
+		if response.StatusCode != status {
+			t.Errorf("login with %s responded with %d, want %d", password, response.StatusCode, status)
+		}
+	}
+	if response, _ := testRequest(t, app, "POST", "/api/v1/password/reset", "", map[string]string{"token": token, "password": "password3"}); response.StatusCode != 400 {
+		t.Errorf("reused token responded with %d", response.StatusCode)
+	}
+}
+
+func TestResetPasswordAfterEmailChange(t *testing.T) {
+	app, mailer := newTestApp(t)
+	access, _ := registerTestUser(t, app, "alice")
+	mailer.waitForToken(t, "alice@example.com")
+
+	testRequest(t, app, "POST", "/api/v1/password/forgot", "", map[string]string{"email": "alice@example.com"})
+	token := mailer.waitForToken(t, "alice@example.com")
+
+	if response, _ := testRequest(t, app, "PATCH", "/api/v1/me", access, map[string]string{"email": "alice@example.org", "password": "password1"}); response.StatusCode != 200 {
+		t.Fatalf("email change responded with %d", response.StatusCode)
+	}
+	if response, _ := testRequest(t, app, "POST", "/api/v1/password/reset", "", map[string]string{"token": token, "password": "password2"}); response.StatusCode != 400 {
+		t.Errorf("reset link sent before the email change responded with %d", response.StatusCode)
+	}
+}
+
+func TestForgotPasswordOfUnknownEmail(t *testing.T) {
+	app, mailer := newTestApp(t)
+
+	// Responds as for a known address so accounts cannot be found out, but sends nothing
+	if response, _ := testRequest(t, app, "POST", "/api/v1/password/forgot", "", map[string]string{"email": "nobody@example.com"}); response.StatusCode != 202 {
+		t.Errorf("forgot responded with %d", response.StatusCode)
+	}
+	registerTestUser(t, app, "alice")
+	mailer.waitForToken(t, "alice@example.com")
+
+	mailer.mu.Lock()
+	defer mailer.mu.Unlock()
+	for _, mail := range mailer.sent {
+		if mail.To == "nobody@example.com" {
+			t.Errorf("sent %v", mail)
+		}
+	}
+}
+
+func TestEmailThrottling(t *testing.T) {
+	app, _ := newTestApp(t)
+
+	for i := 1; i <= emailThrottle.FreeAttempts+1; i++ {
+		if response, _ := testRequest(t, app, "POST", "/api/v1/password/forgot", "", map[string]string{"email": "nobody@example.com"}); response.StatusCode != 202 {
+			t.Fatalf("request %d responded with %d", i, response.StatusCode)
+		}
+	}
+
+	if response, _ := testRequest(t, app, "POST", "/api/v1/password/forgot", "", map[string]string{"email": "nobody@example.com"}); response.StatusCode != 429 {
+		t.Errorf("throttled request responded with %d", response.StatusCode)
+	}
+	if response, _ := testRequest(t, app, "POST", "/api/v1/password/forgot", "", map[string]string{"email": "other@example.com"}); response.StatusCode != 202 {
+		t.Errorf("request for another address responded with %d", response.StatusCode)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// APIError is the error response of every endpoint, handlers return it and ErrorHandler writes it
+type APIError struct {
+	Status    int          `json:"-"`
+	Code      string       `json:"code"`  // Stable, for programs
+	Message   string       `json:"error"` // For people
+	Details   []FieldError `json:"details,omitempty"`
+	RequestID string       `json:"requestId,omitempty"`
+}
+
+// FieldError tells what is wrong with a field of the request
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Error returns the message
+func (err *APIError) Error() string {
+	return err.Message
+}
+
+// Creates an error response
+func newAPIError(status int, code, message string) *APIError {
+	return &APIError{Status: status, Code: code, Message: message}
+}
+
+// Creates the response to a request with an invalid field
+func validationError(field, message string) *APIError {
+	return validationErrors([]FieldError{{Field: field, Message: message}})
+}
+
+// Creates the response to a request with invalid fields, the message is the first one's, or returns nil if there are none
+func validationErrors(details []FieldError) *APIError {
+	if len(details) == 0 {
+		return nil
+	}
+
+	return &APIError{
+		Status:  400,
+		Code:    "VALIDATION_FAILED",
+		Message: details[0].Message,
+		Details: details,
+	}
+}
+
+// Errors used by several handlers
+var (
+	errInternal            = newAPIError(500, "INTERNAL_ERROR", "Internal server error")
+	errInvalidJSON         = newAPIError(400, "INVALID_JSON", "Cannot parse JSON")
+	errUnauthorized        = newAPIError(401, "UNAUTHORIZED", "Unauthorized")
+	errForbidden           = newAPIError(403, "FORBIDDEN", "Forbidden")
+	errWrongPassword       = newAPIError(403, "WRONG_PASSWORD", "Wrong password")
+	errMovieNotFound       = newAPIError(404, "MOVIE_NOT_FOUND", "Movie does not exist")
+	errReviewNotFound      = newAPIError(404, "REVIEW_NOT_FOUND", "Review does not exist")
+	errUsernameTaken       = newAPIError(409, "USERNAME_TAKEN", "Username already exist")
+	errEmailTaken          = newAPIError(409, "EMAIL_TAKEN", "Email has been used")
+	errInvalidToken        = newAPIError(400, "INVALID_TOKEN", "Invalid or expired token")
+	errTwoFactorEnabled    = newAPIError(409, "TWO_FACTOR_ENABLED", "Two-factor authentication already enabled")
+	errTwoFactorNotEnabled = newAPIError(400, "TWO_FACTOR_NOT_ENABLED", "Two-factor authentication not enabled")
+	errProviderNotFound    = newAPIError(404, "PROVIDER_NOT_FOUND", "Unknown identity provider")
+	errRouteNotFound       = newAPIError(404, "ROUTE_NOT_FOUND", "Not found")
+	errInvalidMovieID      = validationError("id", "Invalid movie ID")
+	errInvalidReviewID     = validationError("reviewId", "Invalid review ID")
+)
+
+// ErrorHandler writes the errors returned by handlers, errors that are not an APIError are logged and hidden behind a 500
+func ErrorHandler(ctx *fiber.Ctx, err error) error {
+	requestID := string(ctx.Response().Header.Peek(fiber.HeaderXRequestID))
+
+	response, ok := err.(*APIError)
+	if fiberErr, isFiberErr := err.(*fiber.Error); isFiberErr {
+		// Errors of fiber itself, e.g. a too large body, get a code from their status
+		code := strings.ToUpper(strings.ReplaceAll(utils.StatusMessage(fiberErr.Code), " ", "_"))
+		response = newAPIError(fiberErr.Code, code, fiberErr.Message)
+	} else if !ok {
+		log.Printf("Request %s: %s\n", requestID, err.Error())
+		response = errInternal
+	}
+
+	// Copy, so the shared errors are not changed
+	body := *response
+	body.RequestID = requestID
+	return ctx.Status(body.Status).JSON(body)
+}
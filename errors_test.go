@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestErrorEnvelope(t *testing.T) {
+	app, _ := newTestApp(t)
+	access, _ := registerTestUser(t, app, "alice")
+
+	tests := []struct {
+		method, path, token string
+		body                interface{}
+		status              int
+		code                string
+	}{
+		{"GET", "/api/v1/movies", "", nil, 401, "UNAUTHORIZED"},
+		{"GET", "/api/v1/movies/1", access, nil, 404, "MOVIE_NOT_FOUND"},
+		{"GET", "/api/v1/movies/abc", access, nil, 400, "VALIDATION_FAILED"},
+		{"POST", "/api/v1/register", "", map[string]string{"username": "alice", "email": "alice@example.org", "password": "password1"}, 409, "USERNAME_TAKEN"},
+		{"DELETE", "/api/v1/movies/1", access, nil, 403, "FORBIDDEN"},
+	}
+
+	for _, test := range tests {
+		response, body := testRequest(t, app, test.method, test.path, test.token, test.body)
+		requestID := response.Header.Get(fiber.HeaderXRequestID)
+		if response.StatusCode != test.status || body["code"] != test.code || body["error"] == "" || requestID == "" || body["requestId"] != requestID {
+			t.Errorf("%s %s: got %d %v, want %d %s", test.method, test.path, response.StatusCode, body, test.status, test.code)
+		}
+	}
+
+}
+
+func TestErrorHandlerHidesInternalErrors(t *testing.T) {
+	app := fiber.New(fiber.Config{ErrorHandler: ErrorHandler})
+	app.Get("/", func(ctx *fiber.Ctx) error { return errors.New("database is down") })
+
+	if response, body := testRequest(t, app, "GET", "/", "", nil); response.StatusCode != 500 || body["code"] != "INTERNAL_ERROR" || body["error"] != "Internal server error" {
+		t.Errorf("got %d %v", response.StatusCode, body)
+	}
+}
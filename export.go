@@ -0,0 +1,372 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// How long a finished export can be downloaded
+const exportLifetime = time.Hour
+
+// Statuses of data exports
+const (
+	exportPending = "pending"
+	exportReady   = "ready"
+	exportFailed  = "failed"
+)
+
+// Exports of personal data, kept in memory until they expire
+var dataExports = &DataExports{byUser: map[int]*DataExport{}}
+
+// DataExport is an archive of everything stored about a user, built in the background
+type DataExport struct {
+	UserID    int
+	Status    string
+	Token     string // Secret part of the download URL
+	Archive   []byte
+	CreatedAt time.Time
+	ExpiresAt time.Time // Set once ready
+}
+
+// DataExports holds the latest export of every user
+type DataExports struct {
+	mu     sync.Mutex
+	byUser map[int]*DataExport
+}
+
+// Drops expired exports, must hold the lock
+func (exports *DataExports) prune() {
+	now := time.Now()
+	for userID, export := range exports.byUser {
+		if export.Status == exportReady && export.ExpiresAt.Before(now) {
+			delete(exports.byUser, userID)
+		}
+	}
+}
+
+// Start returns the unexpired export of the user, or starts building a new one if there is none or the last one failed
+func (exports *DataExports) Start(user *User) (DataExport, error) {
+	exports.mu.Lock()
+	defer exports.mu.Unlock()
+
+	exports.prune()
+	if export, ok := exports.byUser[user.ID]; ok && export.Status != exportFailed {
+		return *export, nil
+	}
+
+	token, err := generateTokenID()
+	if err != nil {
+		return DataExport{}, err
+	}
+
+	export := &DataExport{UserID: user.ID, Status: exportPending, Token: token, CreatedAt: time.Now()}
+	exports.byUser[user.ID] = export
+	go exports.build(export, *user)
+
+	return *export, nil
+}
+
+// Builds the archive of the export
+func (exports *DataExports) build(export *DataExport, user User) {
+	archive, err := buildExportArchive(&user)
+
+	exports.mu.Lock()
+	defer exports.mu.Unlock()
+
+	if err != nil {
+		log.Println(err.Error())
+		export.Status = exportFailed
+		return
+	}
+
+	export.Archive = archive
+	export.Status = exportReady
+	export.ExpiresAt = time.Now().Add(exportLifetime)
+}
+
+// Get gets a ready, unexpired export by its download token
+func (exports *DataExports) Get(token string) (DataExport, bool) {
+	exports.mu.Lock()
+	defer exports.mu.Unlock()
+
+	exports.prune()
+	for _, export := range exports.byUser {
+		if export.Token == token && export.Status == exportReady {
+			return *export, true
+		}
+	}
+
+	return DataExport{}, false
+}
+
+// Remove drops the export of the user
+func (exports *DataExports) Remove(userID int) {
+	exports.mu.Lock()
+	defer exports.mu.Unlock()
+
+	delete(exports.byUser, userID)
+}
+
+// Part of an export, written to the archive as <Name>.json and <Name>.csv
+type exportSection struct {
+	Name    string
+	Records interface{}
+	Header  []string
+	Rows    [][]string
+}
+
+// Collect the sections of an export, add one for every new kind of data stored about users
+var exportCollectors = []func(user *User) (exportSection, error){
+	exportAccount,
+	exportReviews,
+	exportAPIKeys,
+	exportIdentities,
+	exportSessions,
+	exportAuditEvents,
+}
+
+// The account row, without the password hash
+func exportAccount(user *User) (exportSection, error) {
+	return exportSection{
+		Name:    "account",
+		Records: profile(user),
+		Header:  []string{"id", "username", "email", "role", "emailVerified"},
+		Rows: [][]string{{
+			strconv.Itoa(user.ID), user.Username, user.Email, user.Role, strconv.FormatBool(user.EmailVerified),
+		}},
+	}, nil
+}
+
+// Every review of the user with the title of the movie
+func exportReviews(user *User) (exportSection, error) {
+	reviews, err := store.GetUserReviews(user.ID)
+	if err != nil {
+		return exportSection{}, err
+	}
+
+	records := []map[string]interface{}{}
+	rows := [][]string{}
+	for _, review := range reviews {
+		records = append(records, map[string]interface{}{
+			"id":         review.ID,
+			"movieId":    review.MovieID,
+			"movieTitle": review.MovieTitle,
+			"rating":     review.Rating,
+			"comment":    review.Comment,
+			"createdAt":  review.CreatedAt,
+			"updatedAt":  review.UpdatedAt,
+		})
+		rows = append(rows, []string{
+			strconv.Itoa(review.ID), strconv.Itoa(review.MovieID), review.MovieTitle, strconv.Itoa(review.Rating), review.Comment,
+			review.CreatedAt.Format(time.RFC3339), review.UpdatedAt.Format(time.RFC3339),
+		})
+	}
+
+	return exportSection{
+		Name:    "reviews",
+		Records: records,
+		Header:  []string{"id", "movieId", "movieTitle", "rating", "comment", "createdAt", "updatedAt"},
+		Rows:    rows,
+	}, nil
+}
+
+// Every API key of the user, without the hashes
+func exportAPIKeys(user *User) (exportSection, error) {
+	keys, err := store.GetUserAPIKeys(user.ID)
+	if err != nil {
+		return exportSection{}, err
+	}
+
+	records := []map[string]interface{}{}
+	rows := [][]string{}
+	for i, key := range keys {
+		lastUsedAt := ""
+		if key.LastUsedAt != nil {
+			lastUsedAt = key.LastUsedAt.Format(time.RFC3339)
+		}
+
+		records = append(records, apiKeyJSON(&keys[i]))
+		rows = append(rows, []string{
+			strconv.Itoa(key.ID), key.Name, key.Prefix, strings.Join(key.Scopes, " "), key.CreatedAt.Format(time.RFC3339), lastUsedAt,
+		})
+	}
+
+	return exportSection{
+		Name:    "api_keys",
+		Records: records,
+		Header:  []string{"id", "name", "prefix", "scopes", "createdAt", "lastUsedAt"},
+		Rows:    rows,
+	}, nil
+}
+
+// Every OIDC identity linked to the user
+func exportIdentities(user *User) (exportSection, error) {
+	identities, err := store.GetUserIdentities(user.ID)
+	if err != nil {
+		return exportSection{}, err
+	}
+
+	records := []map[string]interface{}{}
+	rows := [][]string{}
+	for _, identity := range identities {
+		records = append(records, map[string]interface{}{
+			"provider":  identity.Provider,
+			"subject":   identity.Subject,
+			"createdAt": identity.CreatedAt,
+		})
+		rows = append(rows, []string{identity.Provider, identity.Subject, identity.CreatedAt.Format(time.RFC3339)})
+	}
+
+	return exportSection{
+		Name:    "user_identities",
+		Records: records,
+		Header:  []string{"provider", "subject", "createdAt"},
+		Rows:    rows,
+	}, nil
+}
+
+// Every refresh token issued to the user with the device it was issued to, without the token IDs
+func exportSessions(user *User) (exportSection, error) {
+	tokens, err := store.GetUserRefreshTokens(user.ID)
+	if err != nil {
+		return exportSection{}, err
+	}
+
+	records := []map[string]interface{}{}
+	rows := [][]string{}
+	for _, token := range tokens {
+		records = append(records, map[string]interface{}{
+			"sessionId": token.FamilyID,
+			"device":    token.Device,
+			"expiresAt": token.ExpiresAt,
+			"used":      token.Used,
+			"revoked":   token.Revoked,
+		})
+		rows = append(rows, []string{
+			token.FamilyID, token.Device, token.ExpiresAt.Format(time.RFC3339), strconv.FormatBool(token.Used), strconv.FormatBool(token.Revoked),
+		})
+	}
+
+	return exportSection{
+		Name:    "sessions",
+		Records: records,
+		Header:  []string{"sessionId", "device", "expiresAt", "used", "revoked"},
+		Rows:    rows,
+	}, nil
+}
+
+// Every audit event about the user, e.g. lockouts of the account
+func exportAuditEvents(user *User) (exportSection, error) {
+	events, err := store.GetUserAuditEvents(user.ID)
+	if err != nil {
+		return exportSection{}, err
+	}
+
+	records := []map[string]interface{}{}
+	rows := [][]string{}
+	for _, event := range events {
+		records = append(records, map[string]interface{}{
+			"type":      event.Type,
+			"ip":        event.IP,
+			"detail":    event.Detail,
+			"createdAt": event.CreatedAt,
+		})
+		rows = append(rows, []string{event.Type, event.IP, event.Detail, event.CreatedAt.Format(time.RFC3339)})
+	}
+
+	return exportSection{
+		Name:    "audit_events",
+		Records: records,
+		Header:  []string{"type", "ip", "detail", "createdAt"},
+		Rows:    rows,
+	}, nil
+}
+
+// Builds a zip archive with a JSON and a CSV file of every section
+func buildExportArchive(user *User) ([]byte, error) {
+	var buffer bytes.Buffer
+	archive := zip.NewWriter(&buffer)
+
+	for _, collect := range exportCollectors {
+		section, err := collect(user)
+		if err != nil {
+			return nil, err
+		}
+
+		file, err := archive.Create(section.Name + ".json")
+		if err != nil {
+			return nil, err
+		}
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		if err = encoder.Encode(section.Records); err != nil {
+			return nil, err
+		}
+
+		if file, err = archive.Create(section.Name + ".csv"); err != nil {
+			return nil, err
+		}
+		writer := csv.NewWriter(file)
+		writer.Write(section.Header)
+		writer.WriteAll(section.Rows)
+		if err = writer.Error(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// ExportMe starts an export of the user's data, or reports on the last one with its download URL once it is ready
+func ExportMe(ctx *fiber.Ctx) error {
+	user, err := currentUser(ctx)
+	if err != nil {
+		return err
+	}
+
+	export, err := dataExports.Start(user)
+	if err != nil {
+		return err
+	}
+
+	if export.Status != exportReady {
+		return ctx.Status(202).JSON(map[string]interface{}{
+			"status":    export.Status,
+			"createdAt": export.CreatedAt,
+		})
+	}
+
+	return ctx.Status(200).JSON(map[string]interface{}{
+		"status":    export.Status,
+		"createdAt": export.CreatedAt,
+		"url":       ctx.BaseURL() + apiV1Prefix + "/exports/" + export.Token,
+		"expiresAt": export.ExpiresAt,
+	})
+}
+
+// DownloadExport downloads a ready export, the token in the URL authorizes the download
+func DownloadExport(ctx *fiber.Ctx) error {
+	export, ok := dataExports.Get(ctx.Params("token"))
+	if !ok {
+		return newAPIError(404, "EXPORT_NOT_FOUND", "Export does not exist or expired")
+	}
+
+	ctx.Set(fiber.HeaderContentType, "application/zip")
+	ctx.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="movie_rater_export_%d_%s.zip"`, export.UserID, export.CreatedAt.Format("2006-01-02")))
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	return ctx.Status(200).Send(export.Archive)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportMe(t *testing.T) {
+	app, _ := newTestApp(t)
+	access, _ := registerTestUser(t, app, "alice")
+	user, err := store.GetUserByEmail("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	movieID, err := store.CreateMovie(NewMovie{Title: "Dune"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = store.CreateReview(movieID, user.ID, 4, "Great", false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The export is built in the background, later calls report on it
+	var url string
+	for deadline := time.Now().Add(5 * time.Second); url == "" && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		response, body := testRequest(t, app, "GET", "/api/v1/me/export", access, nil)
+		if response.StatusCode == 200 {
+			url = body["url"].(string)
+		} else if response.StatusCode != 202 {
+			t.Fatalf("export responded with %d %v", response.StatusCode, body)
+		}
+	}
+	if url == "" {
+		t.Fatal("export was not ready in time")
+	}
+
+	response, err := app.Test(httptest.NewRequest("GET", url, nil), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if response.StatusCode != 200 || err != nil {
+		t.Fatalf("download responded with %d, %v", response.StatusCode, err)
+	}
+
+	files := map[string]string{}
+	for _, file := range reader.File {
+		content, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[file.Name] = string(data)
+	}
+
+	for _, name := range []string{"account.json", "account.csv", "reviews.json", "reviews.csv"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("archive has no %s, only %v", name, reader.File)
+		}
+	}
+	var reviews []map[string]interface{}
+	if err = json.Unmarshal([]byte(files["reviews.json"]), &reviews); err != nil || len(reviews) != 1 || reviews[0]["movieTitle"] != "Dune" {
+		t.Errorf("got reviews %s, %v", files["reviews.json"], err)
+	}
+	if strings.Contains(files["account.json"], user.Password) {
+		t.Errorf("password hash exported in %s", files["account.json"])
+	}
+
+	if response, _ := testRequest(t, app, "GET", "/api/v1/exports/unknown", "", nil); response.StatusCode != 404 {
+		t.Errorf("unknown export responded with %d", response.StatusCode)
+	}
+}
+
+func TestExportSessions(t *testing.T) {
+	app, _ := newTestApp(t)
+	_, refresh := registerTestUser(t, app, "alice")
+	if response, _ := testRequest(t, app, "GET", "/api/v1/refresh", refresh, nil); response.StatusCode != 200 {
+		t.Fatalf("refresh responded with %d", response.StatusCode)
+	}
+	user, err := store.GetUserByEmail("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	section, err := exportSessions(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The token of the registration was used up by the refresh, which issued one of the same session
+	records := section.Records.([]map[string]interface{})
+	if len(records) != 2 || len(section.Rows) != 2 {
+		t.Fatalf("got %d records and %d rows", len(records), len(section.Rows))
+	}
+	if records[0]["used"] != true || records[1]["used"] != false || records[0]["sessionId"] != records[1]["sessionId"] {
+		t.Errorf("got %v", records)
+	}
+	for _, record := range records {
+		if _, ok := record["id"]; ok {
+			t.Errorf("token ID exported in %v", record)
+		}
+	}
+}
+
+func TestExportAuditEvents(t *testing.T) {
+	app, _ := newTestApp(t)
+	registerTestUser(t, app, "alice")
+	registerTestUser(t, app, "bob")
+
+	for username, want := range map[string]int{"alice": 1, "bob": 0} {
+		user, err := store.GetUserByEmail(username + "@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Locks alice out, without waiting out the delays of the login route
+		for i := 0; i < accountThrottle.LockoutAfter*want; i++ {
+			if err = accountThrottle.fail(user.Email, user.ID, "192.0.2.1"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		section, err := exportAuditEvents(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		records := section.Records.([]map[string]interface{})
+		if len(records) != want || len(section.Rows) != want {
+			t.Errorf("%s: got %v, want %d events", username, records, want)
+		} else if want > 0 && records[0]["type"] != auditLoginLockout {
+			t.Errorf("%s: got %v", username, records)
+		}
+	}
+}
@@ -1,11 +1,22 @@
 module github.com/xiaoming857/movie_rater
 
-go 1.15
+go 1.17
 
 require (
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/go-sql-driver/mysql v1.5.0
 	github.com/gofiber/fiber/v2 v2.1.0
 	github.com/gofiber/jwt/v2 v2.0.1
-	golang.org/x/crypto v0.0.0-20190308221718-c2843e01d9a2
+	github.com/swaggo/files/v2 v2.0.2
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
+	golang.org/x/text v0.13.0
+)
+
+require (
+	github.com/andybalholm/brotli v1.0.0 // indirect
+	github.com/klauspost/compress v1.10.7 // indirect
+	github.com/valyala/bytebufferpool v1.0.0 // indirect
+	github.com/valyala/fasthttp v1.16.0 // indirect
+	github.com/valyala/tcplisten v0.0.0-20161114210144-ceec8f93295a // indirect
+	golang.org/x/sys v0.5.0 // indirect
 )
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"sort"
+	"strings"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gofiber/fiber/v2"
+)
+
+// JWTKeys holds the key tokens are signed with and every key tokens are verified with
+type JWTKeys struct {
+	SigningKey   *rsa.PrivateKey
+	SigningKeyID string
+	// Verification keys by key ID, includes the signing key and retired keys still accepted
+	VerificationKeys map[string]*rsa.PublicKey
+}
+
+// JWK is a public key in JSON Web Key format
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// Creates the JWK of a public key
+func newJWK(key *rsa.PublicKey) JWK {
+	return JWK{
+		Kty: "RSA",
+		Use: "sig",
+		Alg: "RS256",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+// Computes the key ID of a public key, its RFC 7638 thumbprint
+func keyID(key *rsa.PublicKey) string {
+	jwk := newJWK(key)
+	thumbprint := sha256.Sum256([]byte(`{"e":"` + jwk.E + `","kty":"RSA","n":"` + jwk.N + `"}`))
+	return base64.RawURLEncoding.EncodeToString(thumbprint[:])
+}
+
+// Loads the PEM private key used for signing and the PEM public (or private) keys of retired keys
+func loadJWTKeys(signingKeyFile string, verificationKeyFiles []string) (*JWTKeys, error) {
+	pem, err := ioutil.ReadFile(signingKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	signingKey, err := jwt.ParseRSAPrivateKeyFromPEM(pem)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", signingKeyFile, err)
+	}
+	if signingKey.N.BitLen() < 2048 {
+		return nil, fmt.Errorf("%s: RSA key must be at least 2048 bits", signingKeyFile)
+	}
+
+	keys := &JWTKeys{
+		SigningKey:       signingKey,
+		SigningKeyID:     keyID(&signingKey.PublicKey),
+		VerificationKeys: map[string]*rsa.PublicKey{},
+	}
+	keys.VerificationKeys[keys.SigningKeyID] = &signingKey.PublicKey
+
+	for _, file := range verificationKeyFiles {
+		if pem, err = ioutil.ReadFile(file); err != nil {
+			return nil, err
+		}
+
+		publicKey, err := jwt.ParseRSAPublicKeyFromPEM(pem)
+		if err != nil {
+			privateKey, privateErr := jwt.ParseRSAPrivateKeyFromPEM(pem)
+			if privateErr != nil {
+				return nil, fmt.Errorf("%s: %w", file, err)
+			}
+			publicKey = &privateKey.PublicKey
+		}
+
+		keys.VerificationKeys[keyID(publicKey)] = publicKey
+	}
+
+	return keys, nil
+}
+
+// Splits a comma separated list of files, ignoring empty entries
+func splitFileList(list string) []string {
+	var files []string
+	for _, file := range strings.Split(list, ",") {
+		if file = strings.TrimSpace(file); file != "" {
+			files = append(files, file)
+		}
+	}
+
+	return files
+}
+
+// Signs the claims with the current signing key, the key ID goes into the kid header
+func signToken(claims jwt.MapClaims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = config.JWTKeys.SigningKeyID
+	return token.SignedString(config.JWTKeys.SigningKey)
+}
+
+// Parses a token signed by any verification key and checks its typ claim, for tokens not passed in the Authorization header
+func parseToken(tokenString, tokenType string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwt.SigningMethodRS256 {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+
+		kid, _ := token.Header["kid"].(string)
+		key, ok := config.JWTKeys.VerificationKeys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown key ID %q", kid)
+		}
+		return key, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	if claims["typ"] != tokenType {
+		return nil, fmt.Errorf("not a %s token", tokenType)
+	}
+
+	return claims, nil
+}
+
+// Verification keys in the form the JWT middleware takes
+func verificationKeys() map[string]interface{} {
+	keys := map[string]interface{}{}
+	for kid, key := range config.JWTKeys.VerificationKeys {
+		keys[kid] = key
+	}
+
+	return keys
+}
+
+// JWKS serves the public keys tokens are verified with
+func JWKS(ctx *fiber.Ctx) error {
+	jwks := struct {
+		Keys []JWK `json:"keys"`
+	}{Keys: []JWK{}}
+
+	for kid, key := range config.JWTKeys.VerificationKeys {
+		jwk := newJWK(key)
+		jwk.Kid = kid
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	sort.Slice(jwks.Keys, func(i, j int) bool { return jwks.Keys[i].Kid < jwks.Keys[j].Kid })
+
+	ctx.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	return ctx.Status(200).JSON(jwks)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestTokenKeys(t *testing.T) {
+	app, _ := newTestApp(t)
+	_, refresh := registerTestUser(t, app, "alice")
+
+	retired, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The retired key still verifies the tokens it signed, the app reads its keys when it sets up its routes
+	config.JWTKeys.VerificationKeys["retired"] = &retired.PublicKey
+	app = fiber.New(fiber.Config{ErrorHandler: ErrorHandler})
+	setupRoutes(app)
+
+	tests := []struct {
+		name   string
+		keyID  string
+		key    *rsa.PrivateKey
+		status int
+	}{
+		{"signing key", "test", testKey.key, 200},
+		{"retired key", "retired", retired, 200},
+		{"unknown key", "unknown", unknown, 401},
+		{"key ID of another key", "test", unknown, 401},
+	}
+
+	for _, test := range tests {
+		config.JWTKeys.SigningKey, config.JWTKeys.SigningKeyID = test.key, test.keyID
+		token, err := generateAccessToken(&User{ID: 1, Username: "alice", Email: "alice@example.com", Role: "user"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if response, _ := testRequest(t, app, "GET", "/api/v1/movies", token, nil); response.StatusCode != test.status {
+			t.Errorf("%s: got %d, want %d", test.name, response.StatusCode, test.status)
+		}
+	}
+
+	if response, _ := testRequest(t, app, "GET", "/api/v1/movies", refresh, nil); response.StatusCode != 401 {
+		t.Errorf("refresh token used as access token responded with %d", response.StatusCode)
+	}
+
+	response, body := testRequest(t, app, "GET", "/.well-known/jwks.json", "", nil)
+	keys, _ := body["keys"].([]interface{})
+	if response.StatusCode != 200 || len(keys) != 2 || keys[0].(map[string]interface{})["kid"] != "retired" || keys[1].(map[string]interface{})["kid"] != "test" {
+		t.Errorf("JWKS responded with %d %v", response.StatusCode, body)
+	}
+}
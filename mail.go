@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MailSender sends plain text emails
+type MailSender interface {
+	Send(to, subject, body string) error
+}
+
+// SMTPSender sends emails through an SMTP server
+type SMTPSender struct {
+	Addr     string // host:port
+	Username string // No authentication when empty
+	Password string
+	From     string
+}
+
+// Send sends the email, STARTTLS is used when the server offers it
+func (sender *SMTPSender) Send(to, subject, body string) error {
+	var auth smtp.Auth
+	if sender.Username != "" {
+		host, _, _ := net.SplitHostPort(sender.Addr)
+		auth = smtp.PlainAuth("", sender.Username, sender.Password, host)
+	}
+
+	return smtp.SendMail(sender.Addr, auth, sender.From, []string{to}, formatMail(sender.From, to, subject, body))
+}
+
+// FileSender appends emails to a file, or writes them to the log when Path is empty, for local development and tests
+type FileSender struct {
+	Path string
+	mu   sync.Mutex
+}
+
+// Send writes the email
+func (sender *FileSender) Send(to, subject, body string) error {
+	message := formatMail("", to, subject, body)
+	if sender.Path == "" {
+		log.Printf("Email not sent (MAIL_DRIVER=log):\n%s\n", message)
+		return nil
+	}
+
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+
+	file, err := os.OpenFile(sender.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(message, "\r\n"...))
+	return err
+}
+
+// Formats the email with the headers every sender writes, line breaks are removed from header values
+func formatMail(from, to, subject, body string) []byte {
+	headerValue := strings.NewReplacer("\r", "", "\n", "").Replace
+	from, to, subject = headerValue(from), headerValue(to), headerValue(subject)
+
+	var message strings.Builder
+	if from != "" {
+		fmt.Fprintf(&message, "From: %s\r\n", from)
+	}
+	fmt.Fprintf(&message, "To: %s\r\n", to)
+	fmt.Fprintf(&message, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	message.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return []byte(message.String())
+}
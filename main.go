@@ -1,79 +1,135 @@
 package main
 
 import (
-	"database/sql"
 	"log"
+	"os"
 
-	_ "github.com/go-sql-driver/mysql"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/logger"
+	"github.com/gofiber/fiber/v2/middleware/recover"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
 )
 
-// Database instance
-var db *sql.DB
-
-// Database setting
-const (
-	dbUser     = "ARV134"
-	dbPassword = "123456"
-	dbName     = "ARV134"
-	dbProtocol = "tcp"
-	dbAddress  = "34.101.252.33"
-	dbPort     = "3306"
-)
-
-// Connect funtion
-func connect() error {
-	var err error
-
-	// Use DSN string to open
-	// db, err = sql.Open("mysql", dbUser+":"+dbPassword+"@"+dbProtocol+"("+dbAddress+":"+dbPort+")/"+dbName)
-	db, err = sql.Open("mysql", "crazymin_test:CEGdDe7Kt7ydQec@/crazymin_movie_rater")
-
-	if err != nil {
-		return err
-	}
-
-	if err = db.Ping(); err != nil {
-		return err
-	}
-
-	return nil
-}
+// App config
+var config *Config
 
 // Routes function
 func setupRoutes(app *fiber.App) {
+	app.Use(requestid.New())
 	app.Use(logger.New())
+	// Panics become a 500 instead of stopping the server
+	app.Use(recover.New())
 
 	// Unrestricted routes
 	app.Get("/", Home)
-	app.Post("/api/login", Login)
-	app.Post("/api/register", Register)
+	app.Get("/.well-known/jwks.json", JWKS)
+	app.Get("/api/openapi.json", OpenAPI)
+	app.Get("/api/docs", APIDocs)
+	app.Get("/api/docs/:file", APIDocsAsset)
+
+	// Routes of /api/v1, each also at the deprecated unversioned path it had before
+	api := apiRoutes{app: app, v1: app.Group(apiV1Prefix)}
+	api.add("POST", "/login", "/api/login", Login)
+	api.add("POST", "/login/2fa", "/api/login/2fa", LoginTwoFactor)
+	api.add("GET", "/oidc/:provider/login", "/api/oidc/:provider/login", OIDCLogin)
+	api.add("GET", "/oidc/:provider/callback", "/api/oidc/:provider/callback", OIDCCallback)
+	api.add("POST", "/register", "/api/register", Register)
+	api.add("POST", "/verify-email", "/api/verify-email", VerifyEmail)
+	api.add("POST", "/password/forgot", "/api/password/forgot", ForgotPassword)
+	api.add("POST", "/password/reset", "/api/password/reset", ResetPassword)
+	api.add("GET", "/exports/:token", "/api/exports/:token", DownloadExport)
 
 	// Restricted routes
-	app.Use("/api/refresh", RefreshProtected())
-	app.Get("/api/refresh", Refresh)
+	api.add("GET", "/refresh", "/api/refresh", RefreshProtected(), Refresh)
+	api.add("POST", "/logout", "/api/logout", RefreshProtected(), Logout)
 
 	app.Use(AccessProtected())
-	app.Get("/api/movies", GetMovies)
-	app.Get("/api/reviews/:id", GetReviews)
-	app.Post("/api/movie", AddMovie)
-	app.Post("/api/review/:id", AddReview)
+
+	// Routes API keys can use with the scope
+	api.add("GET", "/me", "/api/me", ScopeProtected("profile:read"), GetMe)
+	api.add("GET", "/movies", "/api/movies", ScopeProtected("movies:read"), GetMovies)
+	api.add("GET", "/movies/search", "/api/movies/search", ScopeProtected("movies:read"), SearchMovies)
+	api.add("GET", "/movies/suggest", "/api/movies/suggest", ScopeProtected("movies:read"), SuggestMovies)
+	api.add("GET", "/movies/:id", "/api/movies/:id", ScopeProtected("movies:read"), GetMovie)
+	api.add("GET", "/movies/:id/reviews", "/api/reviews/:id", ScopeProtected("reviews:read"), GetReviews)
+	api.add("POST", "/movies/:id/reviews", "/api/review/:id", ScopeProtected("reviews:write"), VerifiedProtected("review"), AddReview)
+	api.add("PATCH", "/reviews/:reviewId", "/api/reviews/:reviewId", ScopeProtected("reviews:write"), VerifiedProtected("review"), UpdateReview)
+	api.add("DELETE", "/reviews/:reviewId", "/api/reviews/:reviewId", ScopeProtected("reviews:write"), DeleteReview)
+
+	// Moderator routes
+	api.add("POST", "/movies", "/api/movie", ScopeProtected("movies:write"), RoleProtected("moderator"), VerifiedProtected("movie"), AddMovie)
+	api.add("PATCH", "/movies/:id", "/api/movies/:id", ScopeProtected("movies:write"), RoleProtected("moderator"), VerifiedProtected("movie"), UpdateMovie)
+	api.add("DELETE", "/movies/:id", "/api/movies/:id", ScopeProtected("movies:write"), RoleProtected("moderator"), VerifiedProtected("movie"), DeleteMovie)
+	api.add("DELETE", "/moderation/reviews/:reviewId", "/api/moderation/reviews/:reviewId", ScopeProtected("reviews:moderate"), RoleProtected("moderator"), RemoveReview)
+
+	// Routes below need the access token of a login, API keys are refused
+	app.Use(SessionProtected())
+	api.add("POST", "/logout-all", "/api/logout-all", LogoutAll)
+	api.add("POST", "/verify-email/resend", "/api/verify-email/resend", ResendVerification)
+	api.add("PATCH", "/me", "/api/me", UpdateMe)
+	api.add("DELETE", "/me", "/api/me", DeleteMe)
+	api.add("POST", "/me/password", "/api/me/password", ChangePassword)
+	api.add("GET", "/me/export", "/api/me/export", ExportMe)
+	api.add("POST", "/me/2fa/setup", "/api/me/2fa/setup", SetupTwoFactor)
+	api.add("POST", "/me/2fa/confirm", "/api/me/2fa/confirm", ConfirmTwoFactor)
+	api.add("POST", "/me/2fa/recovery-codes", "/api/me/2fa/recovery-codes", RegenerateRecoveryCodes)
+	api.add("DELETE", "/me/2fa", "/api/me/2fa", DisableTwoFactor)
+	api.add("GET", "/me/api-keys", "/api/me/api-keys", GetAPIKeys)
+	api.add("POST", "/me/api-keys", "/api/me/api-keys", AddAPIKey)
+	api.add("DELETE", "/me/api-keys/:id", "/api/me/api-keys/:id", RevokeAPIKey)
+
+	// Admin routes
+	api.add("PUT", "/admin/users/:id/role", "/api/admin/users/:id/role", RoleProtected("admin"), SetUserRole)
+
+	// Unknown routes
+	app.Use(func(ctx *fiber.Ctx) error {
+		return errRouteNotFound
+	})
 }
 
 func main() {
-	// Connect with database
-	if err := connect(); err != nil {
+	// Load config
+	var err error
+	if config, err = loadConfig(); err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	// Open storage
+	if store, err = openStore(config); err != nil {
 		panic(err.Error())
 	}
+	defer store.Close()
+
+	// Run subcommand instead of serving
+	if len(os.Args) > 1 {
+		if err = runCommand(os.Args[1:]); err != nil {
+			log.Fatalln(err.Error())
+		}
+		return
+	}
+
+	// Refuse to serve against an out-of-date schema
+	if err = checkSchema(store); err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	// Bootstrap the admins ADMIN_EMAILS lists
+	if err = promoteListedAdmins(); err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	// Index movies for search
+	if err = buildSearchIndex(); err != nil {
+		log.Fatalln(err.Error())
+	}
 
 	// Create a Fiber app
-	app := fiber.New()
+	app := fiber.New(fiber.Config{
+		ErrorHandler: ErrorHandler,
+	})
 
 	// Routes
 	setupRoutes(app)
 
-	// log.Fatalln(app.Listen(":" + os.Getenv("PORT")))
-	log.Fatalln(app.Listen(":8080"))
-	defer db.Close()
+	log.Fatalln(app.Listen(":" + config.Port))
 }
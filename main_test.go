@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Key every test app signs its tokens with, generated once as it is slow
+var testKey struct {
+	once sync.Once
+	key  *rsa.PrivateKey
+}
+
+// Email sent through testMailer
+type testMail struct {
+	To, Subject, Body string
+}
+
+// testMailer records emails instead of sending them
+type testMailer struct {
+	mu   sync.Mutex
+	sent []testMail
+}
+
+// Send records the email
+func (mailer *testMailer) Send(to, subject, body string) error {
+	mailer.mu.Lock()
+	defer mailer.mu.Unlock()
+
+	mailer.sent = append(mailer.sent, testMail{To: to, Subject: subject, Body: body})
+	return nil
+}
+
+// Sets the globals up with a memory store and returns an app with every route
+func newTestApp(t *testing.T) (*fiber.App, *testMailer) {
+	t.Helper()
+
+	testKey.once.Do(func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			panic(err)
+		}
+		testKey.key = key
+	})
+
+	mailer := new(testMailer)
+	config = &Config{
+		JWTKeys: &JWTKeys{
+			SigningKey:       testKey.key,
+			SigningKeyID:     "test",
+			VerificationKeys: map[string]*rsa.PublicKey{"test": &testKey.key.PublicKey},
+		},
+		Mailer:                mailer,
+		AppURL:                "http://app.test",
+		APIURL:                "http://api.test",
+		VerifiedEmailRequired: map[string]bool{},
+		OIDCProviders:         map[string]*OIDCProvider{},
+	}
+	store = newMemoryStore()
+	searchIndex = newSearchIndex()
+	dataExports = &DataExports{byUser: map[int]*DataExport{}}
+
+	app := fiber.New(fiber.Config{ErrorHandler: ErrorHandler})
+	setupRoutes(app)
+	return app, mailer
+}
+
+// Sends a request with an optional JSON body and bearer token, the JSON response is decoded into a map
+func testRequest(t *testing.T, app *fiber.App, method, path, token string, body interface{}) (*http.Response, map[string]interface{}) {
+	t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	request := httptest.NewRequest(method, path, reader)
+	request.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	response, err := app.Test(request, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Bodies that are not a JSON object, like arrays, give an empty map
+	result := map[string]interface{}{}
+	if response.Header.Get("Content-Type") == fiber.MIMEApplicationJSON {
+		var decoded interface{}
+		if err = json.NewDecoder(response.Body).Decode(&decoded); err != nil {
+			t.Fatal(err)
+		}
+		if object, ok := decoded.(map[string]interface{}); ok {
+			result = object
+		}
+	}
+	return response, result
+}
+
+// Registers a user through the API and returns their access and refresh tokens
+func registerTestUser(t *testing.T, app *fiber.App, username string) (string, string) {
+	t.Helper()
+
+	response, body := testRequest(t, app, "POST", "/api/v1/register", "", map[string]string{
+		"username": username,
+		"email":    username + "@example.com",
+		"password": "password1",
+	})
+	if response.StatusCode != 200 {
+		t.Fatalf("register responded with %d %v", response.StatusCode, body)
+	}
+
+	return body["accessToken"].(string), body["refreshToken"].(string)
+}
+
+// Waits for the next email to the address, which is sent in the background, and returns the token of its link
+func (mailer *testMailer) waitForToken(t *testing.T, to string) string {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		mailer.mu.Lock()
+		for i, mail := range mailer.sent {
+			if mail.To == to {
+				mailer.sent = append(mailer.sent[:i], mailer.sent[i+1:]...)
+				mailer.mu.Unlock()
+				return mailTokenPattern.FindStringSubmatch(mail.Body)[1]
+			}
+		}
+		mailer.mu.Unlock()
+	}
+
+	t.Fatalf("no email sent to %s", to)
+	return ""
+}
+
+// Token in the link of an email
+var mailTokenPattern = regexp.MustCompile(`token=([0-9a-f]+)`)
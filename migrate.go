@@ -0,0 +1,175 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Table that records applied migrations
+const migrationsTable = "schema_migrations"
+
+// Returns the SQL database behind the store, or nil if the store has no schema
+func storeDB(s Store) *sql.DB {
+	if mysqlStore, ok := s.(*MySQLStore); ok {
+		return mysqlStore.db
+	}
+
+	return nil
+}
+
+// Creates the migrations table if needed
+func ensureMigrationsTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS ` + migrationsTable + `(
+		version INTEGER UNSIGNED NOT NULL,
+		name VARCHAR(100) NOT NULL,
+		appliedAt DATETIME NOT NULL,
+		CONSTRAINT version_pk PRIMARY KEY(version)
+	)`)
+	return err
+}
+
+// Gets applied migration versions with the time they were applied
+func appliedMigrations(db *sql.DB) (map[int]time.Time, error) {
+	if err := ensureMigrationsTable(db); err != nil {
+		return nil, err
+	}
+
+	result, err := db.Query("SELECT version, appliedAt FROM " + migrationsTable)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	applied := map[int]time.Time{}
+	for result.Next() {
+		var version int
+		var appliedAt []byte
+		if err = result.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+
+		applied[version] = parseDBTime(appliedAt)
+	}
+
+	return applied, result.Err()
+}
+
+// Gets migrations that have not been applied yet
+func pendingMigrations(db *sql.DB) ([]Migration, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []Migration
+	for _, migration := range migrations {
+		if _, ok := applied[migration.Version]; !ok {
+			pending = append(pending, migration)
+		}
+	}
+
+	return pending, nil
+}
+
+// Applies every pending migration in order
+func migrateUp(db *sql.DB) error {
+	pending, err := pendingMigrations(db)
+	if err != nil {
+		return err
+	}
+
+	if len(pending) == 0 {
+		log.Println("Schema is up to date")
+		return nil
+	}
+
+	for _, migration := range pending {
+		for _, statement := range migration.Up {
+			if _, err = db.Exec(statement); err != nil {
+				return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+		}
+
+		_, err = db.Exec("INSERT INTO "+migrationsTable+" (version, name, appliedAt) VALUES (?, ?, ?)",
+			migration.Version, migration.Name, time.Now().UTC().Format(dbTimeLayout))
+		if err != nil {
+			return err
+		}
+
+		log.Printf("Applied %d_%s\n", migration.Version, migration.Name)
+	}
+
+	return nil
+}
+
+// Reverts the latest applied migration
+func migrateDown(db *sql.DB) error {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		migration := migrations[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+
+		for _, statement := range migration.Down {
+			if _, err = db.Exec(statement); err != nil {
+				return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+		}
+
+		if _, err = db.Exec("DELETE FROM "+migrationsTable+" WHERE version = ?", migration.Version); err != nil {
+			return err
+		}
+
+		log.Printf("Reverted %d_%s\n", migration.Version, migration.Name)
+		return nil
+	}
+
+	log.Println("No migration to revert")
+	return nil
+}
+
+// Prints every migration and whether it has been applied
+func migrationStatus(db *sql.DB) error {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range migrations {
+		status := "pending"
+		if appliedAt, ok := applied[migration.Version]; ok {
+			status = "applied " + appliedAt.Format(time.RFC3339)
+		}
+
+		fmt.Printf("%4d  %-40s %s\n", migration.Version, migration.Name, status)
+	}
+
+	return nil
+}
+
+// Checks that the schema has every migration applied
+func checkSchema(s Store) error {
+	db := storeDB(s)
+	if db == nil {
+		return nil
+	}
+
+	pending, err := pendingMigrations(db)
+	if err != nil {
+		return err
+	}
+
+	if len(pending) > 0 {
+		return errors.New("database schema is out of date, run `migrate up` first")
+	}
+
+	return nil
+}
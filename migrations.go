@@ -0,0 +1,307 @@
+package main
+
+// Migration is a numbered schema change, Up applies it and Down reverts it
+type Migration struct {
+	Version int
+	Name    string
+	Up      []string
+	Down    []string
+}
+
+// Schema migrations in order, append new ones at the end and never edit applied ones
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create_movies_users_reviews",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS movies(
+				id INTEGER UNSIGNED AUTO_INCREMENT,
+				title VARCHAR(75) NOT NULL,
+				avgRating DECIMAL(2,1) NOT NULL DEFAULT 0.0 CHECK(avgRating BETWEEN 0.0 AND 5.0),
+				raterNum INTEGER UNSIGNED NOT NULL DEFAULT 0,
+				CONSTRAINT id_pk PRIMARY KEY(id)
+			)`,
+			`CREATE TABLE IF NOT EXISTS users(
+				id INTEGER UNSIGNED AUTO_INCREMENT,
+				username VARCHAR(15) NOT NULL,
+				email VARCHAR(35) NOT NULL,
+				password VARCHAR(100) NOT NULL,
+				CONSTRAINT id_pk PRIMARY KEY(id)
+			)`,
+			`CREATE TABLE IF NOT EXISTS reviews(
+				id INTEGER UNSIGNED AUTO_INCREMENT,
+				rating INTEGER UNSIGNED NOT NULL DEFAULT 0 CHECK(rating BETWEEN 0 AND 5),
+				comment VARCHAR(500),
+				movieId INTEGER UNSIGNED NOT NULL,
+				userId INTEGER UNSIGNED NOT NULL,
+				CONSTRAINT id_pk PRIMARY KEY(id),
+				CONSTRAINT movieId_fk FOREIGN KEY(movieId) REFERENCES movies(id)
+					ON DELETE CASCADE
+					ON UPDATE RESTRICT,
+				CONSTRAINT userId_fk FOREIGN KEY(userId) REFERENCES users(id)
+					ON DELETE CASCADE
+					ON UPDATE RESTRICT
+			)`,
+		},
+		Down: []string{
+			`DROP TABLE reviews`,
+			`DROP TABLE users`,
+			`DROP TABLE movies`,
+		},
+	},
+	{
+		Version: 2,
+		Name:    "unique_review_per_user_and_movie",
+		Up: []string{
+			// Keep only the latest review of each user for each movie
+			`DELETE older FROM reviews AS older
+				INNER JOIN reviews AS newer
+				ON older.userId = newer.userId AND older.movieId = newer.movieId AND older.id < newer.id`,
+			`UPDATE movies
+				LEFT JOIN (SELECT movieId, AVG(rating) AS avgRating, COUNT(*) AS raterNum FROM reviews GROUP BY movieId) AS stats
+				ON stats.movieId = movies.id
+				SET movies.avgRating = COALESCE(ROUND(stats.avgRating, 1), 0), movies.raterNum = COALESCE(stats.raterNum, 0)`,
+			`ALTER TABLE reviews ADD CONSTRAINT userId_movieId_uq UNIQUE(userId, movieId)`,
+		},
+		Down: []string{
+			`ALTER TABLE reviews DROP INDEX userId_movieId_uq`,
+		},
+	},
+	{
+		Version: 3,
+		Name:    "review_timestamps",
+		Up: []string{
+			`ALTER TABLE reviews
+				ADD createdAt DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				ADD updatedAt DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP`,
+		},
+		Down: []string{
+			`ALTER TABLE reviews DROP COLUMN createdAt, DROP COLUMN updatedAt`,
+		},
+	},
+	{
+		Version: 4,
+		Name:    "movie_metadata",
+		Up: []string{
+			`ALTER TABLE movies
+				ADD releaseYear SMALLINT UNSIGNED NOT NULL DEFAULT 0,
+				ADD runtime SMALLINT UNSIGNED NOT NULL DEFAULT 0,
+				ADD synopsis VARCHAR(2000) NOT NULL DEFAULT '',
+				ADD originalLanguage CHAR(2) NOT NULL DEFAULT '',
+				ADD posterUrl VARCHAR(500) NOT NULL DEFAULT '',
+				ADD imdbId VARCHAR(12) NOT NULL DEFAULT '',
+				ADD tmdbId INTEGER UNSIGNED NOT NULL DEFAULT 0`,
+			`CREATE TABLE genres(
+				id INTEGER UNSIGNED AUTO_INCREMENT,
+				name VARCHAR(30) NOT NULL,
+				CONSTRAINT id_pk PRIMARY KEY(id),
+				CONSTRAINT name_uq UNIQUE(name)
+			)`,
+			`CREATE TABLE movie_genres(
+				movieId INTEGER UNSIGNED NOT NULL,
+				genreId INTEGER UNSIGNED NOT NULL,
+				CONSTRAINT movieId_genreId_pk PRIMARY KEY(movieId, genreId),
+				CONSTRAINT movie_genres_movieId_fk FOREIGN KEY(movieId) REFERENCES movies(id)
+					ON DELETE CASCADE
+					ON UPDATE RESTRICT,
+				CONSTRAINT movie_genres_genreId_fk FOREIGN KEY(genreId) REFERENCES genres(id)
+					ON DELETE CASCADE
+					ON UPDATE RESTRICT
+			)`,
+		},
+		Down: []string{
+			`DROP TABLE movie_genres`,
+			`DROP TABLE genres`,
+			`ALTER TABLE movies
+				DROP COLUMN releaseYear,
+				DROP COLUMN runtime,
+				DROP COLUMN synopsis,
+				DROP COLUMN originalLanguage,
+				DROP COLUMN posterUrl,
+				DROP COLUMN imdbId,
+				DROP COLUMN tmdbId`,
+		},
+	},
+	{
+		Version: 5,
+		Name:    "refresh_tokens",
+		Up: []string{
+			`CREATE TABLE refresh_tokens(
+				id CHAR(32) NOT NULL,
+				familyId CHAR(32) NOT NULL,
+				userId INTEGER UNSIGNED NOT NULL,
+				device VARCHAR(100) NOT NULL DEFAULT '',
+				expiresAt DATETIME NOT NULL,
+				usedAt DATETIME,
+				revokedAt DATETIME,
+				CONSTRAINT id_pk PRIMARY KEY(id),
+				INDEX familyId_idx(familyId),
+				CONSTRAINT refresh_tokens_userId_fk FOREIGN KEY(userId) REFERENCES users(id)
+					ON DELETE CASCADE
+					ON UPDATE RESTRICT
+			)`,
+		},
+		Down: []string{
+			`DROP TABLE refresh_tokens`,
+		},
+	},
+	{
+		Version: 6,
+		Name:    "user_roles",
+		Up: []string{
+			`ALTER TABLE users ADD role VARCHAR(10) NOT NULL DEFAULT 'user'`,
+		},
+		Down: []string{
+			`ALTER TABLE users DROP COLUMN role`,
+		},
+	},
+	{
+		Version: 7,
+		Name:    "email_tokens",
+		Up: []string{
+			`ALTER TABLE users ADD emailVerified BOOLEAN NOT NULL DEFAULT FALSE`,
+			// Accounts created before verification existed keep working
+			`UPDATE users SET emailVerified = TRUE`,
+			`CREATE TABLE email_tokens(
+				hash CHAR(64) NOT NULL,
+				userId INTEGER UNSIGNED NOT NULL,
+				purpose VARCHAR(20) NOT NULL,
+				expiresAt DATETIME NOT NULL,
+				usedAt DATETIME,
+				CONSTRAINT email_tokens_pk PRIMARY KEY(hash),
+				INDEX userId_purpose_idx(userId, purpose),
+				CONSTRAINT email_tokens_userId_fk FOREIGN KEY(userId) REFERENCES users(id)
+					ON DELETE CASCADE
+					ON UPDATE RESTRICT
+			)`,
+		},
+		Down: []string{
+			`DROP TABLE email_tokens`,
+			`ALTER TABLE users DROP COLUMN emailVerified`,
+		},
+	},
+	{
+		Version: 8,
+		Name:    "anonymous_reviews",
+		Up: []string{
+			// Reviews of deleted accounts are kept without an author
+			`ALTER TABLE reviews MODIFY userId INTEGER UNSIGNED NULL`,
+		},
+		Down: []string{
+			`DELETE FROM reviews WHERE userId IS NULL`,
+			`UPDATE movies
+				LEFT JOIN (SELECT movieId, AVG(rating) AS avgRating, COUNT(*) AS raterNum FROM reviews GROUP BY movieId) AS stats
+				ON stats.movieId = movies.id
+				SET movies.avgRating = COALESCE(ROUND(stats.avgRating, 1), 0), movies.raterNum = COALESCE(stats.raterNum, 0)`,
+			`ALTER TABLE reviews MODIFY userId INTEGER UNSIGNED NOT NULL`,
+		},
+	},
+	{
+		Version: 9,
+		Name:    "login_failures_audit_events",
+		Up: []string{
+			`CREATE TABLE login_failures(
+				throttleKey VARCHAR(150) NOT NULL,
+				count INTEGER UNSIGNED NOT NULL,
+				lastFailureAt DATETIME NOT NULL,
+				CONSTRAINT login_failures_pk PRIMARY KEY(throttleKey),
+				INDEX lastFailureAt_idx(lastFailureAt)
+			)`,
+			// Events outlive the users they are about
+			`CREATE TABLE audit_events(
+				id INTEGER UNSIGNED AUTO_INCREMENT,
+				type VARCHAR(30) NOT NULL,
+				userId INTEGER UNSIGNED,
+				ip VARCHAR(45) NOT NULL DEFAULT '',
+				detail VARCHAR(255) NOT NULL DEFAULT '',
+				createdAt DATETIME NOT NULL,
+				CONSTRAINT audit_events_pk PRIMARY KEY(id),
+				INDEX userId_idx(userId),
+				INDEX type_createdAt_idx(type, createdAt)
+			)`,
+		},
+		Down: []string{
+			`DROP TABLE audit_events`,
+			`DROP TABLE login_failures`,
+		},
+	},
+	{
+		Version: 10,
+		Name:    "totp",
+		Up: []string{
+			`ALTER TABLE users
+				ADD totpSecret VARCHAR(32),
+				ADD totpEnabled BOOLEAN NOT NULL DEFAULT FALSE,
+				ADD totpLastStep BIGINT NOT NULL DEFAULT 0`,
+			`CREATE TABLE recovery_codes(
+				userId INTEGER UNSIGNED NOT NULL,
+				hash CHAR(64) NOT NULL,
+				usedAt DATETIME,
+				CONSTRAINT recovery_codes_pk PRIMARY KEY(userId, hash),
+				CONSTRAINT recovery_codes_userId_fk FOREIGN KEY(userId) REFERENCES users(id)
+					ON DELETE CASCADE
+					ON UPDATE RESTRICT
+			)`,
+		},
+		Down: []string{
+			`DROP TABLE recovery_codes`,
+			`ALTER TABLE users DROP COLUMN totpSecret, DROP COLUMN totpEnabled, DROP COLUMN totpLastStep`,
+		},
+	},
+	{
+		Version: 11,
+		Name:    "user_identities",
+		Up: []string{
+			`CREATE TABLE user_identities(
+				provider VARCHAR(50) NOT NULL,
+				subject VARCHAR(255) NOT NULL,
+				userId INTEGER UNSIGNED NOT NULL,
+				createdAt DATETIME NOT NULL,
+				CONSTRAINT user_identities_pk PRIMARY KEY(provider, subject),
+				INDEX userId_idx(userId),
+				CONSTRAINT user_identities_userId_fk FOREIGN KEY(userId) REFERENCES users(id)
+					ON DELETE CASCADE
+					ON UPDATE RESTRICT
+			)`,
+		},
+		Down: []string{
+			`DROP TABLE user_identities`,
+		},
+	},
+	{
+		Version: 12,
+		Name:    "api_keys",
+		Up: []string{
+			`CREATE TABLE api_keys(
+				id INTEGER UNSIGNED AUTO_INCREMENT,
+				userId INTEGER UNSIGNED NOT NULL,
+				name VARCHAR(64) NOT NULL,
+				prefix VARCHAR(16) NOT NULL,
+				hash CHAR(64) NOT NULL,
+				scopes VARCHAR(255) NOT NULL,
+				createdAt DATETIME NOT NULL,
+				lastUsedAt DATETIME,
+				CONSTRAINT api_keys_pk PRIMARY KEY(id),
+				CONSTRAINT hash_uq UNIQUE(hash),
+				INDEX userId_idx(userId),
+				CONSTRAINT api_keys_userId_fk FOREIGN KEY(userId) REFERENCES users(id)
+					ON DELETE CASCADE
+					ON UPDATE RESTRICT
+			)`,
+		},
+		Down: []string{
+			`DROP TABLE api_keys`,
+		},
+	},
+	{
+		Version: 13,
+		Name:    "email_token_addresses",
+		Up: []string{
+			// Tokens sent before the address was recorded can not be checked against it, so they stop working
+			`ALTER TABLE email_tokens ADD email VARCHAR(35) NOT NULL DEFAULT ''`,
+		},
+		Down: []string{
+			`ALTER TABLE email_tokens DROP COLUMN email`,
+		},
+	},
+}
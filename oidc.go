@@ -0,0 +1,501 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Names OIDC providers may have, they appear in URLs and setting names
+var oidcProviderName = regexp.MustCompile(`^[a-z0-9]+$`)
+
+// Characters kept from a provider's username for new accounts
+var oidcUsernameStrip = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// How long a user has to finish logging in at the provider
+const oidcLoginLifetime = 10 * time.Minute
+
+// Returned by oidcUser when the ID token has no email to create or find an account with
+var errNoEmail = errors.New("identity has no email")
+
+// Returned by oidcUser when the email of the ID token is not one accounts can have
+var errInvalidEmail = errors.New("identity email is invalid")
+
+// Numbered usernames tried for a new account, bases have at most 12 characters so base999 still fits in 15
+const oidcUsernameNumbers = 999
+
+// Random usernames tried once every numbered one is taken
+const oidcUsernameRandomTries = 5
+
+// Client for requests to OIDC providers
+var oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// OIDCProvider is an OpenID Connect provider users can login with, its endpoints and keys are discovered on first use
+type OIDCProvider struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+
+	mu            sync.Mutex
+	discovery     *oidcDiscovery
+	keys          map[string]*rsa.PublicKey
+	keysFetchedAt time.Time
+}
+
+// Provider metadata from /.well-known/openid-configuration
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Identity of the user asserted by an ID token
+type oidcIdentity struct {
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	PreferredUsername string
+}
+
+// Login started at a provider, by its state parameter
+type oidcLogin struct {
+	Provider    string
+	Nonce       string
+	Verifier    string // PKCE code verifier
+	RedirectURI string
+	ExpiresAt   time.Time
+}
+
+// Logins waiting for the provider to redirect back, kept in memory
+var oidcLogins = struct {
+	sync.Mutex
+	byState map[string]oidcLogin
+}{byState: map[string]oidcLogin{}}
+
+// Gets JSON from the URL
+func getJSON(url string, value interface{}) error {
+	response, err := oidcHTTPClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return fmt.Errorf("GET %s: %s", url, response.Status)
+	}
+
+	return json.NewDecoder(response.Body).Decode(value)
+}
+
+// Gets the provider metadata, fetching it on first use
+func (provider *OIDCProvider) metadata() (*oidcDiscovery, error) {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	if provider.discovery != nil {
+		return provider.discovery, nil
+	}
+
+	discovery := new(oidcDiscovery)
+	if err := getJSON(provider.Issuer+"/.well-known/openid-configuration", discovery); err != nil {
+		return nil, err
+	}
+
+	if strings.TrimSuffix(discovery.Issuer, "/") != provider.Issuer {
+		return nil, fmt.Errorf("%s: discovery issuer %q does not match", provider.Name, discovery.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("%s: discovery is missing endpoints", provider.Name)
+	}
+
+	provider.discovery = discovery
+	return discovery, nil
+}
+
+// Gets a signing key of the provider by key ID, the keys are fetched again at most once a minute when one is missing
+func (provider *OIDCProvider) key(kid string) (*rsa.PublicKey, error) {
+	discovery, err := provider.metadata()
+	if err != nil {
+		return nil, err
+	}
+
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	if key, ok := provider.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(provider.keysFetchedAt) < time.Minute {
+		return nil, fmt.Errorf("%s: unknown key ID %q", provider.Name, kid)
+	}
+
+	var jwks struct {
+		Keys []JWK `json:"keys"`
+	}
+	if err = getJSON(discovery.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+
+	provider.keys = map[string]*rsa.PublicKey{}
+	provider.keysFetchedAt = time.Now()
+	for _, jwk := range jwks.Keys {
+		n, nErr := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, eErr := base64.RawURLEncoding.DecodeString(jwk.E)
+		if jwk.Kty != "RSA" || nErr != nil || eErr != nil {
+			continue
+		}
+
+		provider.keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+
+	if key, ok := provider.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s: unknown key ID %q", provider.Name, kid)
+}
+
+// URL the provider redirects back to, the callback of the deprecated route for logins started there so registered URIs keep working
+func (provider *OIDCProvider) redirectURI(deprecated bool) string {
+	prefix := apiV1Prefix
+	if deprecated {
+		prefix = "/api"
+	}
+
+	return config.APIURL + prefix + "/oidc/" + provider.Name + "/callback"
+}
+
+// Exchanges the authorization code for an ID token
+func (provider *OIDCProvider) exchange(code, verifier, redirectURI string) (string, error) {
+	discovery, err := provider.metadata()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURI)
+	form.Set("client_id", provider.ClientID)
+	form.Set("code_verifier", verifier)
+
+	request, err := http.NewRequest("POST", discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if provider.ClientSecret != "" {
+		request.SetBasicAuth(url.QueryEscape(provider.ClientID), url.QueryEscape(provider.ClientSecret))
+	}
+
+	response, err := oidcHTTPClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err = json.NewDecoder(response.Body).Decode(&tokens); err != nil {
+		return "", fmt.Errorf("%s: token response: %w", provider.Name, err)
+	}
+	if response.StatusCode != 200 || tokens.IDToken == "" {
+		return "", fmt.Errorf("%s: token request failed: %s %s %s", provider.Name, response.Status, tokens.Error, tokens.ErrorDescription)
+	}
+
+	return tokens.IDToken, nil
+}
+
+// Verifies the signature, issuer, audience, expiry and nonce of an ID token
+func (provider *OIDCProvider) verifyIDToken(idToken, nonce string) (*oidcIdentity, error) {
+	discovery, err := provider.metadata()
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := jwt.Parse(idToken, func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwt.SigningMethodRS256 {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+
+		kid, _ := token.Header["kid"].(string)
+		return provider.key(kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	claims := token.Claims.(jwt.MapClaims)
+
+	if claims["iss"] != discovery.Issuer {
+		return nil, errors.New("ID token issuer does not match")
+	}
+
+	audienceMatches := claims["aud"] == provider.ClientID
+	if audiences, ok := claims["aud"].([]interface{}); ok {
+		for _, audience := range audiences {
+			audienceMatches = audienceMatches || audience == provider.ClientID
+		}
+	}
+	if !audienceMatches {
+		return nil, errors.New("ID token is not for this client")
+	}
+
+	if _, ok := claims["exp"]; !ok {
+		return nil, errors.New("ID token has no expiry")
+	}
+	if claims["nonce"] != nonce {
+		return nil, errors.New("ID token nonce does not match")
+	}
+
+	identity := new(oidcIdentity)
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	identity.PreferredUsername, _ = claims["preferred_username"].(string)
+	// Some providers send the boolean as a string
+	identity.EmailVerified = claims["email_verified"] == true || claims["email_verified"] == "true"
+	if identity.Subject == "" {
+		return nil, errors.New("ID token has no subject")
+	}
+
+	return identity, nil
+}
+
+// Finds the user of the identity, linking it to the account with its verified email or creating an account
+func oidcUser(provider string, identity *oidcIdentity) (*User, error) {
+	user, err := store.GetUserByIdentity(provider, identity.Subject)
+	if err != errNotFound {
+		return user, err
+	}
+
+	if identity.Email == "" {
+		return nil, errNoEmail
+	}
+	// Same rules as the email of a registration
+	if validateValue("email", reflect.ValueOf(identity.Email), "email,max=35") != nil {
+		return nil, errInvalidEmail
+	}
+
+	user, err = store.GetUserByEmail(identity.Email)
+	if err == nil {
+		// Only an email both the provider and the account verified proves the account is the same person's,
+		// otherwise whoever registered the email unverified would keep access to the linked account
+		if !identity.EmailVerified || !user.EmailVerified {
+			return nil, errDuplicate
+		}
+	} else if err == errNotFound {
+		if user, err = createOIDCUser(identity); err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, err
+	}
+
+	if identity.EmailVerified && !user.EmailVerified {
+		if err = store.SetEmailVerified(user.ID); err != nil {
+			return nil, err
+		}
+		user.EmailVerified = true
+
+		if err = promoteListedAdmin(user); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = store.LinkIdentity(user.ID, provider, identity.Subject); err != nil {
+		return nil, err
+	}
+
+	log.Printf("User %d linked to %s identity %s\n", user.ID, provider, identity.Subject)
+	return user, nil
+}
+
+// Creates an account for an identity, with a free username based on the provider's and a random password that can be reset
+func createOIDCUser(identity *oidcIdentity) (*User, error) {
+	base := identity.PreferredUsername
+	if base == "" {
+		base = strings.Split(identity.Email, "@")[0]
+	}
+	base = oidcUsernameStrip.ReplaceAllString(base, "")
+	if len(base) > 12 {
+		base = base[:12]
+	}
+	if len(base) < 3 {
+		base = "user"
+	}
+
+	username, err := freeOIDCUsername(base)
+	if err != nil {
+		return nil, err
+	}
+
+	password, err := generateTokenID()
+	if err != nil {
+		return nil, err
+	}
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	userID, err := store.CreateUser(username, identity.Email, hashedPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	return &User{ID: userID, Username: username, Email: identity.Email, Role: "user"}, nil
+}
+
+// Finds a free username, base and then base2 to base999, or user and random hex digits once those are taken
+func freeOIDCUsername(base string) (string, error) {
+	for i := 1; i <= oidcUsernameNumbers+oidcUsernameRandomTries; i++ {
+		username := base
+		if i > oidcUsernameNumbers {
+			random, err := generateTokenID()
+			if err != nil {
+				return "", err
+			}
+			username = "user" + random[:8]
+		} else if i > 1 {
+			username = base + strconv.Itoa(i)
+		}
+
+		exists, err := store.UsernameExists(username)
+		if err != nil {
+			return "", err
+		} else if !exists {
+			return username, nil
+		}
+	}
+
+	return "", errors.New("no free username for " + base)
+}
+
+// OIDCLogin redirects to the provider to login
+func OIDCLogin(ctx *fiber.Ctx) error {
+	provider, ok := config.OIDCProviders[ctx.Params("provider")]
+	if !ok {
+		return errProviderNotFound
+	}
+
+	discovery, err := provider.metadata()
+	if err != nil {
+		log.Println(err.Error())
+		return newAPIError(502, "PROVIDER_UNAVAILABLE", "Identity provider unavailable")
+	}
+
+	// State ties the callback to this login, nonce ties the ID token to it and PKCE the code
+	var secrets [4]string
+	for i := range secrets {
+		if secrets[i], err = generateTokenID(); err != nil {
+			return err
+		}
+	}
+	state, nonce, verifier := secrets[0], secrets[1], secrets[2]+secrets[3]
+	challenge := sha256.Sum256([]byte(verifier))
+
+	oidcLogins.Lock()
+	for other, login := range oidcLogins.byState {
+		if login.ExpiresAt.Before(time.Now()) {
+			delete(oidcLogins.byState, other)
+		}
+	}
+	redirectURI := provider.redirectURI(deprecatedRoute(ctx))
+	oidcLogins.byState[state] = oidcLogin{Provider: provider.Name, Nonce: nonce, Verifier: verifier, RedirectURI: redirectURI, ExpiresAt: time.Now().Add(oidcLoginLifetime)}
+	oidcLogins.Unlock()
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", provider.ClientID)
+	query.Set("redirect_uri", redirectURI)
+	query.Set("scope", "openid email profile")
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	if hint := ctx.Query("login_hint"); hint != "" {
+		query.Set("login_hint", hint)
+	}
+
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return ctx.Redirect(discovery.AuthorizationEndpoint+separator+query.Encode(), 302)
+}
+
+// OIDCCallback finishes a login at the provider, the client app gets the tokens (or the 2FA challenge) in the URL fragment of APP_URL/oidc/callback
+func OIDCCallback(ctx *fiber.Ctx) error {
+	provider, ok := config.OIDCProviders[ctx.Params("provider")]
+	if !ok {
+		return errProviderNotFound
+	}
+
+	// Use up the started login
+	oidcLogins.Lock()
+	login, ok := oidcLogins.byState[ctx.Query("state")]
+	delete(oidcLogins.byState, ctx.Query("state"))
+	oidcLogins.Unlock()
+	if !ok || login.Provider != provider.Name || login.ExpiresAt.Before(time.Now()) {
+		return newAPIError(400, "INVALID_LOGIN_STATE", "Invalid or expired login")
+	}
+
+	if ctx.Query("error") != "" {
+		return newAPIError(401, "PROVIDER_LOGIN_REFUSED", "Login refused by the identity provider: "+ctx.Query("error"))
+	}
+
+	idToken, err := provider.exchange(ctx.Query("code"), login.Verifier, login.RedirectURI)
+	if err != nil {
+		log.Println(err.Error())
+		return newAPIError(502, "PROVIDER_LOGIN_FAILED", "Identity provider login failed")
+	}
+
+	identity, err := provider.verifyIDToken(idToken, login.Nonce)
+	if err != nil {
+		log.Println(err.Error())
+		return newAPIError(401, "INVALID_ID_TOKEN", "Invalid ID token")
+	}
+
+	user, err := oidcUser(provider.Name, identity)
+	if err == errNoEmail {
+		return newAPIError(400, "PROVIDER_EMAIL_MISSING", "The identity provider did not share an email")
+	} else if err == errInvalidEmail {
+		return newAPIError(400, "PROVIDER_EMAIL_INVALID", "The email the identity provider shared is not valid or longer than 35 characters")
+	} else if err == errDuplicate {
+		return newAPIError(409, "ACCOUNT_EXISTS", "An account uses this email, login with its password and verify the email first")
+	} else if err != nil {
+		return err
+	}
+
+	body, err := loginBody(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	// Tokens go in the fragment so they are not sent to servers or written to their logs
+	fragment := url.Values{}
+	for key, value := range body {
+		fragment.Set(key, fmt.Sprint(value))
+	}
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	return ctx.Redirect(config.AppURL+"/oidc/callback#"+fragment.Encode(), 302)
+}
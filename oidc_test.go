@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gofiber/fiber/v2"
+)
+
+// OIDC provider serving discovery, JWKS and token endpoints, the test plays the browser at the authorization endpoint
+type mockOIDCProvider struct {
+	server *httptest.Server
+	mu     sync.Mutex
+	codes  map[string]mockOIDCGrant
+}
+
+// Authorization granted by the mock provider, redeemed at its token endpoint
+type mockOIDCGrant struct {
+	claims      jwt.MapClaims
+	challenge   string
+	redirectURI string
+}
+
+// Starts a mock provider and configures it as "mock"
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	provider := &mockOIDCProvider{codes: map[string]mockOIDCGrant{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                provider.server.URL,
+			AuthorizationEndpoint: provider.server.URL + "/authorize",
+			TokenEndpoint:         provider.server.URL + "/token",
+			JWKSURI:               provider.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		key := &testKey.key.PublicKey
+		json.NewEncoder(w).Encode(map[string][]JWK{"keys": {{
+			Kty: "RSA",
+			Kid: "mock",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		clientID, secret, _ := r.BasicAuth()
+
+		provider.mu.Lock()
+		grant, ok := provider.codes[r.Form.Get("code")]
+		delete(provider.codes, r.Form.Get("code"))
+		provider.mu.Unlock()
+
+		challenge := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		if !ok || clientID != "client" || secret != "secret" || r.Form.Get("redirect_uri") != grant.redirectURI ||
+			base64.RawURLEncoding.EncodeToString(challenge[:]) != grant.challenge {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, grant.claims)
+		token.Header["kid"] = "mock"
+		idToken, err := token.SignedString(testKey.key)
+		if err != nil {
+			t.Error(err)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idToken})
+	})
+
+	provider.server = httptest.NewServer(mux)
+	t.Cleanup(provider.server.Close)
+
+	config.OIDCProviders["mock"] = &OIDCProvider{Name: "mock", Issuer: provider.server.URL, ClientID: "client", ClientSecret: "secret"}
+	return provider
+}
+
+// Logs in at the provider with the claims of an identity and returns the response of the callback
+func (provider *mockOIDCProvider) login(t *testing.T, app *fiber.App, claims jwt.MapClaims) (*http.Response, map[string]interface{}) {
+	t.Helper()
+
+	response, _ := testRequest(t, app, "GET", "/api/v1/oidc/mock/login", "", nil)
+	if response.StatusCode != 302 {
+		t.Fatalf("login responded with %d", response.StatusCode)
+	}
+	authorize, err := url.Parse(response.Header.Get(fiber.HeaderLocation))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := authorize.Query()
+
+	if query.Get("redirect_uri") != config.APIURL+"/api/v1/oidc/mock/callback" {
+		t.Fatalf("redirect URI is %s", query.Get("redirect_uri"))
+	}
+
+	claims["iss"] = provider.server.URL
+	claims["aud"] = "client"
+	claims["nonce"] = query.Get("nonce")
+	claims["exp"] = time.Now().Add(time.Minute).Unix()
+
+	code := "code-" + query.Get("state")
+	provider.mu.Lock()
+	provider.codes[code] = mockOIDCGrant{claims: claims, challenge: query.Get("code_challenge"), redirectURI: query.Get("redirect_uri")}
+	provider.mu.Unlock()
+
+	return testRequest(t, app, "GET", "/api/v1/oidc/mock/callback?"+url.Values{"code": {code}, "state": {query.Get("state")}}.Encode(), "", nil)
+}
+
+// Gets the account the callback logged in to from the tokens in its redirect
+func oidcLoggedInUser(t *testing.T, app *fiber.App, response *http.Response) map[string]interface{} {
+	t.Helper()
+
+	location, err := url.Parse(response.Header.Get(fiber.HeaderLocation))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location.Host != "app.test" || location.Path != "/oidc/callback" {
+		t.Fatalf("callback redirected to %s", location)
+	}
+
+	fragment, err := url.ParseQuery(location.Fragment)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, me := testRequest(t, app, "GET", "/api/v1/me", fragment.Get("accessToken"), nil)
+	return me
+}
+
+func TestOIDCLogin(t *testing.T) {
+	tests := []struct {
+		name          string
+		localEmail    string // Email of an existing account, none if empty
+		localVerified bool
+		claims        jwt.MapClaims
+		status        int
+		code          string // Error code when the login is refused
+		linked        bool   // Logged in to the existing account
+	}{
+		{
+			name:   "creates an account",
+			claims: jwt.MapClaims{"sub": "1", "email": "new@example.com", "email_verified": true, "preferred_username": "new user"},
+			status: 302,
+		},
+		{
+			name:          "links a verified account",
+			localEmail:    "bob@example.com",
+			localVerified: true,
+			claims:        jwt.MapClaims{"sub": "2", "email": "bob@example.com", "email_verified": true},
+			status:        302,
+			linked:        true,
+		},
+		{
+			name:       "refuses an unverified account",
+			localEmail: "bob@example.com",
+			claims:     jwt.MapClaims{"sub": "3", "email": "bob@example.com", "email_verified": true},
+			status:     409,
+			code:       "ACCOUNT_EXISTS",
+		},
+		{
+			name:          "refuses an email the provider did not verify",
+			localEmail:    "bob@example.com",
+			localVerified: true,
+			claims:        jwt.MapClaims{"sub": "4", "email": "bob@example.com", "email_verified": false},
+			status:        409,
+			code:          "ACCOUNT_EXISTS",
+		},
+		{
+			name:   "refuses an identity without email",
+			claims: jwt.MapClaims{"sub": "5"},
+			status: 400,
+			code:   "PROVIDER_EMAIL_MISSING",
+		},
+		{
+			name:   "refuses an invalid email",
+			claims: jwt.MapClaims{"sub": "6", "email": "new@localhost", "email_verified": true},
+			status: 400,
+			code:   "PROVIDER_EMAIL_INVALID",
+		},
+		{
+			name:   "refuses an email longer than accounts have",
+			claims: jwt.MapClaims{"sub": "7", "email": strings.Repeat("n", 24) + "@example.com", "email_verified": true},
+			status: 400,
+			code:   "PROVIDER_EMAIL_INVALID",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app, _ := newTestApp(t)
+			provider := newMockOIDCProvider(t)
+
+			localID := 0
+			if test.localEmail != "" {
+				var err error
+				if localID, err = store.CreateUser("bob", test.localEmail, "hash"); err != nil {
+					t.Fatal(err)
+				}
+				if test.localVerified {
+					if err = store.SetEmailVerified(localID); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			response, body := provider.login(t, app, test.claims)
+			if response.StatusCode != test.status {
+				t.Fatalf("callback responded with %d %v, want %d", response.StatusCode, body, test.status)
+			}
+			if test.status != 302 {
+				if body["code"] != test.code {
+					t.Errorf("error code is %v, want %s", body["code"], test.code)
+				}
+				if _, err := store.GetUserByIdentity("mock", test.claims["sub"].(string)); err != errNotFound {
+					t.Errorf("identity was linked")
+				}
+				return
+			}
+
+			me := oidcLoggedInUser(t, app, response)
+			if me["email"] != test.claims["email"] || me["emailVerified"] != true {
+				t.Errorf("logged in as %v", me)
+			}
+			if linked := int(me["id"].(float64)) == localID; linked != test.linked {
+				t.Errorf("logged in to user %v, the existing account is %d", me["id"], localID)
+			}
+
+			// The next login finds the account by the identity, whatever the email is by then
+			test.claims["email"] = "changed@example.com"
+			response, body = provider.login(t, app, test.claims)
+			if response.StatusCode != 302 {
+				t.Fatalf("second login responded with %d %v", response.StatusCode, body)
+			}
+			if again := oidcLoggedInUser(t, app, response); again["id"] != me["id"] {
+				t.Errorf("second login is user %v, first was %v", again["id"], me["id"])
+			}
+
+			identities, err := store.GetUserIdentities(int(me["id"].(float64)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(identities) != 1 || identities[0].Provider != "mock" || identities[0].Subject != test.claims["sub"] {
+				t.Errorf("linked identities are %v", identities)
+			}
+		})
+	}
+}
+
+func TestFreeOIDCUsername(t *testing.T) {
+	store = newMemoryStore()
+
+	base := "abcdefghijkl"
+	for i := 1; i <= oidcUsernameNumbers; i++ {
+		username := base
+		if i > 1 {
+			username += strconv.Itoa(i)
+		}
+		if _, err := store.CreateUser(username, strconv.Itoa(i)+"@example.com", "hash"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every numbered username is taken, a random one still fits
+	username, err := freeOIDCUsername(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(username, "user") || len(username) > 15 {
+		t.Errorf("got username %q", username)
+	}
+}
+
+func TestOIDCCallbackRejectsUnknownState(t *testing.T) {
+	app, _ := newTestApp(t)
+	newMockOIDCProvider(t)
+
+	response, body := testRequest(t, app, "GET", "/api/v1/oidc/mock/callback?code=x&state=unknown", "", nil)
+	if response.StatusCode != 400 || body["code"] != "INVALID_LOGIN_STATE" {
+		t.Errorf("callback responded with %d %v", response.StatusCode, body)
+	}
+}
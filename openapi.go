@@ -0,0 +1,479 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	swaggerFiles "github.com/swaggo/files/v2"
+)
+
+// apiOperation documents a route of setupRoutes, a test checks every route has one
+type apiOperation struct {
+	Method   string
+	Path     string // As registered, :params become {params}
+	OldPath  string // Deprecated unversioned alias of the route
+	Tag      string
+	Summary  string
+	Auth     string // Security scheme of the token the route needs, empty for none
+	Scope    string // Scope API keys need, empty if they cannot use the route
+	Role     string // Least role the route needs
+	Query    []apiParam
+	Body     interface{} // Request body type, nil for none
+	Status   int
+	Response interface{} // Response body type, apiSchema or apiPage, nil for none
+}
+
+// apiParam is a query parameter of an operation
+type apiParam struct {
+	Name        string
+	Type        string
+	Description string
+}
+
+// apiSchema is a JSON schema written out, for responses without a type
+type apiSchema map[string]interface{}
+
+// apiPage is the response of a paginated list, a page type whose data are items
+type apiPage struct {
+	Page interface{}
+	Item interface{}
+}
+
+// Query parameters of paginated lists
+var pageParams = []apiParam{
+	{"page", "integer", "Page number, starting at 1"},
+	{"limit", "integer", "Items per page, at most " + strconv.Itoa(maxPageLimit)},
+}
+
+// Responses built as maps
+var (
+	tokensSchema = objectSchema(map[string]interface{}{
+		"accessToken":  "string",
+		"refreshToken": "string",
+	})
+	loginSchema = apiSchema{"oneOf": []interface{}{
+		objectSchema(map[string]interface{}{
+			"accessToken":   "string",
+			"refreshToken":  "string",
+			"username":      "string",
+			"email":         "string",
+			"role":          "string",
+			"emailVerified": "boolean",
+		}),
+		objectSchema(map[string]interface{}{
+			"mfaRequired":    "boolean",
+			"challengeToken": "string",
+		}),
+	}}
+	profileSchema = objectSchema(map[string]interface{}{
+		"id":            "integer",
+		"username":      "string",
+		"email":         "string",
+		"role":          "string",
+		"emailVerified": "boolean",
+	})
+	successSchema = objectSchema(map[string]interface{}{
+		"success": "string",
+	})
+	exportSchema = objectSchema(map[string]interface{}{
+		"status":    "string",
+		"createdAt": "date-time",
+		"url":       "string",
+		"expiresAt": "date-time",
+	})
+	apiKeySchema = objectSchema(map[string]interface{}{
+		"id":         "integer",
+		"name":       "string",
+		"prefix":     "string",
+		"scopes":     apiSchema{"type": "array", "items": apiSchema{"type": "string", "enum": apiKeyScopes}},
+		"createdAt":  "date-time",
+		"lastUsedAt": "date-time",
+		"key":        "string",
+	})
+)
+
+// Every route of setupRoutes
+var apiOperations = []apiOperation{
+	{Method: "GET", Path: "/", Tag: "meta", Summary: "Welcome message", Status: 200, Response: apiSchema{"type": "string"}},
+	{Method: "GET", Path: "/.well-known/jwks.json", Tag: "meta", Summary: "Public keys access tokens are signed with", Status: 200, Response: objectSchema(map[string]interface{}{"keys": apiSchema{"type": "array", "items": schemaRef("JWK")}})},
+	{Method: "GET", Path: "/api/openapi.json", Tag: "meta", Summary: "This document", Status: 200, Response: apiSchema{"type": "object"}},
+	{Method: "GET", Path: "/api/docs", Tag: "meta", Summary: "Swagger UI of this document", Status: 200, Response: apiSchema{"type": "string"}},
+	{Method: "GET", Path: "/api/docs/:file", Tag: "meta", Summary: "Script or stylesheet of Swagger UI", Status: 200, Response: apiSchema{"type": "string"}},
+
+	{Method: "POST", Path: "/api/v1/register", OldPath: "/api/register", Tag: "auth", Summary: "Create an account and log in", Body: RegisterData{}, Status: 200, Response: loginSchema},
+	{Method: "POST", Path: "/api/v1/login", OldPath: "/api/login", Tag: "auth", Summary: "Log in with email and password, users with 2FA get a challenge token", Body: LoginData{}, Status: 200, Response: loginSchema},
+	{Method: "POST", Path: "/api/v1/login/2fa", OldPath: "/api/login/2fa", Tag: "auth", Summary: "Finish a login with a 2FA code or recovery code", Body: LoginTwoFactorData{}, Status: 200, Response: loginSchema},
+	{Method: "GET", Path: "/api/v1/oidc/:provider/login", OldPath: "/api/oidc/:provider/login", Tag: "auth", Summary: "Redirect to the identity provider", Query: []apiParam{{"login_hint", "string", "Email to suggest to the provider"}}, Status: 302},
+	{Method: "GET", Path: "/api/v1/oidc/:provider/callback", OldPath: "/api/oidc/:provider/callback", Tag: "auth", Summary: "Return from the identity provider, redirects to the app with the tokens in the fragment", Query: []apiParam{{"state", "string", ""}, {"code", "string", ""}, {"error", "string", ""}}, Status: 302},
+	{Method: "GET", Path: "/api/v1/refresh", OldPath: "/api/refresh", Tag: "auth", Summary: "Rotate the refresh token", Auth: "refreshToken", Status: 200, Response: tokensSchema},
+	{Method: "POST", Path: "/api/v1/logout", OldPath: "/api/logout", Tag: "auth", Summary: "Revoke the refresh token and its family", Auth: "refreshToken", Status: 204},
+	{Method: "POST", Path: "/api/v1/logout-all", OldPath: "/api/logout-all", Tag: "auth", Summary: "Revoke every refresh token of the user", Auth: "accessToken", Status: 204},
+	{Method: "POST", Path: "/api/v1/verify-email", OldPath: "/api/verify-email", Tag: "auth", Summary: "Verify the email with the emailed token", Body: EmailTokenData{}, Status: 204},
+	{Method: "POST", Path: "/api/v1/verify-email/resend", OldPath: "/api/verify-email/resend", Tag: "auth", Summary: "Send the verification email again", Auth: "accessToken", Status: 202},
+	{Method: "POST", Path: "/api/v1/password/forgot", OldPath: "/api/password/forgot", Tag: "auth", Summary: "Email a password reset link", Body: ForgotPasswordData{}, Status: 202},
+	{Method: "POST", Path: "/api/v1/password/reset", OldPath: "/api/password/reset", Tag: "auth", Summary: "Set a new password with the emailed token", Body: ResetPasswordData{}, Status: 204},
+
+	{Method: "GET", Path: "/api/v1/me", OldPath: "/api/me", Tag: "account", Summary: "Profile of the user", Auth: "accessToken", Scope: "profile:read", Status: 200, Response: profileSchema},
+	{Method: "PATCH", Path: "/api/v1/me", OldPath: "/api/me", Tag: "account", Summary: "Change the username or email, the email needs the password", Auth: "accessToken", Body: UpdateProfileData{}, Status: 200, Response: profileSchema},
+	{Method: "DELETE", Path: "/api/v1/me", OldPath: "/api/me", Tag: "account", Summary: "Delete the account", Auth: "accessToken", Body: DeleteAccountData{}, Status: 204},
+	{Method: "POST", Path: "/api/v1/me/password", OldPath: "/api/me/password", Tag: "account", Summary: "Change the password, other sessions are logged out", Auth: "accessToken", Body: ChangePasswordData{}, Status: 200, Response: tokensSchema},
+	{Method: "GET", Path: "/api/v1/me/export", OldPath: "/api/me/export", Tag: "account", Summary: "Start an export of the user's data or get the last one", Auth: "accessToken", Status: 200, Response: exportSchema},
+	{Method: "GET", Path: "/api/v1/exports/:token", OldPath: "/api/exports/:token", Tag: "account", Summary: "Download an export, the token authorizes it", Status: 200, Response: apiSchema{"type": "string", "format": "binary"}},
+	{Method: "POST", Path: "/api/v1/me/2fa/setup", OldPath: "/api/me/2fa/setup", Tag: "account", Summary: "Start enrolling in 2FA", Auth: "accessToken", Status: 200, Response: objectSchema(map[string]interface{}{"secret": "string", "otpauthUri": "string"})},
+	{Method: "POST", Path: "/api/v1/me/2fa/confirm", OldPath: "/api/me/2fa/confirm", Tag: "account", Summary: "Turn 2FA on with a code", Auth: "accessToken", Body: TwoFactorCodeData{}, Status: 200, Response: objectSchema(map[string]interface{}{"recoveryCodes": apiSchema{"type": "array", "items": apiSchema{"type": "string"}}})},
+	{Method: "POST", Path: "/api/v1/me/2fa/recovery-codes", OldPath: "/api/me/2fa/recovery-codes", Tag: "account", Summary: "Replace the recovery codes", Auth: "accessToken", Body: TwoFactorCodeData{}, Status: 200, Response: objectSchema(map[string]interface{}{"recoveryCodes": apiSchema{"type": "array", "items": apiSchema{"type": "string"}}})},
+	{Method: "DELETE", Path: "/api/v1/me/2fa", OldPath: "/api/me/2fa", Tag: "account", Summary: "Turn 2FA off", Auth: "accessToken", Body: DisableTwoFactorData{}, Status: 204},
+	{Method: "GET", Path: "/api/v1/me/api-keys", OldPath: "/api/me/api-keys", Tag: "account", Summary: "API keys of the user", Auth: "accessToken", Status: 200, Response: objectSchema(map[string]interface{}{"apiKeys": apiSchema{"type": "array", "items": apiKeySchema}})},
+	{Method: "POST", Path: "/api/v1/me/api-keys", OldPath: "/api/me/api-keys", Tag: "account", Summary: "Create an API key, the key is only returned now", Auth: "accessToken", Body: AddAPIKeyData{}, Status: 201, Response: apiKeySchema},
+	{Method: "DELETE", Path: "/api/v1/me/api-keys/:id", OldPath: "/api/me/api-keys/:id", Tag: "account", Summary: "Revoke an API key", Auth: "accessToken", Status: 204},
+
+	{Method: "GET", Path: "/api/v1/movies", OldPath: "/api/movies", Tag: "movies", Summary: "Page of movies", Auth: "accessToken", Scope: "movies:read", Query: append([]apiParam{{"sort", "string", "One of " + strings.Join(movieSorts, ", ")}, {"minRating", "number", ""}, {"minRaters", "integer", ""}}, pageParams...), Status: 200, Response: apiPage{Page{}, Movie{}}},
+	{Method: "GET", Path: "/api/v1/movies/search", OldPath: "/api/movies/search", Tag: "movies", Summary: "Movies matching the query, most relevant first", Auth: "accessToken", Scope: "movies:read", Query: append([]apiParam{{"q", "string", "Words to search titles and synopses for"}}, pageParams...), Status: 200, Response: apiPage{Page{}, Movie{}}},
+	{Method: "GET", Path: "/api/v1/movies/suggest", OldPath: "/api/movies/suggest", Tag: "movies", Summary: "Titles starting with the query", Auth: "accessToken", Scope: "movies:read", Query: []apiParam{{"q", "string", ""}, {"limit", "integer", "At most 20"}}, Status: 200, Response: []Suggestion{}},
+	{Method: "GET", Path: "/api/v1/movies/:id", OldPath: "/api/movies/:id", Tag: "movies", Summary: "A movie", Auth: "accessToken", Scope: "movies:read", Status: 200, Response: Movie{}},
+	{Method: "POST", Path: "/api/v1/movies", OldPath: "/api/movie", Tag: "movies", Summary: "Add a movie", Auth: "accessToken", Scope: "movies:write", Role: "moderator", Body: NewMovie{}, Status: 201, Response: Movie{}},
+	{Method: "PATCH", Path: "/api/v1/movies/:id", OldPath: "/api/movies/:id", Tag: "movies", Summary: "Change a movie, fields left out keep their value", Auth: "accessToken", Scope: "movies:write", Role: "moderator", Body: NewMovie{}, Status: 200, Response: Movie{}},
+	{Method: "DELETE", Path: "/api/v1/movies/:id", OldPath: "/api/movies/:id", Tag: "movies", Summary: "Delete a movie and its reviews", Auth: "accessToken", Scope: "movies:write", Role: "moderator", Status: 204},
+
+	{Method: "GET", Path: "/api/v1/movies/:id/reviews", OldPath: "/api/reviews/:id", Tag: "reviews", Summary: "A movie with a page of its reviews", Auth: "accessToken", Scope: "reviews:read", Query: append([]apiParam{{"sort", "string", "One of " + strings.Join(reviewSorts, ", ")}, {"rating", "integer", ""}}, pageParams...), Status: 200, Response: apiPage{ReviewPage{}, Review{}}},
+	{Method: "POST", Path: "/api/v1/movies/:id/reviews", OldPath: "/api/review/:id", Tag: "reviews", Summary: "Review a movie", Auth: "accessToken", Scope: "reviews:write", Body: NewReview{}, Status: 201, Response: successSchema},
+	{Method: "PATCH", Path: "/api/v1/reviews/:reviewId", OldPath: "/api/reviews/:reviewId", Tag: "reviews", Summary: "Change a review of the user, fields left out keep their value", Auth: "accessToken", Scope: "reviews:write", Body: NewReview{}, Status: 200, Response: Review{}},
+	{Method: "DELETE", Path: "/api/v1/reviews/:reviewId", OldPath: "/api/reviews/:reviewId", Tag: "reviews", Summary: "Delete a review of the user", Auth: "accessToken", Scope: "reviews:write", Status: 204},
+	{Method: "DELETE", Path: "/api/v1/moderation/reviews/:reviewId", OldPath: "/api/moderation/reviews/:reviewId", Tag: "reviews", Summary: "Remove any review", Auth: "accessToken", Scope: "reviews:moderate", Role: "moderator", Status: 204},
+
+	{Method: "PUT", Path: "/api/v1/admin/users/:id/role", OldPath: "/api/admin/users/:id/role", Tag: "admin", Summary: "Change the role of a user", Auth: "accessToken", Role: "admin", Body: NewRole{}, Status: 200, Response: objectSchema(map[string]interface{}{"id": "integer", "role": "string"})},
+}
+
+// Parameters of registered paths
+var pathParamPattern = regexp.MustCompile(`:(\w+)`)
+
+// OpenAPI gets the OpenAPI 3 document of the API
+func OpenAPI(ctx *fiber.Ctx) error {
+	return ctx.Status(200).JSON(openAPIDocument())
+}
+
+// APIDocs shows the OpenAPI document in Swagger UI
+func APIDocs(ctx *fiber.Ctx) error {
+	ctx.Type("html")
+	return ctx.Status(200).SendString(swaggerUIPage)
+}
+
+// APIDocsAsset gets a file of Swagger UI, they are built into the binary so the docs work offline
+func APIDocsAsset(ctx *fiber.Ctx) error {
+	file := ctx.Params("file")
+	if !swaggerUIAssets[file] {
+		return errRouteNotFound
+	}
+
+	content, err := fs.ReadFile(swaggerFiles.FS, file)
+	if err != nil {
+		return err
+	}
+
+	ctx.Type(path.Ext(file))
+	ctx.Set("Cache-Control", "public, max-age=86400")
+	return ctx.Status(200).Send(content)
+}
+
+// Builds the OpenAPI document from apiOperations, schemas of types are generated from their fields and tags
+func openAPIDocument() map[string]interface{} {
+	schemas := map[string]interface{}{}
+	schemaOf(reflect.TypeOf(APIError{}), schemas)
+	schemaOf(reflect.TypeOf(JWK{}), schemas)
+
+	paths := map[string]map[string]interface{}{}
+	addOperation := func(method, path string, document map[string]interface{}) {
+		path = pathParamPattern.ReplaceAllString(path, "{$1}")
+		if paths[path] == nil {
+			paths[path] = map[string]interface{}{}
+		}
+		paths[path][strings.ToLower(method)] = document
+	}
+
+	for _, operation := range apiOperations {
+		addOperation(operation.Method, operation.Path, operation.document(schemas))
+
+		if operation.OldPath != "" {
+			document := operation.document(schemas)
+			document["deprecated"] = true
+			document["description"] = strings.TrimSpace(fmt.Sprintf("%s Deprecated alias of %s %s until %s, movies, reviews and suggestions keep their old field names.",
+				document["description"], operation.Method, operation.Path, unversionedSunsetAt.Format("2006-01-02")))
+			addOperation(operation.Method, operation.OldPath, document)
+		}
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Movie Rater API",
+			"version": "1.0.0",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"accessToken":  map[string]interface{}{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+				"refreshToken": map[string]interface{}{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+				"apiKey":       map[string]interface{}{"type": "http", "scheme": "bearer", "description": "Personal API key starting with " + apiKeyPrefix},
+			},
+		},
+	}
+}
+
+// Documents the operation, adding the schemas of its types
+func (operation *apiOperation) document(schemas map[string]interface{}) map[string]interface{} {
+	parameters := []interface{}{}
+	for _, match := range pathParamPattern.FindAllStringSubmatch(operation.Path, -1) {
+		paramType := "string"
+		if match[1] == "id" || strings.HasSuffix(match[1], "Id") {
+			paramType = "integer"
+		}
+		parameters = append(parameters, map[string]interface{}{"name": match[1], "in": "path", "required": true, "schema": apiSchema{"type": paramType}})
+	}
+	for _, param := range operation.Query {
+		parameter := map[string]interface{}{"name": param.Name, "in": "query", "schema": apiSchema{"type": param.Type}}
+		if param.Description != "" {
+			parameter["description"] = param.Description
+		}
+		parameters = append(parameters, parameter)
+	}
+
+	success := map[string]interface{}{"description": strconv.Itoa(operation.Status) + " " + utils.StatusMessage(operation.Status)}
+	if operation.Response != nil {
+		success["content"] = map[string]interface{}{"application/json": map[string]interface{}{"schema": bodySchema(operation.Response, schemas)}}
+	}
+
+	result := map[string]interface{}{
+		"tags":       []string{operation.Tag},
+		"summary":    operation.Summary,
+		"parameters": parameters,
+		"responses": map[string]interface{}{
+			strconv.Itoa(operation.Status): success,
+			"default": map[string]interface{}{
+				"description": "Error",
+				"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": schemaRef("APIError")}},
+			},
+		},
+	}
+
+	if operation.Body != nil {
+		result["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  map[string]interface{}{"application/json": map[string]interface{}{"schema": bodySchema(operation.Body, schemas)}},
+		}
+	}
+
+	// Security and what else the route needs
+	security := []interface{}{}
+	description := []string{}
+	if operation.Auth != "" {
+		security = append(security, map[string]interface{}{operation.Auth: []string{}})
+	}
+	if operation.Scope != "" {
+		security = append(security, map[string]interface{}{"apiKey": []string{}})
+		description = append(description, "API keys need the "+operation.Scope+" scope.")
+	}
+	if operation.Role != "" {
+		description = append(description, "Needs the "+operation.Role+" role.")
+	}
+	result["security"] = security
+	if len(description) > 0 {
+		result["description"] = strings.Join(description, " ")
+	}
+
+	return result
+}
+
+// Schema of a request or response body, a type, an apiSchema or an apiPage
+func bodySchema(body interface{}, schemas map[string]interface{}) interface{} {
+	switch body := body.(type) {
+	case apiSchema:
+		return body
+	case apiPage:
+		return apiSchema{"allOf": []interface{}{
+			schemaOf(reflect.TypeOf(body.Page), schemas),
+			objectSchema(map[string]interface{}{"data": apiSchema{"type": "array", "items": schemaOf(reflect.TypeOf(body.Item), schemas)}}),
+		}}
+	default:
+		return schemaOf(reflect.TypeOf(body), schemas)
+	}
+}
+
+// Schema of an object, properties are a schema or the name of a type or format
+func objectSchema(properties map[string]interface{}) apiSchema {
+	result := apiSchema{}
+	for name, property := range properties {
+		switch property {
+		case "date-time":
+			result[name] = apiSchema{"type": "string", "format": "date-time"}
+		case "string", "integer", "number", "boolean":
+			result[name] = apiSchema{"type": property}
+		default:
+			result[name] = property
+		}
+	}
+
+	return apiSchema{"type": "object", "properties": result}
+}
+
+// Reference to a schema of the components
+func schemaRef(name string) apiSchema {
+	return apiSchema{"$ref": "#/components/schemas/" + name}
+}
+
+// Schema of a Go type as encoding/json writes it, named structs are added to schemas and referenced
+func schemaOf(t reflect.Type, schemas map[string]interface{}) apiSchema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return apiSchema{"type": "string"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return apiSchema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return apiSchema{"type": "number"}
+	case reflect.Bool:
+		return apiSchema{"type": "boolean"}
+	case reflect.Slice:
+		return apiSchema{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return apiSchema{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case reflect.Struct:
+		if t == reflect.TypeOf(time.Time{}) {
+			return apiSchema{"type": "string", "format": "date-time"}
+		}
+		if _, ok := schemas[t.Name()]; !ok {
+			// Placeholder first, for types that contain themselves
+			schemas[t.Name()] = nil
+			schemas[t.Name()] = structSchema(t, schemas)
+		}
+		return schemaRef(t.Name())
+	default:
+		return apiSchema{}
+	}
+}
+
+// Schema of the fields of a struct, the validate tags become constraints
+func structSchema(t reflect.Type, schemas map[string]interface{}) apiSchema {
+	properties := apiSchema{}
+	required := []string{}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" || field.PkgPath != "" {
+			continue
+		}
+
+		// Fields of embedded structs are written as fields of the struct
+		if field.Anonymous && name == "" {
+			embedded := structSchema(field.Type, schemas)
+			for key, value := range embedded["properties"].(apiSchema) {
+				properties[key] = value
+			}
+			if embeddedRequired, ok := embedded["required"].([]string); ok {
+				required = append(required, embeddedRequired...)
+			}
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		schema := schemaOf(field.Type, schemas)
+		if rules := field.Tag.Get("validate"); rules != "" {
+			schema = constrainSchema(schema, field.Type, rules)
+
+			// Rules after dive are of the items
+			if strings.Contains(","+strings.Split(rules, ",dive")[0]+",", ",required,") {
+				required = append(required, name)
+			}
+		}
+		properties[name] = schema
+	}
+
+	result := apiSchema{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		result["required"] = required
+	}
+	return result
+}
+
+// Adds the rules of a validate tag to the schema of a field
+func constrainSchema(schema apiSchema, t reflect.Type, rules string) apiSchema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	ruleList := strings.Split(rules, ",")
+	for ruleIndex, rule := range ruleList {
+		ruleName, argument := rule, ""
+		if i := strings.Index(rule, "="); i >= 0 {
+			ruleName, argument = rule[:i], rule[i+1:]
+		}
+
+		switch ruleName {
+		case "required":
+			if t.Kind() == reflect.String {
+				schema["minLength"] = 1
+			}
+		case "min", "max":
+			limit, _ := strconv.Atoi(argument)
+			keyword := map[reflect.Kind]string{reflect.String: "Length", reflect.Slice: "Items"}[t.Kind()]
+			if keyword == "" {
+				schema[map[string]string{"min": "minimum", "max": "maximum"}[ruleName]] = limit
+			} else {
+				schema[ruleName+keyword] = limit
+			}
+		case "email":
+			schema["format"] = "email"
+		case "url":
+			schema["format"] = "uri"
+		case "oneof":
+			schema["enum"] = strings.Fields(argument)
+		case "pattern":
+			schema["pattern"] = validationPatterns[argument].Regexp.String()
+		case "dive":
+			items := schema["items"].(apiSchema)
+			itemRules := strings.Join(ruleList[ruleIndex+1:], ",")
+			schema["items"] = constrainSchema(apiSchema{"type": items["type"]}, t.Elem(), itemRules)
+			return schema
+		}
+	}
+
+	return schema
+}
+
+// Files of Swagger UI the page loads
+var swaggerUIAssets = map[string]bool{
+	"swagger-ui.css":       true,
+	"swagger-ui-bundle.js": true,
+}
+
+// Swagger UI, its files are served by APIDocsAsset
+const swaggerUIPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="utf-8">
+	<title>Movie Rater API</title>
+	<link rel="stylesheet" href="/api/docs/swagger-ui.css">
+</head>
+<body>
+	<div id="swagger-ui"></div>
+	<script src="/api/docs/swagger-ui-bundle.js"></script>
+	<script>
+		SwaggerUIBundle({url: "/api/openapi.json", dom_id: "#swagger-ui"})
+	</script>
+</body>
+</html>
+`
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Routes registered by setupRoutes as "METHOD path", without the middleware of app.Use
+func registeredRoutes(t *testing.T) map[string]bool {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config = &Config{JWTKeys: &JWTKeys{VerificationKeys: map[string]*rsa.PublicKey{"test": &key.PublicKey}}}
+
+	app := fiber.New()
+	setupRoutes(app)
+
+	// Use adds its handlers for every method, so handlers CONNECT has, which no route uses, are middleware
+	middleware := map[uintptr]bool{}
+	for _, routes := range app.Stack() {
+		for _, route := range routes {
+			for _, handler := range route.Handlers {
+				if route.Method == fiber.MethodConnect {
+					middleware[reflect.ValueOf(handler).Pointer()] = true
+				}
+			}
+		}
+	}
+
+	result := map[string]bool{}
+	for _, routes := range app.Stack() {
+		for _, route := range routes {
+			if route.Method == fiber.MethodHead || route.Method == fiber.MethodConnect || route.Method == fiber.MethodOptions || route.Method == fiber.MethodTrace {
+				continue
+			}
+
+			for _, handler := range route.Handlers {
+				if !middleware[reflect.ValueOf(handler).Pointer()] {
+					result[route.Method+" "+route.Path] = true
+				}
+			}
+		}
+	}
+
+	return result
+}
+
+func TestOpenAPICoversRoutes(t *testing.T) {
+	routes := registeredRoutes(t)
+
+	documented := map[string]bool{}
+	for _, operation := range apiOperations {
+		for _, path := range []string{operation.Path, operation.OldPath} {
+			if path == "" {
+				continue
+			}
+
+			route := operation.Method + " " + path
+			if documented[route] {
+				t.Errorf("%s is documented twice", route)
+			}
+			documented[route] = true
+
+			if !routes[route] {
+				t.Errorf("%s is documented but not registered", route)
+			}
+		}
+	}
+
+	for route := range routes {
+		if !documented[route] {
+			t.Errorf("%s is missing from apiOperations", route)
+		}
+	}
+
+	if _, err := json.Marshal(openAPIDocument()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAPIDocsServesItsAssets(t *testing.T) {
+	app, _ := newTestApp(t)
+
+	response, _ := testRequest(t, app, "GET", "/api/docs", "", nil)
+	page, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != 200 || strings.Contains(string(page), "https://") {
+		t.Errorf("docs responded with %d and loads files from elsewhere: %s", response.StatusCode, page)
+	}
+
+	tests := []struct {
+		path        string
+		status      int
+		contentType string
+	}{
+		{"/api/docs/swagger-ui.css", 200, "text/css"},
+		{"/api/docs/swagger-ui-bundle.js", 200, "application/javascript"},
+		{"/api/docs/index.html", 404, ""},
+		{"/api/docs/..%2Fopenapi.json", 404, ""},
+	}
+
+	for _, test := range tests {
+		if test.status == 200 && !strings.Contains(string(page), `"`+test.path+`"`) {
+			t.Errorf("docs do not load %s", test.path)
+		}
+
+		response, _ := testRequest(t, app, "GET", test.path, "", nil)
+		if response.StatusCode != test.status || !strings.HasPrefix(response.Header.Get("Content-Type"), test.contentType) {
+			t.Errorf("%s responded with %d %s", test.path, response.StatusCode, response.Header.Get("Content-Type"))
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"math"
+	"net/url"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Page size used when the limit query is missing
+const defaultPageLimit = 20
+
+// Largest page size a client can ask for
+const maxPageLimit = 100
+
+// Largest page a client can ask for, so the offset of any page fits in an int
+const maxPage = math.MaxInt32 / maxPageLimit
+
+// Page is the response envelope of paginated lists
+type Page struct {
+	Data  interface{} `json:"data"`
+	Page  int         `json:"page"`
+	Limit int         `json:"limit"`
+	Total int         `json:"total"`
+	Next  string      `json:"next,omitempty"`
+	Prev  string      `json:"prev,omitempty"`
+}
+
+// Parses the page and limit queries
+func parsePagination(ctx *fiber.Ctx) (page int, limit int, err error) {
+	page, limit = 1, defaultPageLimit
+
+	if value := ctx.Query("page"); value != "" {
+		if page, err = strconv.Atoi(value); err != nil || page < 1 || page > maxPage {
+			return 0, 0, validationError("page", "page must be a number between 1 and "+strconv.Itoa(maxPage))
+		}
+	}
+
+	if value := ctx.Query("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxPageLimit {
+			return 0, 0, validationError("limit", "limit must be a number between 1 and "+strconv.Itoa(maxPageLimit))
+		}
+	}
+
+	return page, limit, nil
+}
+
+// Creates a page with links to the next and previous pages that keep the other queries
+func newPage(ctx *fiber.Ctx, data interface{}, page, limit, total int) Page {
+	result := Page{Data: data, Page: page, Limit: limit, Total: total}
+
+	link := func(page int) string {
+		query := url.Values{}
+		ctx.Context().QueryArgs().VisitAll(func(key, value []byte) {
+			query.Add(string(key), string(value))
+		})
+		query.Set("page", strconv.Itoa(page))
+		query.Set("limit", strconv.Itoa(limit))
+		return ctx.Path() + "?" + query.Encode()
+	}
+
+	if page*limit < total {
+		result.Next = link(page + 1)
+	}
+	if page > 1 {
+		result.Prev = link(page - 1)
+	}
+
+	return result
+}
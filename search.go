@@ -0,0 +1,376 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Search index of all movies, kept in sync by the movie and review handlers
+var searchIndex = newSearchIndex()
+
+// Weights of the fields a term can match in
+const (
+	titleWeight    = 3.0
+	synopsisWeight = 1.0
+)
+
+// Weights of how a query token matched a term
+const (
+	exactMatch  = 1.0
+	prefixMatch = 0.7
+	typoMatch   = 0.5
+)
+
+// Limits of a query, every token of it is matched against every indexed term
+const (
+	maxQueryBytes  = 200
+	maxQueryTokens = 10
+)
+
+// Letters folded to their ASCII form when indexing and searching
+var foldedLetters = map[rune]string{}
+
+func init() {
+	for folded, letters := range map[string]string{
+		"a": "àáâãäåāăą", "c": "çćĉċč", "d": "ďđð", "e": "èéêëēĕėęě", "g": "ĝğġģ",
+		"h": "ĥħ", "i": "ìíîïĩīĭįı", "j": "ĵ", "k": "ķ", "l": "ĺļľŀł", "n": "ñńņňŉ",
+		"o": "òóôõöøōŏő", "r": "ŕŗř", "s": "śŝşš", "t": "ţťŧ", "u": "ùúûüũūŭůűų",
+		"w": "ŵ", "y": "ýÿŷ", "z": "źżž", "ae": "æ", "oe": "œ", "ss": "ß", "th": "þ",
+	} {
+		for _, letter := range letters {
+			foldedLetters[letter] = folded
+		}
+	}
+}
+
+// Splits text into lower case, accent-free tokens
+func tokenize(text string) []string {
+	var tokens []string
+	var token strings.Builder
+
+	flush := func() {
+		if token.Len() > 0 {
+			tokens = append(tokens, token.String())
+			token.Reset()
+		}
+	}
+
+	for _, r := range strings.ToLower(text) {
+		if folded, ok := foldedLetters[r]; ok {
+			token.WriteString(folded)
+		} else if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			token.WriteRune(r)
+		} else if r != '\'' {
+			flush()
+		}
+	}
+	flush()
+
+	return tokens
+}
+
+// Typos allowed in a token, longer tokens allow more
+func allowedTypos(token string) int {
+	switch n := utf8.RuneCountInString(token); {
+	case n < 4:
+		return 0
+	case n < 8:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// Damerau-Levenshtein distance in runes of a and b, or max+1 if it is larger than max
+func editDistance(textA, textB string, max int) int {
+	a, b := []rune(textA), []rune(textB)
+	if diff := len(a) - len(b); diff > max || -diff > max {
+		return max + 1
+	}
+
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+
+			cur[j] = minInt(minInt(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				cur[j] = minInt(cur[j], prev2[j-2]+1)
+			}
+			rowMin = minInt(rowMin, cur[j])
+		}
+
+		if rowMin > max {
+			return max + 1
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Indexed movie
+type searchDoc struct {
+	movie       Movie
+	titleTokens []string
+}
+
+// SearchIndex is an in-memory inverted index of movie titles and synopses
+type SearchIndex struct {
+	mu       sync.RWMutex
+	docs     map[int]*searchDoc
+	postings map[string]map[int]float64 // Term -> movie ID -> field weight
+}
+
+// Creates an empty search index
+func newSearchIndex() *SearchIndex {
+	return &SearchIndex{
+		docs:     map[int]*searchDoc{},
+		postings: map[string]map[int]float64{},
+	}
+}
+
+// Add adds or replaces a movie
+func (index *SearchIndex) Add(movie Movie) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	index.remove(movie.ID)
+
+	doc := &searchDoc{movie: movie, titleTokens: tokenize(movie.Title)}
+	index.docs[movie.ID] = doc
+
+	addTerms := func(tokens []string, weight float64) {
+		for _, token := range tokens {
+			if index.postings[token] == nil {
+				index.postings[token] = map[int]float64{}
+			}
+			if index.postings[token][movie.ID] < weight {
+				index.postings[token][movie.ID] = weight
+			}
+		}
+	}
+	addTerms(doc.titleTokens, titleWeight)
+	addTerms(tokenize(movie.Synopsis), synopsisWeight)
+}
+
+// Remove removes a movie
+func (index *SearchIndex) Remove(movieID int) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	index.remove(movieID)
+}
+
+func (index *SearchIndex) remove(movieID int) {
+	if _, ok := index.docs[movieID]; !ok {
+		return
+	}
+
+	delete(index.docs, movieID)
+	for term, movies := range index.postings {
+		delete(movies, movieID)
+		if len(movies) == 0 {
+			delete(index.postings, term)
+		}
+	}
+}
+
+// Scores every movie matching the token, allowing typos and a prefix match if prefix is set
+func (index *SearchIndex) matchToken(token string, prefix bool) map[int]float64 {
+	scores := map[int]float64{}
+	typos := allowedTypos(token)
+
+	for term, movies := range index.postings {
+		var match float64
+		if term == token {
+			match = exactMatch
+		} else if prefix && strings.HasPrefix(term, token) {
+			match = prefixMatch
+		} else if typos > 0 && editDistance(token, term, typos) <= typos {
+			match = typoMatch
+		} else {
+			continue
+		}
+
+		for movieID, weight := range movies {
+			if score := match * weight; score > scores[movieID] {
+				scores[movieID] = score
+			}
+		}
+	}
+
+	return scores
+}
+
+// Boosts relevance by rating, trusting ratings with more raters more
+func ratingBoost(movie Movie) float64 {
+	confidence := float64(movie.RaterNum) / float64(movie.RaterNum+5)
+	return 1 + 0.1*movie.AvgRating*confidence
+}
+
+// Search finds movies matching every token of the query, the last token may be a prefix, ranked by relevance and rating
+func (index *SearchIndex) Search(query string, limit, offset int) ([]Movie, int) {
+	tokens := tokenize(query)
+	if len(tokens) == 0 {
+		return []Movie{}, 0
+	}
+
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+
+	var scores map[int]float64
+	for i, token := range tokens {
+		matches := index.matchToken(token, i == len(tokens)-1)
+		if scores == nil {
+			scores = matches
+			continue
+		}
+
+		for movieID := range scores {
+			if match, ok := matches[movieID]; ok {
+				scores[movieID] += match
+			} else {
+				delete(scores, movieID)
+			}
+		}
+	}
+
+	type result struct {
+		movie Movie
+		score float64
+	}
+	results := make([]result, 0, len(scores))
+	for movieID, score := range scores {
+		movie := index.docs[movieID].movie
+		results = append(results, result{movie: movie, score: score * ratingBoost(movie)})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if math.Abs(results[i].score-results[j].score) > 1e-9 {
+			return results[i].score > results[j].score
+		}
+		return results[i].movie.ID > results[j].movie.ID
+	})
+
+	if offset < 0 {
+		offset = 0
+	}
+
+	movies := []Movie{}
+	for i := offset; i < len(results) && i < offset+limit; i++ {
+		movies = append(movies, results[i].movie)
+	}
+
+	return movies, len(results)
+}
+
+// Suggestion struct
+type Suggestion struct {
+	ID          int    `json:"id"`
+	Title       string `json:"title"`
+	ReleaseYear int    `json:"releaseYear"`
+}
+
+// Suggest finds movies whose title has words starting with every token of the prefix, best rated first
+func (index *SearchIndex) Suggest(prefix string, limit int) []Suggestion {
+	tokens := tokenize(prefix)
+	suggestions := []Suggestion{}
+	if len(tokens) == 0 {
+		return suggestions
+	}
+
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+
+	var matches []Movie
+	for _, doc := range index.docs {
+		if titleHasPrefixes(doc.titleTokens, tokens) {
+			matches = append(matches, doc.movie)
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if boostI, boostJ := ratingBoost(matches[i]), ratingBoost(matches[j]); boostI != boostJ {
+			return boostI > boostJ
+		}
+		return matches[i].Title < matches[j].Title
+	})
+
+	for i := 0; i < len(matches) && i < limit; i++ {
+		suggestions = append(suggestions, Suggestion{ID: matches[i].ID, Title: matches[i].Title, ReleaseYear: matches[i].ReleaseYear})
+	}
+
+	return suggestions
+}
+
+// Reports whether every prefix starts some title token
+func titleHasPrefixes(titleTokens, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		found := false
+		for _, token := range titleTokens {
+			found = found || strings.HasPrefix(token, prefix)
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Loads every movie from the store into the search index
+func buildSearchIndex() error {
+	const batch = 500
+	for offset := 0; ; offset += batch {
+		movies, _, err := store.GetMovies(MovieQuery{Sort: "newest", Limit: batch, Offset: offset})
+		if err != nil {
+			return err
+		}
+
+		for _, movie := range movies {
+			searchIndex.Add(movie)
+		}
+
+		if len(movies) < batch {
+			return nil
+		}
+	}
+}
+
+// Reindexes a movie after it changed, removing it if it no longer exists
+func reindexMovie(movieID int) error {
+	movie, err := store.GetMovie(movieID)
+	if err == errNotFound {
+		searchIndex.Remove(movieID)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	searchIndex.Add(*movie)
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestEditDistanceCountsRunes(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"matrix", "matirx", 1},
+		{"матрица", "матрипа", 1},
+		{"матрица", "матрциа", 1},
+		{"東京物語", "東京物話", 1},
+	}
+
+	for _, test := range tests {
+		if got := editDistance(test.a, test.b, 2); got != test.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+
+	// Three Cyrillic letters are six bytes, too short for typos
+	if typos := allowedTypos("кот"); typos != 0 {
+		t.Errorf("got %d typos for a word of three letters", typos)
+	}
+}
+
+func TestSearchQueryLimits(t *testing.T) {
+	app, _ := newTestApp(t)
+	access, _ := registerTestUser(t, app, "alice")
+
+	tests := []struct {
+		query  string
+		status int
+	}{
+		{strings.Repeat("dune ", 10), 200},
+		{strings.Repeat("dune ", 11), 400},
+		{strings.Repeat("a", 201), 400},
+	}
+
+	for _, path := range []string{"/api/v1/movies/search", "/api/v1/movies/suggest"} {
+		for _, test := range tests {
+			response, body := testRequest(t, app, "GET", path+"?q="+url.QueryEscape(test.query), access, nil)
+			if response.StatusCode != test.status || test.status == 400 && body["code"] != "VALIDATION_FAILED" {
+				t.Errorf("%s with q of %d bytes: got %d %v, want %d", path, len(test.query), response.StatusCode, body, test.status)
+			}
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Storage instance, movie avgRating and raterNum are always derived from the reviews
+var store Store
+
+// Returned by stores when a requested row does not exist
+var errNotFound = errors.New("not found")
+
+// Returned by stores when a row would break a uniqueness rule
+var errDuplicate = errors.New("duplicate")
+
+// Returned by stores when a used or revoked refresh token, or an already used TOTP code, is presented again
+var errTokenReused = errors.New("token reused")
+
+// User ID that matches the rows of every user, IDs start at 1
+const anyUser = 0
+
+// Username shown on reviews whose author deleted their account
+const deletedUsername = "[deleted]"
+
+// Returned by stores when a user changes a row they do not own
+var errNotOwner = errors.New("not owner")
+
+// User struct
+type User struct {
+	ID       int
+	Username string
+	Email    string
+	Password string
+	Role     string
+	// Set once the user proved they own the email
+	EmailVerified bool
+	// Base32 TOTP secret, pending until TOTPEnabled is set
+	TOTPSecret  string
+	TOTPEnabled bool
+}
+
+// Roles of users, each role can do everything the roles before it can
+var roles = []string{"user", "moderator", "admin"}
+
+// Reports whether the role is at least as privileged as minRole
+func hasRole(role, minRole string) bool {
+	rank := map[string]int{}
+	for i, role := range roles {
+		rank[role] = i + 1
+	}
+
+	return rank[role] >= rank[minRole] && rank[role] > 0
+}
+
+// RefreshToken is the server-side record of an issued refresh token, tokens rotated from the same login share a family
+type RefreshToken struct {
+	ID        string // jti claim
+	FamilyID  string
+	UserID    int
+	Device    string
+	ExpiresAt time.Time
+}
+
+// StoredRefreshToken is a refresh token as the store keeps it, with whether it was used or revoked
+type StoredRefreshToken struct {
+	RefreshToken
+	Used    bool
+	Revoked bool
+}
+
+// Purposes of email tokens
+const (
+	verifyEmailPurpose   = "verify_email"
+	resetPasswordPurpose = "reset_password"
+)
+
+// EmailToken is the server-side record of a token sent by email, only its hash is stored
+type EmailToken struct {
+	Hash    string
+	UserID  int
+	Purpose string
+	// Address the token was sent to, it is only valid while the user still has it
+	Email     string
+	ExpiresAt time.Time
+}
+
+// UserIdentity is an identity at an OIDC provider linked to a user
+type UserIdentity struct {
+	Provider  string
+	Subject   string
+	UserID    int
+	CreatedAt time.Time
+}
+
+// LoginFailures counts the failed logins of an account or IP since the count last restarted
+type LoginFailures struct {
+	Count         int
+	LastFailureAt time.Time
+}
+
+// AuditEvent records a security relevant event
+type AuditEvent struct {
+	Type      string // One of the audit* event types
+	UserID    int    // anyUser if no known user is involved
+	IP        string
+	Detail    string
+	CreatedAt time.Time
+}
+
+// APIKey is a personal key a user's scripts authenticate with, only its hash is stored
+type APIKey struct {
+	ID         int
+	UserID     int
+	Name       string
+	Prefix     string // Start of the key, shown to tell keys apart
+	Hash       string
+	Scopes     []string // Some of apiKeyScopes
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+}
+
+// MovieQuery selects a page of movies
+type MovieQuery struct {
+	Sort      string // One of movieSorts
+	MinRating float64
+	MinRaters int
+	Limit     int
+	Offset    int
+}
+
+// Sort orders of movie lists
+var movieSorts = []string{"newest", "rating", "title", "most_rated"}
+
+// ReviewQuery selects a page of reviews of a movie
+type ReviewQuery struct {
+	MovieID int
+	Sort    string // One of reviewSorts
+	Rating  *int   // Only reviews with this rating when set
+	Limit   int
+	Offset  int
+}
+
+// Sort orders of review lists
+var reviewSorts = []string{"newest", "oldest", "highest", "lowest"}
+
+// Store is the persistence layer for users, movies and reviews
+type Store interface {
+	// Users
+	GetUserByID(userID int) (*User, error)
+	GetUserByEmail(email string) (*User, error)
+	UsernameExists(username string) (bool, error)
+	EmailExists(email string) (bool, error)
+	CreateUser(username, email, passwordHash string) (int, error)
+	SetUserRole(userID int, role string) error
+	SetUserPassword(userID int, passwordHash string) error
+	SetEmailVerified(userID int) error
+	// Saves the username, email and emailVerified of the user
+	UpdateUser(user *User) error
+	// Gets the user an external identity is linked to
+	GetUserByIdentity(provider, subject string) (*User, error)
+	// Links an external identity to the user, an identity already linked gives errDuplicate
+	LinkIdentity(userID int, provider, subject string) error
+	// Gets the identities linked to the user, oldest first
+	GetUserIdentities(userID int) ([]UserIdentity, error)
+	// Stores a pending TOTP secret, 2FA stays off until EnableTOTP
+	SetTOTPSecret(userID int, secret string) error
+	// Turns 2FA on and replaces the recovery codes
+	EnableTOTP(userID int, recoveryCodeHashes []string) error
+	DisableTOTP(userID int) error
+	// Records the time step of a used TOTP code, a step not after the last used one gives errTokenReused
+	UseTOTPStep(userID int, step int64) error
+	// Uses up an unused recovery code of the user
+	UseRecoveryCode(userID int, hash string) error
+	// Deletes the user and their tokens, their reviews are kept without an author if keepReviews is set, returns the movies whose rating changed
+	DeleteUser(userID int, keepReviews bool) (changedMovies []int, err error)
+
+	// Email tokens
+	CreateEmailToken(token EmailToken) error
+	// Uses up an unexpired token of the purpose together with every other token of the user for the purpose
+	UseEmailToken(hash, purpose string) (*EmailToken, error)
+	// Uses up every outstanding token of the user, whatever the purpose
+	RevokeUserEmailTokens(userID int) error
+
+	// Refresh tokens
+	CreateRefreshToken(token RefreshToken) error
+	// Marks an unexpired token as used, a token that was already used or revoked revokes its family and gives errTokenReused
+	UseRefreshToken(tokenID string) (*RefreshToken, error)
+	RevokeRefreshTokenFamily(tokenID string) error
+	RevokeUserRefreshTokens(userID int) error
+	// Gets every refresh token of the user, also used and revoked ones, oldest first
+	GetUserRefreshTokens(userID int) ([]StoredRefreshToken, error)
+
+	// Login throttling, keys name the account or IP failures are counted for
+	GetLoginFailures(key string) (LoginFailures, error)
+	// Counts a failure and returns the new count, the count restarts if the last failure is older than resetAfter
+	AddLoginFailure(key string, resetAfter time.Duration) (LoginFailures, error)
+	ClearLoginFailures(key string) error
+
+	// Audit log
+	CreateAuditEvent(event AuditEvent) error
+	// Gets the events about the user, oldest first
+	GetUserAuditEvents(userID int) ([]AuditEvent, error)
+
+	// API keys
+	CreateAPIKey(key APIKey) (int, error)
+	GetAPIKeyByHash(hash string) (*APIKey, error)
+	// Gets the keys of the user, oldest first
+	GetUserAPIKeys(userID int) ([]APIKey, error)
+	// Deletes a key of the user, keys of other users give errNotFound
+	DeleteAPIKey(keyID, userID int) error
+	SetAPIKeyLastUsed(keyID int, usedAt time.Time) error
+
+	// Movies
+	GetMovies(query MovieQuery) (movies []Movie, total int, err error)
+	GetMovie(movieID int) (*Movie, error)
+	CreateMovie(movie NewMovie) (int, error)
+	UpdateMovie(movieID int, movie NewMovie) error
+	DeleteMovie(movieID int) error
+	RecomputeRatings() error
+
+	// Reviews
+	GetReviews(query ReviewQuery) (reviews []Review, total int, err error)
+	GetReview(reviewID int) (*Review, error)
+	// Gets every review of the user, oldest first
+	GetUserReviews(userID int) ([]UserReview, error)
+	// A user has at most one review per movie, an existing one is replaced if replace is set, otherwise errDuplicate is returned
+	CreateReview(movieID, userID, rating int, comment string, replace bool) (reviewID int, replaced bool, err error)
+	UpdateReview(reviewID, userID, rating int, comment string) error
+	DeleteReview(reviewID, userID int) error
+	// Deletes a review of any user, for moderation
+	RemoveReview(reviewID int) error
+
+	Close() error
+}
+
+// Opens the store selected by the config
+func openStore(cfg *Config) (Store, error) {
+	switch cfg.DatabaseDriver {
+	case "mysql":
+		return openMySQLStore(cfg.DatabaseDSN)
+	case "memory":
+		return newMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown database driver %q", cfg.DatabaseDriver)
+	}
+}
@@ -0,0 +1,1075 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps data in memory, it is lost when the app stops
+type MemoryStore struct {
+	mu      sync.RWMutex
+	users   []User
+	movies  []memoryMovie
+	reviews []memoryReview
+	tokens  map[string]*StoredRefreshToken
+	// Email tokens by hash, removed once used
+	emailTokens map[string]EmailToken
+	// User IDs by provider and subject of their external identities
+	identities map[[2]string]UserIdentity
+	// TOTP steps last used and unused recovery code hashes by user ID
+	totpSteps     map[int]int64
+	recoveryCodes map[int][]string
+	// Login failures by key
+	loginFailures map[string]LoginFailures
+	auditEvents   []AuditEvent
+	apiKeys       []APIKey
+
+	// Last assigned IDs, like AUTO_INCREMENT
+	lastUserID   int
+	lastMovieID  int
+	lastReviewID int
+	lastAPIKeyID int
+}
+
+// Movie row kept by MemoryStore
+type memoryMovie struct {
+	ID int
+	NewMovie
+	AvgRating float64
+	RaterNum  int
+}
+
+// Converts the row to a Movie
+func (movie memoryMovie) toMovie() Movie {
+	genres := append([]string{}, movie.Genres...)
+	sort.Strings(genres)
+
+	return Movie{
+		ID:               movie.ID,
+		Title:            movie.Title,
+		ReleaseYear:      movie.ReleaseYear,
+		Runtime:          movie.Runtime,
+		Synopsis:         movie.Synopsis,
+		OriginalLanguage: movie.OriginalLanguage,
+		Genres:           genres,
+		PosterURL:        movie.PosterURL,
+		IMDbID:           movie.IMDbID,
+		TMDbID:           movie.TMDbID,
+		AvgRating:        movie.AvgRating,
+		RaterNum:         movie.RaterNum,
+	}
+}
+
+// Review row kept by MemoryStore
+type memoryReview struct {
+	ID        int
+	Rating    int
+	Comment   string
+	MovieID   int
+	UserID    int // anyUser once the author deleted their account
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Creates an empty in-memory store
+func newMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		tokens:        map[string]*StoredRefreshToken{},
+		emailTokens:   map[string]EmailToken{},
+		loginFailures: map[string]LoginFailures{},
+		identities:    map[[2]string]UserIdentity{},
+		totpSteps:     map[int]int64{},
+		recoveryCodes: map[int][]string{},
+	}
+}
+
+// Close does nothing
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// Returns the index of the movie, or -1 if it does not exist
+func (s *MemoryStore) movieIndex(movieID int) int {
+	for i := range s.movies {
+		if s.movies[i].ID == movieID {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Returns the index of the review, or -1 if it does not exist
+func (s *MemoryStore) reviewIndex(reviewID int) int {
+	for i := range s.reviews {
+		if s.reviews[i].ID == reviewID {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Returns the user with the ID, or nil if it does not exist
+func (s *MemoryStore) userByID(userID int) *User {
+	for i := range s.users {
+		if s.users[i].ID == userID {
+			return &s.users[i]
+		}
+	}
+
+	return nil
+}
+
+// GetUserByID gets a user by ID
+func (s *MemoryStore) GetUserByID(userID int) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user := s.userByID(userID)
+	if user == nil {
+		return nil, errNotFound
+	}
+
+	result := *user
+	return &result, nil
+}
+
+// GetUserByEmail gets a user by email
+func (s *MemoryStore) GetUserByEmail(email string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, user := range s.users {
+		if user.Email == email {
+			return &user, nil
+		}
+	}
+
+	return nil, errNotFound
+}
+
+// UsernameExists checks if the username is taken
+func (s *MemoryStore) UsernameExists(username string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, user := range s.users {
+		if user.Username == username {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// EmailExists checks if the email has been used
+func (s *MemoryStore) EmailExists(email string) (bool, error) {
+	_, err := s.GetUserByEmail(email)
+	if err == errNotFound {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// CreateUser inserts a new user and returns its ID
+func (s *MemoryStore) CreateUser(username, email, passwordHash string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastUserID++
+	id := s.lastUserID
+	s.users = append(s.users, User{ID: id, Username: username, Email: email, Password: passwordHash, Role: "user"})
+	return id, nil
+}
+
+// SetUserRole changes the role of a user
+func (s *MemoryStore) SetUserRole(userID int, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user := s.userByID(userID)
+	if user == nil {
+		return errNotFound
+	}
+
+	user.Role = role
+	return nil
+}
+
+// SetUserPassword changes the password hash of a user
+func (s *MemoryStore) SetUserPassword(userID int, passwordHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user := s.userByID(userID)
+	if user == nil {
+		return errNotFound
+	}
+
+	user.Password = passwordHash
+	return nil
+}
+
+// SetEmailVerified marks the email of a user as verified
+func (s *MemoryStore) SetEmailVerified(userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user := s.userByID(userID)
+	if user == nil {
+		return errNotFound
+	}
+
+	user.EmailVerified = true
+	return nil
+}
+
+// UpdateUser saves the username, email and emailVerified of the user
+func (s *MemoryStore) UpdateUser(user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := s.userByID(user.ID)
+	if stored == nil {
+		return errNotFound
+	}
+
+	stored.Username = user.Username
+	stored.Email = user.Email
+	stored.EmailVerified = user.EmailVerified
+	return nil
+}
+
+// GetUserByIdentity gets the user an external identity is linked to
+func (s *MemoryStore) GetUserByIdentity(provider, subject string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user := s.userByID(s.identities[[2]string{provider, subject}].UserID)
+	if user == nil {
+		return nil, errNotFound
+	}
+
+	result := *user
+	return &result, nil
+}
+
+// LinkIdentity links an external identity to the user
+func (s *MemoryStore) LinkIdentity(userID int, provider, subject string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.userByID(userID) == nil {
+		return errNotFound
+	}
+
+	key := [2]string{provider, subject}
+	if _, ok := s.identities[key]; ok {
+		return errDuplicate
+	}
+
+	s.identities[key] = UserIdentity{Provider: provider, Subject: subject, UserID: userID, CreatedAt: time.Now().UTC()}
+	return nil
+}
+
+// GetUserIdentities gets the identities linked to the user, oldest first
+func (s *MemoryStore) GetUserIdentities(userID int) ([]UserIdentity, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	identities := []UserIdentity{}
+	for _, identity := range s.identities {
+		if identity.UserID == userID {
+			identities = append(identities, identity)
+		}
+	}
+
+	sort.Slice(identities, func(i, j int) bool {
+		return identities[i].CreatedAt.Before(identities[j].CreatedAt)
+	})
+	return identities, nil
+}
+
+// SetTOTPSecret stores a pending TOTP secret of the user
+func (s *MemoryStore) SetTOTPSecret(userID int, secret string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user := s.userByID(userID)
+	if user == nil {
+		return errNotFound
+	}
+
+	user.TOTPSecret = secret
+	user.TOTPEnabled = false
+	return nil
+}
+
+// EnableTOTP turns 2FA on and replaces the recovery codes
+func (s *MemoryStore) EnableTOTP(userID int, recoveryCodeHashes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user := s.userByID(userID)
+	if user == nil {
+		return errNotFound
+	}
+
+	user.TOTPEnabled = true
+	s.recoveryCodes[userID] = append([]string{}, recoveryCodeHashes...)
+	return nil
+}
+
+// DisableTOTP turns 2FA off and drops the secret and recovery codes
+func (s *MemoryStore) DisableTOTP(userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user := s.userByID(userID)
+	if user == nil {
+		return errNotFound
+	}
+
+	user.TOTPSecret = ""
+	user.TOTPEnabled = false
+	delete(s.recoveryCodes, userID)
+	return nil
+}
+
+// UseTOTPStep records the time step of a used TOTP code, steps cannot be used twice
+func (s *MemoryStore) UseTOTPStep(userID int, step int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if step <= s.totpSteps[userID] {
+		return errTokenReused
+	}
+
+	s.totpSteps[userID] = step
+	return nil
+}
+
+// UseRecoveryCode uses up an unused recovery code of the user
+func (s *MemoryStore) UseRecoveryCode(userID int, hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	codes := s.recoveryCodes[userID]
+	for i, code := range codes {
+		if code == hash {
+			s.recoveryCodes[userID] = append(codes[:i], codes[i+1:]...)
+			return nil
+		}
+	}
+
+	return errNotFound
+}
+
+// DeleteUser deletes the user and their tokens, their reviews are kept without an author or deleted
+func (s *MemoryStore) DeleteUser(userID int, keepReviews bool) ([]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user := s.userByID(userID)
+	if user == nil {
+		return nil, errNotFound
+	}
+
+	changedMovies := []int{}
+	reviews := s.reviews[:0]
+	for _, review := range s.reviews {
+		if review.UserID == userID {
+			if keepReviews {
+				review.UserID = anyUser
+			} else {
+				changedMovies = append(changedMovies, review.MovieID)
+				continue
+			}
+		}
+		reviews = append(reviews, review)
+	}
+	s.reviews = reviews
+
+	for _, movieID := range changedMovies {
+		s.updateMovieRating(s.movieIndex(movieID))
+	}
+
+	for id, token := range s.tokens {
+		if token.UserID == userID {
+			delete(s.tokens, id)
+		}
+	}
+	for hash, token := range s.emailTokens {
+		if token.UserID == userID {
+			delete(s.emailTokens, hash)
+		}
+	}
+	delete(s.totpSteps, userID)
+	delete(s.recoveryCodes, userID)
+	apiKeys := []APIKey{}
+	for _, key := range s.apiKeys {
+		if key.UserID != userID {
+			apiKeys = append(apiKeys, key)
+		}
+	}
+	s.apiKeys = apiKeys
+	for key, identity := range s.identities {
+		if identity.UserID == userID {
+			delete(s.identities, key)
+		}
+	}
+
+	for i := range s.users {
+		if s.users[i].ID == userID {
+			s.users = append(s.users[:i], s.users[i+1:]...)
+			break
+		}
+	}
+
+	return changedMovies, nil
+}
+
+// CreateEmailToken records a token sent by email
+func (s *MemoryStore) CreateEmailToken(token EmailToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.emailTokens[token.Hash] = token
+	return nil
+}
+
+// UseEmailToken uses up an unexpired token and every other token of the user for the purpose
+func (s *MemoryStore) UseEmailToken(hash, purpose string) (*EmailToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.emailTokens[hash]
+	if !ok || token.Purpose != purpose || token.ExpiresAt.Before(time.Now()) {
+		return nil, errNotFound
+	}
+
+	for otherHash, other := range s.emailTokens {
+		if other.UserID == token.UserID && other.Purpose == purpose {
+			delete(s.emailTokens, otherHash)
+		}
+	}
+
+	return &token, nil
+}
+
+// RevokeUserEmailTokens uses up every outstanding token of the user
+func (s *MemoryStore) RevokeUserEmailTokens(userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for hash, token := range s.emailTokens {
+		if token.UserID == userID {
+			delete(s.emailTokens, hash)
+		}
+	}
+	return nil
+}
+
+// CreateRefreshToken records an issued refresh token
+func (s *MemoryStore) CreateRefreshToken(token RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tokens[token.ID] = &StoredRefreshToken{RefreshToken: token}
+	return nil
+}
+
+// UseRefreshToken marks an unexpired refresh token as used, reuse revokes its family
+func (s *MemoryStore) UseRefreshToken(tokenID string) (*RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.tokens[tokenID]
+	if !ok {
+		return nil, errNotFound
+	}
+
+	if token.Used || token.Revoked {
+		s.revokeTokens(func(other *StoredRefreshToken) bool { return other.FamilyID == token.FamilyID })
+		return nil, errTokenReused
+	}
+
+	if token.ExpiresAt.Before(time.Now()) {
+		return nil, errNotFound
+	}
+
+	token.Used = true
+	result := token.RefreshToken
+	return &result, nil
+}
+
+// Revokes the refresh tokens matching the filter, returns how many were revoked
+func (s *MemoryStore) revokeTokens(filter func(*StoredRefreshToken) bool) int {
+	revoked := 0
+	for _, token := range s.tokens {
+		if !token.Revoked && filter(token) {
+			token.Revoked = true
+			revoked++
+		}
+	}
+
+	return revoked
+}
+
+// RevokeRefreshTokenFamily revokes every token of the family the token belongs to
+func (s *MemoryStore) RevokeRefreshTokenFamily(tokenID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.tokens[tokenID]
+	if !ok {
+		return errNotFound
+	}
+
+	if s.revokeTokens(func(other *StoredRefreshToken) bool { return other.FamilyID == token.FamilyID }) == 0 {
+		return errNotFound
+	}
+
+	return nil
+}
+
+// RevokeUserRefreshTokens revokes every refresh token of the user
+func (s *MemoryStore) RevokeUserRefreshTokens(userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.revokeTokens(func(token *StoredRefreshToken) bool { return token.UserID == userID })
+	return nil
+}
+
+// GetUserRefreshTokens gets every refresh token of the user, oldest first
+func (s *MemoryStore) GetUserRefreshTokens(userID int) ([]StoredRefreshToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tokens := []StoredRefreshToken{}
+	for _, token := range s.tokens {
+		if token.UserID == userID {
+			tokens = append(tokens, *token)
+		}
+	}
+
+	// Every token lives as long, so the first to expire was issued first
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].ExpiresAt.Before(tokens[j].ExpiresAt)
+	})
+	return tokens, nil
+}
+
+// GetLoginFailures gets the failed logins counted for the key
+func (s *MemoryStore) GetLoginFailures(key string) (LoginFailures, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.loginFailures[key], nil
+}
+
+// AddLoginFailure counts a failed login for the key, counts older than resetAfter restart and are dropped
+func (s *MemoryStore) AddLoginFailure(key string, resetAfter time.Duration) (LoginFailures, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for other, failures := range s.loginFailures {
+		if now.Sub(failures.LastFailureAt) > resetAfter {
+			delete(s.loginFailures, other)
+		}
+	}
+
+	failures := s.loginFailures[key]
+	failures.Count++
+	failures.LastFailureAt = now
+	s.loginFailures[key] = failures
+	return failures, nil
+}
+
+// ClearLoginFailures forgets the failed logins of the key
+func (s *MemoryStore) ClearLoginFailures(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.loginFailures, key)
+	return nil
+}
+
+// CreateAuditEvent records an audit event
+func (s *MemoryStore) CreateAuditEvent(event AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.auditEvents = append(s.auditEvents, event)
+	return nil
+}
+
+// GetUserAuditEvents gets the events about the user, oldest first
+func (s *MemoryStore) GetUserAuditEvents(userID int) ([]AuditEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	events := []AuditEvent{}
+	for _, event := range s.auditEvents {
+		if event.UserID == userID {
+			events = append(events, event)
+		}
+	}
+
+	return events, nil
+}
+
+// Copies the key so callers cannot change the stored one
+func copyAPIKey(key APIKey) *APIKey {
+	key.Scopes = append([]string{}, key.Scopes...)
+	if key.LastUsedAt != nil {
+		lastUsedAt := *key.LastUsedAt
+		key.LastUsedAt = &lastUsedAt
+	}
+
+	return &key
+}
+
+// CreateAPIKey stores a new API key
+func (s *MemoryStore) CreateAPIKey(key APIKey) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.userByID(key.UserID) == nil {
+		return 0, errNotFound
+	}
+	for _, other := range s.apiKeys {
+		if other.Hash == key.Hash {
+			return 0, errDuplicate
+		}
+	}
+
+	s.lastAPIKeyID++
+	key.ID = s.lastAPIKeyID
+	s.apiKeys = append(s.apiKeys, *copyAPIKey(key))
+	return key.ID, nil
+}
+
+// GetAPIKeyByHash gets an API key by the hash of the key
+func (s *MemoryStore) GetAPIKeyByHash(hash string) (*APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, key := range s.apiKeys {
+		if key.Hash == hash {
+			return copyAPIKey(key), nil
+		}
+	}
+
+	return nil, errNotFound
+}
+
+// GetUserAPIKeys gets the API keys of the user, oldest first
+func (s *MemoryStore) GetUserAPIKeys(userID int) ([]APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := []APIKey{}
+	for _, key := range s.apiKeys {
+		if key.UserID == userID {
+			keys = append(keys, *copyAPIKey(key))
+		}
+	}
+
+	return keys, nil
+}
+
+// DeleteAPIKey deletes an API key of the user
+func (s *MemoryStore) DeleteAPIKey(keyID, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, key := range s.apiKeys {
+		if key.ID == keyID && key.UserID == userID {
+			s.apiKeys = append(s.apiKeys[:i], s.apiKeys[i+1:]...)
+			return nil
+		}
+	}
+
+	return errNotFound
+}
+
+// SetAPIKeyLastUsed records when an API key was last used
+func (s *MemoryStore) SetAPIKeyLastUsed(keyID int, usedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.apiKeys {
+		if s.apiKeys[i].ID == keyID {
+			s.apiKeys[i].LastUsedAt = &usedAt
+			return nil
+		}
+	}
+
+	return errNotFound
+}
+
+// Reports whether movie a comes before movie b in the sort order
+func memoryMovieLess(order string, a, b memoryMovie) bool {
+	switch order {
+	case "rating":
+		if a.AvgRating != b.AvgRating {
+			return a.AvgRating > b.AvgRating
+		}
+		if a.RaterNum != b.RaterNum {
+			return a.RaterNum > b.RaterNum
+		}
+	case "title":
+		if a.Title != b.Title {
+			return a.Title < b.Title
+		}
+		return a.ID < b.ID
+	case "most_rated":
+		if a.RaterNum != b.RaterNum {
+			return a.RaterNum > b.RaterNum
+		}
+		if a.AvgRating != b.AvgRating {
+			return a.AvgRating > b.AvgRating
+		}
+	}
+
+	return a.ID > b.ID
+}
+
+// GetMovies gets a page of movies and the number of movies matching the filters
+func (s *MemoryStore) GetMovies(query MovieQuery) ([]Movie, int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var matches []memoryMovie
+	for _, movie := range s.movies {
+		if movie.AvgRating >= query.MinRating && movie.RaterNum >= query.MinRaters {
+			matches = append(matches, movie)
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return memoryMovieLess(query.Sort, matches[i], matches[j])
+	})
+
+	if query.Offset < 0 {
+		query.Offset = 0
+	}
+
+	movies := []Movie{}
+	for i := query.Offset; i < len(matches) && i < query.Offset+query.Limit; i++ {
+		movies = append(movies, matches[i].toMovie())
+	}
+
+	return movies, len(matches), nil
+}
+
+// CreateMovie inserts a new movie and returns its ID
+func (s *MemoryStore) CreateMovie(movie NewMovie) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastMovieID++
+	id := s.lastMovieID
+	movie.Genres = append([]string{}, movie.Genres...)
+	s.movies = append(s.movies, memoryMovie{ID: id, NewMovie: movie})
+	return id, nil
+}
+
+// GetMovie gets a movie by ID
+func (s *MemoryStore) GetMovie(movieID int) (*Movie, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	i := s.movieIndex(movieID)
+	if i < 0 {
+		return nil, errNotFound
+	}
+
+	movie := s.movies[i].toMovie()
+	return &movie, nil
+}
+
+// UpdateMovie changes a movie
+func (s *MemoryStore) UpdateMovie(movieID int, movie NewMovie) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.movieIndex(movieID)
+	if i < 0 {
+		return errNotFound
+	}
+
+	movie.Genres = append([]string{}, movie.Genres...)
+	s.movies[i].NewMovie = movie
+	return nil
+}
+
+// DeleteMovie deletes a movie and its reviews
+func (s *MemoryStore) DeleteMovie(movieID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.movieIndex(movieID)
+	if i < 0 {
+		return errNotFound
+	}
+
+	s.movies = append(s.movies[:i], s.movies[i+1:]...)
+
+	reviews := s.reviews[:0]
+	for _, review := range s.reviews {
+		if review.MovieID != movieID {
+			reviews = append(reviews, review)
+		}
+	}
+	s.reviews = reviews
+
+	return nil
+}
+
+// Sets avgRating and raterNum of the movie at index i from its reviews
+func (s *MemoryStore) updateMovieRating(i int) {
+	sum, count := 0, 0
+	for _, review := range s.reviews {
+		if review.MovieID == s.movies[i].ID {
+			sum += review.Rating
+			count++
+		}
+	}
+
+	s.movies[i].RaterNum = count
+	s.movies[i].AvgRating = 0
+	if count > 0 {
+		s.movies[i].AvgRating = math.Round(float64(sum)/float64(count)*10) / 10
+	}
+}
+
+// RecomputeRatings rebuilds avgRating and raterNum of every movie from the reviews
+func (s *MemoryStore) RecomputeRatings() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.movies {
+		s.updateMovieRating(i)
+	}
+
+	return nil
+}
+
+// Converts the row to a Review, returns false if the author does not exist
+func (s *MemoryStore) toReview(review memoryReview) (Review, bool) {
+	username := deletedUsername
+	if review.UserID != anyUser {
+		user := s.userByID(review.UserID)
+		if user == nil {
+			return Review{}, false
+		}
+		username = user.Username
+	}
+
+	return Review{
+		ID:        review.ID,
+		MovieID:   review.MovieID,
+		Rating:    review.Rating,
+		Comment:   review.Comment,
+		Username:  username,
+		CreatedAt: review.CreatedAt,
+		UpdatedAt: review.UpdatedAt,
+	}, true
+}
+
+// Reports whether review a comes before review b in the sort order
+func memoryReviewLess(order string, a, b memoryReview) bool {
+	switch order {
+	case "oldest":
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+		return a.ID < b.ID
+	case "highest":
+		if a.Rating != b.Rating {
+			return a.Rating > b.Rating
+		}
+	case "lowest":
+		if a.Rating != b.Rating {
+			return a.Rating < b.Rating
+		}
+	}
+
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.After(b.CreatedAt)
+	}
+	return a.ID > b.ID
+}
+
+// GetReviews gets a page of reviews of a movie and the number of reviews matching the filters
+func (s *MemoryStore) GetReviews(query ReviewQuery) ([]Review, int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var matches []memoryReview
+	for _, review := range s.reviews {
+		if review.MovieID == query.MovieID && (query.Rating == nil || review.Rating == *query.Rating) {
+			matches = append(matches, review)
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return memoryReviewLess(query.Sort, matches[i], matches[j])
+	})
+
+	if query.Offset < 0 {
+		query.Offset = 0
+	}
+
+	reviews := []Review{}
+	for i := query.Offset; i < len(matches) && i < query.Offset+query.Limit; i++ {
+		if review, ok := s.toReview(matches[i]); ok {
+			reviews = append(reviews, review)
+		}
+	}
+
+	return reviews, len(matches), nil
+}
+
+// CreateReview inserts or replaces the review of the user and updates the movie rating
+func (s *MemoryStore) CreateReview(movieID, userID, rating int, comment string, replace bool) (int, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.movieIndex(movieID)
+	if i < 0 || s.userByID(userID) == nil {
+		return 0, false, errNotFound
+	}
+
+	// Check for an existing review of the user
+	for j := range s.reviews {
+		if s.reviews[j].MovieID != movieID || s.reviews[j].UserID != userID {
+			continue
+		}
+
+		if !replace {
+			return 0, false, errDuplicate
+		}
+
+		s.reviews[j].Rating = rating
+		s.reviews[j].Comment = comment
+		s.reviews[j].UpdatedAt = time.Now().UTC()
+		s.updateMovieRating(i)
+		return s.reviews[j].ID, true, nil
+	}
+
+	s.lastReviewID++
+	id := s.lastReviewID
+	now := time.Now().UTC()
+	s.reviews = append(s.reviews, memoryReview{ID: id, Rating: rating, Comment: comment, MovieID: movieID, UserID: userID, CreatedAt: now, UpdatedAt: now})
+	s.updateMovieRating(i)
+	return id, false, nil
+}
+
+// GetReview gets a review by ID
+func (s *MemoryStore) GetReview(reviewID int) (*Review, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	i := s.reviewIndex(reviewID)
+	if i < 0 {
+		return nil, errNotFound
+	}
+
+	review, ok := s.toReview(s.reviews[i])
+	if !ok {
+		return nil, errNotFound
+	}
+
+	return &review, nil
+}
+
+// GetUserReviews gets every review of the user, oldest first
+func (s *MemoryStore) GetUserReviews(userID int) ([]UserReview, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var matches []memoryReview
+	for _, review := range s.reviews {
+		if review.UserID == userID {
+			matches = append(matches, review)
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return memoryReviewLess("oldest", matches[i], matches[j])
+	})
+
+	reviews := []UserReview{}
+	for _, match := range matches {
+		review, ok := s.toReview(match)
+		i := s.movieIndex(match.MovieID)
+		if !ok || i < 0 {
+			continue
+		}
+
+		reviews = append(reviews, UserReview{Review: review, MovieTitle: s.movies[i].Title})
+	}
+
+	return reviews, nil
+}
+
+// Returns the index of a review of the user, or of any user if userID is anyUser
+func (s *MemoryStore) ownReviewIndex(reviewID, userID int) (int, error) {
+	i := s.reviewIndex(reviewID)
+	if i < 0 {
+		return -1, errNotFound
+	}
+
+	if userID != anyUser && s.reviews[i].UserID != userID {
+		return -1, errNotOwner
+	}
+
+	return i, nil
+}
+
+// UpdateReview changes a review of the user and updates the movie rating
+func (s *MemoryStore) UpdateReview(reviewID, userID, rating int, comment string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, err := s.ownReviewIndex(reviewID, userID)
+	if err != nil {
+		return err
+	}
+
+	s.reviews[i].Rating = rating
+	s.reviews[i].Comment = comment
+	s.reviews[i].UpdatedAt = time.Now().UTC()
+	s.updateMovieRating(s.movieIndex(s.reviews[i].MovieID))
+	return nil
+}
+
+// RemoveReview deletes a review of any user and updates the movie rating
+func (s *MemoryStore) RemoveReview(reviewID int) error {
+	return s.DeleteReview(reviewID, anyUser)
+}
+
+// DeleteReview deletes a review of the user and updates the movie rating
+func (s *MemoryStore) DeleteReview(reviewID, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, err := s.ownReviewIndex(reviewID, userID)
+	if err != nil {
+		return err
+	}
+
+	movieID := s.reviews[i].MovieID
+	s.reviews = append(s.reviews[:i], s.reviews[i+1:]...)
+	s.updateMovieRating(s.movieIndex(movieID))
+	return nil
+}
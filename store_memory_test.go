@@ -0,0 +1,529 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Memory store with two users and a movie
+func newTestStore(t *testing.T) (s *MemoryStore, users [2]int, movieID int) {
+	t.Helper()
+
+	s = newMemoryStore()
+	for i, name := range []string{"alice", "bob"} {
+		id, err := s.CreateUser(name, name+"@example.com", "hash")
+		if err != nil {
+			t.Fatal(err)
+		}
+		users[i] = id
+	}
+
+	movieID, err := s.CreateMovie(NewMovie{Title: "Dune", ReleaseYear: 1984, Genres: []string{"sci-fi"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s, users, movieID
+}
+
+func TestMemoryStoreNotFound(t *testing.T) {
+	s, users, movieID := newTestStore(t)
+	reviewID, _, err := s.CreateReview(movieID, users[0], 3, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const unknown = 99
+	tests := []struct {
+		name string
+		call func() error
+		want error
+	}{
+		{"GetUserByID", func() error { _, err := s.GetUserByID(unknown); return err }, errNotFound},
+		{"GetUserByEmail", func() error { _, err := s.GetUserByEmail("nobody@example.com"); return err }, errNotFound},
+		{"GetUserByIdentity", func() error { _, err := s.GetUserByIdentity("mock", "1"); return err }, errNotFound},
+		{"SetUserRole", func() error { return s.SetUserRole(unknown, "admin") }, errNotFound},
+		{"SetUserPassword", func() error { return s.SetUserPassword(unknown, "hash") }, errNotFound},
+		{"SetEmailVerified", func() error { return s.SetEmailVerified(unknown) }, errNotFound},
+		{"UpdateUser", func() error { return s.UpdateUser(&User{ID: unknown}) }, errNotFound},
+		{"LinkIdentity", func() error { return s.LinkIdentity(unknown, "mock", "1") }, errNotFound},
+		{"SetTOTPSecret", func() error { return s.SetTOTPSecret(unknown, "secret") }, errNotFound},
+		{"EnableTOTP", func() error { return s.EnableTOTP(unknown, nil) }, errNotFound},
+		{"DisableTOTP", func() error { return s.DisableTOTP(unknown) }, errNotFound},
+		{"DeleteUser", func() error { _, err := s.DeleteUser(unknown, true); return err }, errNotFound},
+		{"UseEmailToken", func() error { _, err := s.UseEmailToken("hash", verifyEmailPurpose); return err }, errNotFound},
+		{"UseRefreshToken", func() error { _, err := s.UseRefreshToken("id"); return err }, errNotFound},
+		{"RevokeRefreshTokenFamily", func() error { return s.RevokeRefreshTokenFamily("id") }, errNotFound},
+		{"GetAPIKeyByHash", func() error { _, err := s.GetAPIKeyByHash("hash"); return err }, errNotFound},
+		{"DeleteAPIKey", func() error { return s.DeleteAPIKey(unknown, users[0]) }, errNotFound},
+		{"GetMovie", func() error { _, err := s.GetMovie(unknown); return err }, errNotFound},
+		{"UpdateMovie", func() error { return s.UpdateMovie(unknown, NewMovie{Title: "Dune"}) }, errNotFound},
+		{"DeleteMovie", func() error { return s.DeleteMovie(unknown) }, errNotFound},
+		{"GetReview", func() error { _, err := s.GetReview(unknown); return err }, errNotFound},
+		{"CreateReview of unknown movie", func() error { _, _, err := s.CreateReview(unknown, users[0], 3, "", false); return err }, errNotFound},
+		{"CreateReview by unknown user", func() error { _, _, err := s.CreateReview(movieID, unknown, 3, "", false); return err }, errNotFound},
+		{"CreateReview twice", func() error { _, _, err := s.CreateReview(movieID, users[0], 4, "", false); return err }, errDuplicate},
+		{"UpdateReview", func() error { return s.UpdateReview(unknown, users[0], 3, "") }, errNotFound},
+		{"UpdateReview of another user", func() error { return s.UpdateReview(reviewID, users[1], 3, "") }, errNotOwner},
+		{"DeleteReview", func() error { return s.DeleteReview(unknown, users[0]) }, errNotFound},
+		{"DeleteReview of another user", func() error { return s.DeleteReview(reviewID, users[1]) }, errNotOwner},
+		{"RemoveReview", func() error { return s.RemoveReview(unknown) }, errNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.call(); err != test.want {
+				t.Errorf("got %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreUsers(t *testing.T) {
+	s, users, _ := newTestStore(t)
+
+	user, err := s.GetUserByEmail("alice@example.com")
+	if err != nil || user.ID != users[0] || user.Username != "alice" || user.Role != "user" || user.EmailVerified {
+		t.Fatalf("got %+v %v", user, err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		exists func() (bool, error)
+		want   bool
+	}{
+		{"taken username", func() (bool, error) { return s.UsernameExists("alice") }, true},
+		{"free username", func() (bool, error) { return s.UsernameExists("carol") }, false},
+		{"taken email", func() (bool, error) { return s.EmailExists("bob@example.com") }, true},
+		{"free email", func() (bool, error) { return s.EmailExists("carol@example.com") }, false},
+	} {
+		if exists, err := test.exists(); err != nil || exists != test.want {
+			t.Errorf("%s: got %v %v, want %v", test.name, exists, err, test.want)
+		}
+	}
+
+	// Users are returned as copies, changes only stick through the store
+	user.Username = "changed"
+	if again, _ := s.GetUserByID(users[0]); again.Username != "alice" {
+		t.Errorf("changing a returned user changed the store")
+	}
+
+	user.Email = "alice@example.org"
+	user.EmailVerified = true
+	if err = s.UpdateUser(user); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SetUserRole(users[0], "moderator"); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := s.GetUserByID(users[0]); again.Username != "changed" || again.Email != "alice@example.org" || !again.EmailVerified || again.Role != "moderator" {
+		t.Errorf("got %+v after update", again)
+	}
+
+	if err = s.LinkIdentity(users[0], "mock", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.LinkIdentity(users[1], "mock", "1"); err != errDuplicate {
+		t.Errorf("linking a linked identity again gave %v", err)
+	}
+	if linked, err := s.GetUserByIdentity("mock", "1"); err != nil || linked.ID != users[0] {
+		t.Errorf("identity is linked to %+v %v", linked, err)
+	}
+
+	// Deleting a user deletes what belongs to them
+	if _, err = s.DeleteUser(users[0], false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.GetUserByIdentity("mock", "1"); err != errNotFound {
+		t.Errorf("identity of a deleted user gave %v", err)
+	}
+	if _, err = s.GetUserByID(users[0]); err != errNotFound {
+		t.Errorf("deleted user gave %v", err)
+	}
+}
+
+func TestMemoryStoreRatings(t *testing.T) {
+	// Creates a review, failing on errors
+	review := func(s *MemoryStore, movieID, userID, rating int) int {
+		reviewID, _, err := s.CreateReview(movieID, userID, rating, "", false)
+		if err != nil {
+			panic(err)
+		}
+		return reviewID
+	}
+
+	tests := []struct {
+		name   string
+		change func(s *MemoryStore, users [2]int, movieID int) error
+		avg    float64
+		raters int
+	}{
+		{
+			name:   "no reviews",
+			change: func(s *MemoryStore, users [2]int, movieID int) error { return nil },
+		},
+		{
+			name: "average of the reviews",
+			change: func(s *MemoryStore, users [2]int, movieID int) error {
+				review(s, movieID, users[0], 5)
+				review(s, movieID, users[1], 2)
+				return nil
+			},
+			avg: 3.5, raters: 2,
+		},
+		{
+			name: "zero ratings count",
+			change: func(s *MemoryStore, users [2]int, movieID int) error {
+				review(s, movieID, users[0], 0)
+				review(s, movieID, users[1], 5)
+				return nil
+			},
+			avg: 2.5, raters: 2,
+		},
+		{
+			name: "rounded to one decimal",
+			change: func(s *MemoryStore, users [2]int, movieID int) error {
+				review(s, movieID, users[0], 5)
+				review(s, movieID, users[1], 4)
+				userID, _ := s.CreateUser("carol", "carol@example.com", "hash")
+				review(s, movieID, userID, 4)
+				return nil
+			},
+			avg: 4.3, raters: 3,
+		},
+		{
+			name: "replaced review",
+			change: func(s *MemoryStore, users [2]int, movieID int) error {
+				first := review(s, movieID, users[0], 5)
+				reviewID, replaced, err := s.CreateReview(movieID, users[0], 1, "", true)
+				if err == nil && (!replaced || reviewID != first) {
+					err = fmt.Errorf("replacing gave review %d, replaced %v", reviewID, replaced)
+				}
+				return err
+			},
+			avg: 1, raters: 1,
+		},
+		{
+			name: "refused second review",
+			change: func(s *MemoryStore, users [2]int, movieID int) error {
+				review(s, movieID, users[0], 5)
+				if _, _, err := s.CreateReview(movieID, users[0], 1, "", false); err != errDuplicate {
+					return fmt.Errorf("second review gave %v", err)
+				}
+				return nil
+			},
+			avg: 5, raters: 1,
+		},
+		{
+			name: "updated review",
+			change: func(s *MemoryStore, users [2]int, movieID int) error {
+				review(s, movieID, users[0], 5)
+				return s.UpdateReview(review(s, movieID, users[1], 5), users[1], 3, "")
+			},
+			avg: 4, raters: 2,
+		},
+		{
+			name: "deleted review",
+			change: func(s *MemoryStore, users [2]int, movieID int) error {
+				review(s, movieID, users[0], 5)
+				return s.DeleteReview(review(s, movieID, users[1], 1), users[1])
+			},
+			avg: 5, raters: 1,
+		},
+		{
+			name: "removed review",
+			change: func(s *MemoryStore, users [2]int, movieID int) error {
+				review(s, movieID, users[0], 5)
+				return s.RemoveReview(review(s, movieID, users[1], 1))
+			},
+			avg: 5, raters: 1,
+		},
+		{
+			name: "deleted user keeping reviews",
+			change: func(s *MemoryStore, users [2]int, movieID int) error {
+				review(s, movieID, users[0], 5)
+				review(s, movieID, users[1], 1)
+				_, err := s.DeleteUser(users[1], true)
+				return err
+			},
+			avg: 3, raters: 2,
+		},
+		{
+			name: "deleted user with reviews",
+			change: func(s *MemoryStore, users [2]int, movieID int) error {
+				review(s, movieID, users[0], 5)
+				review(s, movieID, users[1], 1)
+				changed, err := s.DeleteUser(users[1], false)
+				if err == nil && (len(changed) != 1 || changed[0] != movieID) {
+					err = fmt.Errorf("changed movies are %v", changed)
+				}
+				return err
+			},
+			avg: 5, raters: 1,
+		},
+		{
+			name: "recomputed",
+			change: func(s *MemoryStore, users [2]int, movieID int) error {
+				review(s, movieID, users[0], 4)
+				return s.RecomputeRatings()
+			},
+			avg: 4, raters: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, users, movieID := newTestStore(t)
+			if err := test.change(s, users, movieID); err != nil {
+				t.Fatal(err)
+			}
+
+			movie, err := s.GetMovie(movieID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if movie.AvgRating != test.avg || movie.RaterNum != test.raters {
+				t.Errorf("got rating %v of %d raters, want %v of %d", movie.AvgRating, movie.RaterNum, test.avg, test.raters)
+			}
+		})
+	}
+}
+
+func TestMemoryStorePages(t *testing.T) {
+	s, users, movieID := newTestStore(t)
+	for i := 2; i <= 5; i++ {
+		if _, err := s.CreateMovie(NewMovie{Title: fmt.Sprintf("Movie %d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	review := func(userID, rating int) {
+		if _, _, err := s.CreateReview(movieID, userID, rating, "", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	review(users[0], 2)
+	review(users[1], 4)
+
+	for _, test := range []struct {
+		query MovieQuery
+		ids   []int
+		total int
+	}{
+		{MovieQuery{Sort: "newest", Limit: 2}, []int{5, 4}, 5},
+		{MovieQuery{Sort: "newest", Limit: 2, Offset: 4}, []int{1}, 5},
+		{MovieQuery{Sort: "newest", Limit: 2, Offset: 10}, []int{}, 5},
+		{MovieQuery{Sort: "newest", Limit: 2, Offset: -8}, []int{5, 4}, 5},
+		{MovieQuery{Sort: "rating", Limit: 1, MinRaters: 2}, []int{1}, 1},
+		{MovieQuery{Sort: "title", Limit: 2, MinRating: 3.5}, []int{}, 0},
+	} {
+		movies, total, err := s.GetMovies(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids := []int{}
+		for _, movie := range movies {
+			ids = append(ids, movie.ID)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(test.ids) || total != test.total {
+			t.Errorf("%+v: got %v of %d, want %v of %d", test.query, ids, total, test.ids, test.total)
+		}
+	}
+
+	rating := 4
+	for _, test := range []struct {
+		query   ReviewQuery
+		ratings []int
+		total   int
+	}{
+		{ReviewQuery{MovieID: movieID, Sort: "highest", Limit: 10}, []int{4, 2}, 2},
+		{ReviewQuery{MovieID: movieID, Sort: "lowest", Limit: 1}, []int{2}, 2},
+		{ReviewQuery{MovieID: movieID, Sort: "newest", Limit: 10, Rating: &rating}, []int{4}, 1},
+		{ReviewQuery{MovieID: movieID, Sort: "highest", Limit: 10, Offset: -1}, []int{4, 2}, 2},
+	} {
+		reviews, total, err := s.GetReviews(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ratings := []int{}
+		for _, review := range reviews {
+			ratings = append(ratings, review.Rating)
+		}
+		if fmt.Sprint(ratings) != fmt.Sprint(test.ratings) || total != test.total {
+			t.Errorf("%+v: got %v of %d, want %v of %d", test.query, ratings, total, test.ratings, test.total)
+		}
+	}
+}
+
+func TestMemoryStoreRefreshTokens(t *testing.T) {
+	s, users, _ := newTestStore(t)
+	expiresAt := time.Now().Add(time.Hour)
+	for _, token := range []RefreshToken{
+		{ID: "a1", FamilyID: "a", UserID: users[0], ExpiresAt: expiresAt},
+		{ID: "a2", FamilyID: "a", UserID: users[0], ExpiresAt: expiresAt},
+		{ID: "b1", FamilyID: "b", UserID: users[0], ExpiresAt: expiresAt},
+		{ID: "c1", FamilyID: "c", UserID: users[1], ExpiresAt: expiresAt},
+		{ID: "expired", FamilyID: "d", UserID: users[1], ExpiresAt: time.Now().Add(-time.Second)},
+	} {
+		if err := s.CreateRefreshToken(token); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Steps run in order, reusing a1 revokes its family (a2) but not the other tokens
+	for _, step := range []struct {
+		name    string
+		tokenID string
+		want    error
+	}{
+		{"first use", "a1", nil},
+		{"reuse", "a1", errTokenReused},
+		{"rotated token of the reused family", "a2", errTokenReused},
+		{"other family", "b1", nil},
+		{"other user", "c1", nil},
+		{"expired", "expired", errNotFound},
+		{"unknown", "unknown", errNotFound},
+	} {
+		token, err := s.UseRefreshToken(step.tokenID)
+		if err != step.want {
+			t.Errorf("%s: got %v, want %v", step.name, err, step.want)
+		} else if err == nil && token.ID != step.tokenID {
+			t.Errorf("%s: got token %s", step.name, token.ID)
+		}
+	}
+
+	// Revoking every token of a user leaves other users signed in
+	if err := s.CreateRefreshToken(RefreshToken{ID: "b2", FamilyID: "b", UserID: users[0], ExpiresAt: expiresAt}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateRefreshToken(RefreshToken{ID: "c2", FamilyID: "c", UserID: users[1], ExpiresAt: expiresAt}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RevokeUserRefreshTokens(users[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.UseRefreshToken("b2"); err != errTokenReused {
+		t.Errorf("revoked token gave %v", err)
+	}
+	if _, err := s.UseRefreshToken("c2"); err != nil {
+		t.Errorf("token of another user gave %v", err)
+	}
+}
+
+func TestMemoryStoreEmailTokens(t *testing.T) {
+	s, users, _ := newTestStore(t)
+	expiresAt := time.Now().Add(time.Hour)
+	for _, token := range []EmailToken{
+		{Hash: "verify1", UserID: users[0], Purpose: verifyEmailPurpose, ExpiresAt: expiresAt},
+		{Hash: "verify2", UserID: users[0], Purpose: verifyEmailPurpose, ExpiresAt: expiresAt},
+		{Hash: "reset", UserID: users[0], Purpose: resetPasswordPurpose, Email: "alice@example.com", ExpiresAt: expiresAt},
+		{Hash: "expired", UserID: users[1], Purpose: verifyEmailPurpose, ExpiresAt: time.Now().Add(-time.Second)},
+		{Hash: "revoked", UserID: users[1], Purpose: resetPasswordPurpose, ExpiresAt: expiresAt},
+	} {
+		if err := s.CreateEmailToken(token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.RevokeUserEmailTokens(users[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Steps run in order, using a token uses up the user's other tokens of the purpose
+	for _, step := range []struct {
+		name    string
+		hash    string
+		purpose string
+		want    error
+	}{
+		{"wrong purpose", "verify1", resetPasswordPurpose, errNotFound},
+		{"first use", "verify1", verifyEmailPurpose, nil},
+		{"reuse", "verify1", verifyEmailPurpose, errNotFound},
+		{"other token of the purpose", "verify2", verifyEmailPurpose, errNotFound},
+		{"token of another purpose", "reset", resetPasswordPurpose, nil},
+		{"expired", "expired", verifyEmailPurpose, errNotFound},
+		{"revoked", "revoked", resetPasswordPurpose, errNotFound},
+	} {
+		token, err := s.UseEmailToken(step.hash, step.purpose)
+		if err != step.want {
+			t.Errorf("%s: got %v, want %v", step.name, err, step.want)
+		} else if err == nil && (token.Hash != step.hash || token.UserID != users[0]) {
+			t.Errorf("%s: got %+v", step.name, token)
+		}
+	}
+}
+
+func TestMemoryStoreLoginFailures(t *testing.T) {
+	s := newMemoryStore()
+
+	for i := 1; i <= 3; i++ {
+		failures, err := s.AddLoginFailure("account:a", time.Hour)
+		if err != nil || failures.Count != i {
+			t.Fatalf("failure %d counted as %+v %v", i, failures, err)
+		}
+	}
+	if _, err := s.AddLoginFailure("account:b", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if failures, _ := s.GetLoginFailures("account:a"); failures.Count != 3 {
+		t.Errorf("got %d failures, want 3", failures.Count)
+	}
+
+	// Counts older than the reset restart
+	time.Sleep(2 * time.Millisecond)
+	if failures, _ := s.AddLoginFailure("account:a", time.Millisecond); failures.Count != 1 {
+		t.Errorf("got %d failures after the reset, want 1", failures.Count)
+	}
+
+	if err := s.ClearLoginFailures("account:a"); err != nil {
+		t.Fatal(err)
+	}
+	if failures, _ := s.GetLoginFailures("account:a"); failures.Count != 0 {
+		t.Errorf("got %d failures after clearing", failures.Count)
+	}
+}
+
+func TestMemoryStoreTOTP(t *testing.T) {
+	s, users, _ := newTestStore(t)
+
+	if err := s.SetTOTPSecret(users[0], "SECRET"); err != nil {
+		t.Fatal(err)
+	}
+	if user, _ := s.GetUserByID(users[0]); user.TOTPSecret != "SECRET" || user.TOTPEnabled {
+		t.Fatalf("pending secret gave %+v", user)
+	}
+	if err := s.EnableTOTP(users[0], []string{"code1", "code2"}); err != nil {
+		t.Fatal(err)
+	}
+	if user, _ := s.GetUserByID(users[0]); !user.TOTPEnabled {
+		t.Fatalf("2FA is not enabled")
+	}
+
+	// Steps run in order, a time step or recovery code works once and steps only move forward
+	for _, step := range []struct {
+		name string
+		use  func() error
+		want error
+	}{
+		{"step", func() error { return s.UseTOTPStep(users[0], 100) }, nil},
+		{"same step", func() error { return s.UseTOTPStep(users[0], 100) }, errTokenReused},
+		{"earlier step", func() error { return s.UseTOTPStep(users[0], 99) }, errTokenReused},
+		{"later step", func() error { return s.UseTOTPStep(users[0], 101) }, nil},
+		{"step of another user", func() error { return s.UseTOTPStep(users[1], 100) }, nil},
+		{"recovery code", func() error { return s.UseRecoveryCode(users[0], "code1") }, nil},
+		{"used recovery code", func() error { return s.UseRecoveryCode(users[0], "code1") }, errNotFound},
+		{"recovery code of another user", func() error { return s.UseRecoveryCode(users[1], "code2") }, errNotFound},
+		{"disabled", func() error { return s.DisableTOTP(users[0]) }, nil},
+		{"recovery code after disabling", func() error { return s.UseRecoveryCode(users[0], "code2") }, errNotFound},
+	} {
+		if err := step.use(); err != step.want {
+			t.Errorf("%s: got %v, want %v", step.name, err, step.want)
+		}
+	}
+
+	if user, _ := s.GetUserByID(users[0]); user.TOTPSecret != "" || user.TOTPEnabled {
+		t.Errorf("disabling left %+v", user)
+	}
+}
@@ -0,0 +1,1134 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Layout of DATETIME values
+const dbTimeLayout = "2006-01-02 15:04:05"
+
+// Parses a DATETIME value scanned as bytes, with or without parseTime in the DSN
+func parseDBTime(value []byte) time.Time {
+	if t, err := time.Parse(dbTimeLayout, string(value)); err == nil {
+		return t
+	}
+
+	t, _ := time.Parse(time.RFC3339Nano, string(value))
+	return t
+}
+
+// MySQLStore keeps data in a MySQL database
+type MySQLStore struct {
+	db *sql.DB
+}
+
+// Opens and pings the MySQL database
+func openMySQLStore(dsn string) (*MySQLStore, error) {
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &MySQLStore{db: db}, nil
+}
+
+// Close closes the database
+func (s *MySQLStore) Close() error {
+	return s.db.Close()
+}
+
+// Checks whether the query returns at least one row
+func (s *MySQLStore) exists(query string, args ...interface{}) (bool, error) {
+	var id int
+	err := s.db.QueryRow(query, args...).Scan(&id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Columns selected for a User
+const mysqlUserColumns = "id, username, email, password, role, emailVerified, COALESCE(totpSecret, ''), totpEnabled"
+
+// Gets the user matching the condition
+func (s *MySQLStore) getUser(where string, args ...interface{}) (*User, error) {
+	user := new(User)
+	err := s.db.QueryRow("SELECT "+mysqlUserColumns+" FROM users WHERE "+where, args...).
+		Scan(&user.ID, &user.Username, &user.Email, &user.Password, &user.Role, &user.EmailVerified, &user.TOTPSecret, &user.TOTPEnabled)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// GetUserByID gets a user by ID
+func (s *MySQLStore) GetUserByID(userID int) (*User, error) {
+	return s.getUser("id = ?", userID)
+}
+
+// GetUserByEmail gets a user by email
+func (s *MySQLStore) GetUserByEmail(email string) (*User, error) {
+	return s.getUser("email = ?", email)
+}
+
+// UsernameExists checks if the username is taken
+func (s *MySQLStore) UsernameExists(username string) (bool, error) {
+	return s.exists("SELECT id FROM users WHERE username = ?", username)
+}
+
+// EmailExists checks if the email has been used
+func (s *MySQLStore) EmailExists(email string) (bool, error) {
+	return s.exists("SELECT id FROM users WHERE email = ?", email)
+}
+
+// CreateUser inserts a new user and returns its ID
+func (s *MySQLStore) CreateUser(username, email, passwordHash string) (int, error) {
+	result, err := s.db.Exec("INSERT INTO users (username, email, password) VALUES (?, ?, ?)", username, email, passwordHash)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+// CreateRefreshToken records an issued refresh token
+func (s *MySQLStore) CreateRefreshToken(token RefreshToken) error {
+	_, err := s.db.Exec("INSERT INTO refresh_tokens (id, familyId, userId, device, expiresAt) VALUES (?, ?, ?, ?, ?)",
+		token.ID, token.FamilyID, token.UserID, token.Device, token.ExpiresAt.Format(dbTimeLayout))
+	return err
+}
+
+// UseRefreshToken marks an unexpired refresh token as used, reuse revokes its family
+func (s *MySQLStore) UseRefreshToken(tokenID string) (*RefreshToken, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC().Format(dbTimeLayout)
+	token := new(RefreshToken)
+	var expiresAt []byte
+	var used bool
+	err = tx.QueryRow("SELECT id, familyId, userId, device, expiresAt, usedAt IS NOT NULL OR revokedAt IS NOT NULL FROM refresh_tokens WHERE id = ? FOR UPDATE", tokenID).
+		Scan(&token.ID, &token.FamilyID, &token.UserID, &token.Device, &expiresAt, &used)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	token.ExpiresAt = parseDBTime(expiresAt)
+
+	if used {
+		if _, err = tx.Exec("UPDATE refresh_tokens SET revokedAt = ? WHERE familyId = ? AND revokedAt IS NULL", now, token.FamilyID); err != nil {
+			return nil, err
+		}
+		if err = tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, errTokenReused
+	}
+
+	if token.ExpiresAt.Before(time.Now()) {
+		return nil, errNotFound
+	}
+
+	if _, err = tx.Exec("UPDATE refresh_tokens SET usedAt = ? WHERE id = ?", now, tokenID); err != nil {
+		return nil, err
+	}
+
+	return token, tx.Commit()
+}
+
+// RevokeRefreshTokenFamily revokes every token of the family the token belongs to
+func (s *MySQLStore) RevokeRefreshTokenFamily(tokenID string) error {
+	result, err := s.db.Exec(`UPDATE refresh_tokens AS tokens
+		INNER JOIN refresh_tokens AS token ON token.familyId = tokens.familyId
+		SET tokens.revokedAt = ?
+		WHERE token.id = ? AND tokens.revokedAt IS NULL`, time.Now().UTC().Format(dbTimeLayout), tokenID)
+	if err != nil {
+		return err
+	}
+
+	if revoked, err := result.RowsAffected(); err != nil {
+		return err
+	} else if revoked == 0 {
+		return errNotFound
+	}
+
+	return nil
+}
+
+// RevokeUserRefreshTokens revokes every refresh token of the user
+func (s *MySQLStore) RevokeUserRefreshTokens(userID int) error {
+	_, err := s.db.Exec("UPDATE refresh_tokens SET revokedAt = ? WHERE userId = ? AND revokedAt IS NULL", time.Now().UTC().Format(dbTimeLayout), userID)
+	return err
+}
+
+// GetUserRefreshTokens gets every refresh token of the user, oldest first
+func (s *MySQLStore) GetUserRefreshTokens(userID int) ([]StoredRefreshToken, error) {
+	// Every token lives as long, so the first to expire was issued first
+	result, err := s.db.Query(`SELECT id, familyId, userId, device, expiresAt, usedAt IS NOT NULL, revokedAt IS NOT NULL
+		FROM refresh_tokens WHERE userId = ? ORDER BY expiresAt`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	tokens := []StoredRefreshToken{}
+	for result.Next() {
+		var token StoredRefreshToken
+		var expiresAt []byte
+		if err = result.Scan(&token.ID, &token.FamilyID, &token.UserID, &token.Device, &expiresAt, &token.Used, &token.Revoked); err != nil {
+			return nil, err
+		}
+		token.ExpiresAt = parseDBTime(expiresAt)
+		tokens = append(tokens, token)
+	}
+
+	return tokens, result.Err()
+}
+
+// SetUserRole changes the role of a user
+func (s *MySQLStore) SetUserRole(userID int, role string) error {
+	if exists, err := s.exists("SELECT id FROM users WHERE id = ?", userID); err != nil {
+		return err
+	} else if !exists {
+		return errNotFound
+	}
+
+	_, err := s.db.Exec("UPDATE users SET role = ? WHERE id = ?", role, userID)
+	return err
+}
+
+// SetUserPassword changes the password hash of a user
+func (s *MySQLStore) SetUserPassword(userID int, passwordHash string) error {
+	if exists, err := s.exists("SELECT id FROM users WHERE id = ?", userID); err != nil {
+		return err
+	} else if !exists {
+		return errNotFound
+	}
+
+	_, err := s.db.Exec("UPDATE users SET password = ? WHERE id = ?", passwordHash, userID)
+	return err
+}
+
+// SetEmailVerified marks the email of a user as verified
+func (s *MySQLStore) SetEmailVerified(userID int) error {
+	if exists, err := s.exists("SELECT id FROM users WHERE id = ?", userID); err != nil {
+		return err
+	} else if !exists {
+		return errNotFound
+	}
+
+	_, err := s.db.Exec("UPDATE users SET emailVerified = TRUE WHERE id = ?", userID)
+	return err
+}
+
+// UpdateUser saves the username, email and emailVerified of the user
+func (s *MySQLStore) UpdateUser(user *User) error {
+	if exists, err := s.exists("SELECT id FROM users WHERE id = ?", user.ID); err != nil {
+		return err
+	} else if !exists {
+		return errNotFound
+	}
+
+	_, err := s.db.Exec("UPDATE users SET username = ?, email = ?, emailVerified = ? WHERE id = ?", user.Username, user.Email, user.EmailVerified, user.ID)
+	return err
+}
+
+// GetUserByIdentity gets the user an external identity is linked to
+func (s *MySQLStore) GetUserByIdentity(provider, subject string) (*User, error) {
+	return s.getUser("id = (SELECT userId FROM user_identities WHERE provider = ? AND subject = ?)", provider, subject)
+}
+
+// LinkIdentity links an external identity to the user
+func (s *MySQLStore) LinkIdentity(userID int, provider, subject string) error {
+	if exists, err := s.exists("SELECT id FROM users WHERE id = ?", userID); err != nil {
+		return err
+	} else if !exists {
+		return errNotFound
+	}
+
+	_, err := s.db.Exec("INSERT INTO user_identities (provider, subject, userId, createdAt) VALUES (?, ?, ?, ?)",
+		provider, subject, userID, time.Now().UTC().Format(dbTimeLayout))
+	if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == 1062 {
+		return errDuplicate
+	}
+	return err
+}
+
+// GetUserIdentities gets the identities linked to the user, oldest first
+func (s *MySQLStore) GetUserIdentities(userID int) ([]UserIdentity, error) {
+	result, err := s.db.Query("SELECT provider, subject, userId, createdAt FROM user_identities WHERE userId = ? ORDER BY createdAt", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	identities := []UserIdentity{}
+	for result.Next() {
+		var identity UserIdentity
+		var createdAt []byte
+		if err = result.Scan(&identity.Provider, &identity.Subject, &identity.UserID, &createdAt); err != nil {
+			return nil, err
+		}
+		identity.CreatedAt = parseDBTime(createdAt)
+		identities = append(identities, identity)
+	}
+
+	return identities, result.Err()
+}
+
+// SetTOTPSecret stores a pending TOTP secret of the user
+func (s *MySQLStore) SetTOTPSecret(userID int, secret string) error {
+	if exists, err := s.exists("SELECT id FROM users WHERE id = ?", userID); err != nil {
+		return err
+	} else if !exists {
+		return errNotFound
+	}
+
+	_, err := s.db.Exec("UPDATE users SET totpSecret = ?, totpEnabled = FALSE WHERE id = ?", secret, userID)
+	return err
+}
+
+// EnableTOTP turns 2FA on and replaces the recovery codes in one transaction
+func (s *MySQLStore) EnableTOTP(userID int, recoveryCodeHashes []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRow("SELECT id FROM users WHERE id = ? FOR UPDATE", userID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	} else if err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec("UPDATE users SET totpEnabled = TRUE WHERE id = ?", userID); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM recovery_codes WHERE userId = ?", userID); err != nil {
+		return err
+	}
+	for _, hash := range recoveryCodeHashes {
+		if _, err = tx.Exec("INSERT INTO recovery_codes (userId, hash) VALUES (?, ?)", userID, hash); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// DisableTOTP turns 2FA off and drops the secret and recovery codes in one transaction
+func (s *MySQLStore) DisableTOTP(userID int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRow("SELECT id FROM users WHERE id = ? FOR UPDATE", userID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	} else if err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec("UPDATE users SET totpSecret = NULL, totpEnabled = FALSE WHERE id = ?", userID); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM recovery_codes WHERE userId = ?", userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseTOTPStep records the time step of a used TOTP code, steps cannot be used twice
+func (s *MySQLStore) UseTOTPStep(userID int, step int64) error {
+	result, err := s.db.Exec("UPDATE users SET totpLastStep = ? WHERE id = ? AND totpLastStep < ?", step, userID, step)
+	if err != nil {
+		return err
+	}
+
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated == 0 {
+		return errTokenReused
+	}
+
+	return nil
+}
+
+// UseRecoveryCode uses up an unused recovery code of the user
+func (s *MySQLStore) UseRecoveryCode(userID int, hash string) error {
+	result, err := s.db.Exec("UPDATE recovery_codes SET usedAt = ? WHERE userId = ? AND hash = ? AND usedAt IS NULL",
+		time.Now().UTC().Format(dbTimeLayout), userID, hash)
+	if err != nil {
+		return err
+	}
+
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated == 0 {
+		return errNotFound
+	}
+
+	return nil
+}
+
+// DeleteUser deletes the user and their tokens in one transaction, their reviews are kept without an author or deleted
+func (s *MySQLStore) DeleteUser(userID int, keepReviews bool) ([]int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRow("SELECT id FROM users WHERE id = ? FOR UPDATE", userID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	changedMovies := []int{}
+	if keepReviews {
+		if _, err = tx.Exec("UPDATE reviews SET userId = NULL WHERE userId = ?", userID); err != nil {
+			return nil, err
+		}
+	} else {
+		rows, err := tx.Query("SELECT movieId FROM reviews WHERE userId = ? ORDER BY movieId", userID)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var movieID int
+			if err = rows.Scan(&movieID); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			changedMovies = append(changedMovies, movieID)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+
+		// Lock the movies in ID order like the review changes do, then recompute them without the reviews
+		for _, movieID := range changedMovies {
+			if err = lockMovie(tx, movieID); err != nil {
+				return nil, err
+			}
+		}
+		if _, err = tx.Exec("DELETE FROM reviews WHERE userId = ?", userID); err != nil {
+			return nil, err
+		}
+		for _, movieID := range changedMovies {
+			if err = updateMovieRating(tx, movieID); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Tokens, recovery codes, identities and API keys are deleted by their foreign keys
+	if _, err = tx.Exec("DELETE FROM users WHERE id = ?", userID); err != nil {
+		return nil, err
+	}
+
+	return changedMovies, tx.Commit()
+}
+
+// CreateEmailToken records a token sent by email
+func (s *MySQLStore) CreateEmailToken(token EmailToken) error {
+	_, err := s.db.Exec("INSERT INTO email_tokens (hash, userId, purpose, email, expiresAt) VALUES (?, ?, ?, ?, ?)",
+		token.Hash, token.UserID, token.Purpose, token.Email, token.ExpiresAt.Format(dbTimeLayout))
+	return err
+}
+
+// UseEmailToken uses up an unexpired token and every other token of the user for the purpose
+func (s *MySQLStore) UseEmailToken(hash, purpose string) (*EmailToken, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	token := new(EmailToken)
+	var expiresAt []byte
+	err = tx.QueryRow("SELECT hash, userId, purpose, email, expiresAt FROM email_tokens WHERE hash = ? AND purpose = ? AND usedAt IS NULL FOR UPDATE", hash, purpose).
+		Scan(&token.Hash, &token.UserID, &token.Purpose, &token.Email, &expiresAt)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	token.ExpiresAt = parseDBTime(expiresAt)
+
+	if token.ExpiresAt.Before(time.Now()) {
+		return nil, errNotFound
+	}
+
+	_, err = tx.Exec("UPDATE email_tokens SET usedAt = ? WHERE userId = ? AND purpose = ? AND usedAt IS NULL",
+		time.Now().UTC().Format(dbTimeLayout), token.UserID, purpose)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, tx.Commit()
+}
+
+// RevokeUserEmailTokens uses up every outstanding token of the user
+func (s *MySQLStore) RevokeUserEmailTokens(userID int) error {
+	_, err := s.db.Exec("UPDATE email_tokens SET usedAt = ? WHERE userId = ? AND usedAt IS NULL",
+		time.Now().UTC().Format(dbTimeLayout), userID)
+	return err
+}
+
+// GetLoginFailures gets the failed logins counted for the key
+func (s *MySQLStore) GetLoginFailures(key string) (LoginFailures, error) {
+	var failures LoginFailures
+	var lastFailureAt []byte
+	err := s.db.QueryRow("SELECT count, lastFailureAt FROM login_failures WHERE throttleKey = ?", key).Scan(&failures.Count, &lastFailureAt)
+	if err == sql.ErrNoRows {
+		return LoginFailures{}, nil
+	} else if err != nil {
+		return LoginFailures{}, err
+	}
+
+	failures.LastFailureAt = parseDBTime(lastFailureAt)
+	return failures, nil
+}
+
+// AddLoginFailure counts a failed login for the key, counts older than resetAfter restart and are dropped
+func (s *MySQLStore) AddLoginFailure(key string, resetAfter time.Duration) (LoginFailures, error) {
+	now := time.Now().UTC()
+	resetBefore := now.Add(-resetAfter).Format(dbTimeLayout)
+
+	if _, err := s.db.Exec("DELETE FROM login_failures WHERE lastFailureAt < ? AND throttleKey != ?", resetBefore, key); err != nil {
+		return LoginFailures{}, err
+	}
+
+	// count is assigned before lastFailureAt, so it still sees the previous failure
+	_, err := s.db.Exec(`INSERT INTO login_failures (throttleKey, count, lastFailureAt) VALUES (?, 1, ?)
+		ON DUPLICATE KEY UPDATE count = IF(lastFailureAt < ?, 1, count + 1), lastFailureAt = VALUES(lastFailureAt)`,
+		key, now.Format(dbTimeLayout), resetBefore)
+	if err != nil {
+		return LoginFailures{}, err
+	}
+
+	return s.GetLoginFailures(key)
+}
+
+// ClearLoginFailures forgets the failed logins of the key
+func (s *MySQLStore) ClearLoginFailures(key string) error {
+	_, err := s.db.Exec("DELETE FROM login_failures WHERE throttleKey = ?", key)
+	return err
+}
+
+// CreateAuditEvent records an audit event
+func (s *MySQLStore) CreateAuditEvent(event AuditEvent) error {
+	var userID interface{}
+	if event.UserID != anyUser {
+		userID = event.UserID
+	}
+
+	_, err := s.db.Exec("INSERT INTO audit_events (type, userId, ip, detail, createdAt) VALUES (?, ?, ?, ?, ?)",
+		event.Type, userID, event.IP, event.Detail, event.CreatedAt.UTC().Format(dbTimeLayout))
+	return err
+}
+
+// GetUserAuditEvents gets the events about the user, oldest first
+func (s *MySQLStore) GetUserAuditEvents(userID int) ([]AuditEvent, error) {
+	result, err := s.db.Query("SELECT type, userId, ip, detail, createdAt FROM audit_events WHERE userId = ? ORDER BY createdAt, id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	events := []AuditEvent{}
+	for result.Next() {
+		var event AuditEvent
+		var createdAt []byte
+		if err = result.Scan(&event.Type, &event.UserID, &event.IP, &event.Detail, &createdAt); err != nil {
+			return nil, err
+		}
+		event.CreatedAt = parseDBTime(createdAt)
+		events = append(events, event)
+	}
+
+	return events, result.Err()
+}
+
+// Columns selected for an APIKey
+const mysqlAPIKeyColumns = "id, userId, name, prefix, hash, scopes, createdAt, lastUsedAt"
+
+// Scans a row of mysqlAPIKeyColumns
+func scanAPIKey(row interface{ Scan(...interface{}) error }, key *APIKey) error {
+	var scopes string
+	var createdAt, lastUsedAt []byte
+	if err := row.Scan(&key.ID, &key.UserID, &key.Name, &key.Prefix, &key.Hash, &scopes, &createdAt, &lastUsedAt); err != nil {
+		return err
+	}
+
+	key.Scopes = strings.Split(scopes, ",")
+	key.CreatedAt = parseDBTime(createdAt)
+	if lastUsedAt != nil {
+		usedAt := parseDBTime(lastUsedAt)
+		key.LastUsedAt = &usedAt
+	}
+	return nil
+}
+
+// CreateAPIKey stores a new API key
+func (s *MySQLStore) CreateAPIKey(key APIKey) (int, error) {
+	if exists, err := s.exists("SELECT id FROM users WHERE id = ?", key.UserID); err != nil {
+		return 0, err
+	} else if !exists {
+		return 0, errNotFound
+	}
+
+	result, err := s.db.Exec("INSERT INTO api_keys (userId, name, prefix, hash, scopes, createdAt) VALUES (?, ?, ?, ?, ?, ?)",
+		key.UserID, key.Name, key.Prefix, key.Hash, strings.Join(key.Scopes, ","), key.CreatedAt.UTC().Format(dbTimeLayout))
+	if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == 1062 {
+		return 0, errDuplicate
+	} else if err != nil {
+		return 0, err
+	}
+
+	keyID, err := result.LastInsertId()
+	return int(keyID), err
+}
+
+// GetAPIKeyByHash gets an API key by the hash of the key
+func (s *MySQLStore) GetAPIKeyByHash(hash string) (*APIKey, error) {
+	key := new(APIKey)
+	err := scanAPIKey(s.db.QueryRow("SELECT "+mysqlAPIKeyColumns+" FROM api_keys WHERE hash = ?", hash), key)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// GetUserAPIKeys gets the API keys of the user, oldest first
+func (s *MySQLStore) GetUserAPIKeys(userID int) ([]APIKey, error) {
+	result, err := s.db.Query("SELECT "+mysqlAPIKeyColumns+" FROM api_keys WHERE userId = ? ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	keys := []APIKey{}
+	for result.Next() {
+		var key APIKey
+		if err = scanAPIKey(result, &key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, result.Err()
+}
+
+// DeleteAPIKey deletes an API key of the user
+func (s *MySQLStore) DeleteAPIKey(keyID, userID int) error {
+	result, err := s.db.Exec("DELETE FROM api_keys WHERE id = ? AND userId = ?", keyID, userID)
+	if err != nil {
+		return err
+	}
+
+	if deleted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if deleted == 0 {
+		return errNotFound
+	}
+
+	return nil
+}
+
+// SetAPIKeyLastUsed records when an API key was last used
+func (s *MySQLStore) SetAPIKeyLastUsed(keyID int, usedAt time.Time) error {
+	_, err := s.db.Exec("UPDATE api_keys SET lastUsedAt = ? WHERE id = ?", usedAt.UTC().Format(dbTimeLayout), keyID)
+	return err
+}
+
+// ORDER BY clauses of the movie sorts
+var mysqlMovieOrders = map[string]string{
+	"newest":     "id DESC",
+	"rating":     "avgRating DESC, raterNum DESC, id DESC",
+	"title":      "title ASC, id ASC",
+	"most_rated": "raterNum DESC, avgRating DESC, id DESC",
+}
+
+// Columns selected for a Movie, genres are loaded separately
+const mysqlMovieColumns = "id, title, releaseYear, runtime, synopsis, originalLanguage, posterUrl, imdbId, tmdbId, avgRating, raterNum"
+
+// Scans a row of mysqlMovieColumns
+func scanMovie(row interface{ Scan(...interface{}) error }, movie *Movie) error {
+	movie.Genres = []string{}
+	return row.Scan(&movie.ID, &movie.Title, &movie.ReleaseYear, &movie.Runtime, &movie.Synopsis, &movie.OriginalLanguage,
+		&movie.PosterURL, &movie.IMDbID, &movie.TMDbID, &movie.AvgRating, &movie.RaterNum)
+}
+
+// Loads the genres of the movies
+func (s *MySQLStore) loadGenres(movies []Movie) error {
+	if len(movies) == 0 {
+		return nil
+	}
+
+	indexes := map[int]int{}
+	args := make([]interface{}, len(movies))
+	for i := range movies {
+		indexes[movies[i].ID] = i
+		args[i] = movies[i].ID
+	}
+
+	result, err := s.db.Query("SELECT movieId, name FROM movie_genres INNER JOIN genres ON genreId = genres.id WHERE movieId IN (?"+
+		strings.Repeat(", ?", len(movies)-1)+") ORDER BY name", args...)
+	if err != nil {
+		return err
+	}
+	defer result.Close()
+
+	for result.Next() {
+		var movieID int
+		var genre string
+		if err = result.Scan(&movieID, &genre); err != nil {
+			return err
+		}
+
+		movie := &movies[indexes[movieID]]
+		movie.Genres = append(movie.Genres, genre)
+	}
+
+	return result.Err()
+}
+
+// Replaces the genres of a movie, creating missing genres
+func setGenres(tx *sql.Tx, movieID int, genres []string) error {
+	if _, err := tx.Exec("DELETE FROM movie_genres WHERE movieId = ?", movieID); err != nil {
+		return err
+	}
+
+	for _, genre := range genres {
+		if _, err := tx.Exec("INSERT IGNORE INTO genres (name) VALUES (?)", genre); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec("INSERT INTO movie_genres (movieId, genreId) SELECT ?, id FROM genres WHERE name = ?", movieID, genre)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetMovies gets a page of movies and the number of movies matching the filters
+func (s *MySQLStore) GetMovies(query MovieQuery) ([]Movie, int, error) {
+	if query.Offset < 0 {
+		query.Offset = 0
+	}
+
+	where := " WHERE avgRating >= ? AND raterNum >= ?"
+	args := []interface{}{query.MinRating, query.MinRaters}
+
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM movies"+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	result, err := s.db.Query("SELECT "+mysqlMovieColumns+" FROM movies"+where+" ORDER BY "+mysqlMovieOrders[query.Sort]+" LIMIT ? OFFSET ?",
+		append(args, query.Limit, query.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer result.Close()
+
+	movies := []Movie{}
+	for result.Next() {
+		var movie Movie
+		if err = scanMovie(result, &movie); err != nil {
+			return nil, 0, err
+		}
+
+		movies = append(movies, movie)
+	}
+	if err = result.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return movies, total, s.loadGenres(movies)
+}
+
+// CreateMovie inserts a new movie with its genres and returns its ID
+func (s *MySQLStore) CreateMovie(movie NewMovie) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO movies (title, releaseYear, runtime, synopsis, originalLanguage, posterUrl, imdbId, tmdbId) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		movie.Title, movie.ReleaseYear, movie.Runtime, movie.Synopsis, movie.OriginalLanguage, movie.PosterURL, movie.IMDbID, movie.TMDbID)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	if err = setGenres(tx, int(id), movie.Genres); err != nil {
+		return 0, err
+	}
+
+	return int(id), tx.Commit()
+}
+
+// GetMovie gets a movie by ID
+func (s *MySQLStore) GetMovie(movieID int) (*Movie, error) {
+	movie := new(Movie)
+	err := scanMovie(s.db.QueryRow("SELECT "+mysqlMovieColumns+" FROM movies WHERE id = ?", movieID), movie)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	movies := []Movie{*movie}
+	if err = s.loadGenres(movies); err != nil {
+		return nil, err
+	}
+
+	return &movies[0], nil
+}
+
+// UpdateMovie changes a movie and its genres
+func (s *MySQLStore) UpdateMovie(movieID int, movie NewMovie) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = lockMovie(tx, movieID); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE movies SET title = ?, releaseYear = ?, runtime = ?, synopsis = ?, originalLanguage = ?, posterUrl = ?, imdbId = ?, tmdbId = ? WHERE id = ?",
+		movie.Title, movie.ReleaseYear, movie.Runtime, movie.Synopsis, movie.OriginalLanguage, movie.PosterURL, movie.IMDbID, movie.TMDbID, movieID)
+	if err != nil {
+		return err
+	}
+
+	if err = setGenres(tx, movieID, movie.Genres); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteMovie deletes a movie, its reviews are deleted by the foreign key
+func (s *MySQLStore) DeleteMovie(movieID int) error {
+	result, err := s.db.Exec("DELETE FROM movies WHERE id = ?", movieID)
+	if err != nil {
+		return err
+	}
+
+	if deleted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if deleted == 0 {
+		return errNotFound
+	}
+
+	return nil
+}
+
+// Sets avgRating and raterNum of a movie from its reviews
+func updateMovieRating(tx *sql.Tx, movieID int) error {
+	_, err := tx.Exec(`UPDATE movies SET
+		avgRating = COALESCE((SELECT ROUND(AVG(rating), 1) FROM reviews WHERE movieId = ?), 0),
+		raterNum = (SELECT COUNT(*) FROM reviews WHERE movieId = ?)
+		WHERE id = ?`, movieID, movieID, movieID)
+	return err
+}
+
+// Locks the movie row until the transaction ends, returns errNotFound if it does not exist
+func lockMovie(tx *sql.Tx, movieID int) error {
+	var id int
+	err := tx.QueryRow("SELECT id FROM movies WHERE id = ? FOR UPDATE", movieID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+
+	return err
+}
+
+// RecomputeRatings rebuilds avgRating and raterNum of every movie from the reviews
+func (s *MySQLStore) RecomputeRatings() error {
+	_, err := s.db.Exec(`UPDATE movies
+		LEFT JOIN (SELECT movieId, AVG(rating) AS avgRating, COUNT(*) AS raterNum FROM reviews GROUP BY movieId) AS stats
+		ON stats.movieId = movies.id
+		SET movies.avgRating = COALESCE(ROUND(stats.avgRating, 1), 0), movies.raterNum = COALESCE(stats.raterNum, 0)`)
+	return err
+}
+
+// Columns selected for a Review, reviews must be left joined with users
+const mysqlReviewColumns = "reviews.id, movieId, rating, COALESCE(comment, ''), COALESCE(username, '" + deletedUsername + "'), reviews.createdAt, reviews.updatedAt"
+
+// ORDER BY clauses of the review sorts
+var mysqlReviewOrders = map[string]string{
+	"newest":  "reviews.createdAt DESC, reviews.id DESC",
+	"oldest":  "reviews.createdAt ASC, reviews.id ASC",
+	"highest": "rating DESC, reviews.createdAt DESC, reviews.id DESC",
+	"lowest":  "rating ASC, reviews.createdAt DESC, reviews.id DESC",
+}
+
+// Scans a row of mysqlReviewColumns
+func scanReview(row interface{ Scan(...interface{}) error }, review *Review) error {
+	var createdAt, updatedAt []byte
+	if err := row.Scan(&review.ID, &review.MovieID, &review.Rating, &review.Comment, &review.Username, &createdAt, &updatedAt); err != nil {
+		return err
+	}
+
+	review.CreatedAt = parseDBTime(createdAt)
+	review.UpdatedAt = parseDBTime(updatedAt)
+	return nil
+}
+
+// GetReviews gets a page of reviews of a movie and the number of reviews matching the filters
+func (s *MySQLStore) GetReviews(query ReviewQuery) ([]Review, int, error) {
+	if query.Offset < 0 {
+		query.Offset = 0
+	}
+
+	where := " WHERE movieId = ?"
+	args := []interface{}{query.MovieID}
+	if query.Rating != nil {
+		where += " AND rating = ?"
+		args = append(args, *query.Rating)
+	}
+
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM reviews"+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	result, err := s.db.Query("SELECT "+mysqlReviewColumns+" FROM reviews LEFT JOIN users ON userId = users.id"+where+" ORDER BY "+mysqlReviewOrders[query.Sort]+" LIMIT ? OFFSET ?",
+		append(args, query.Limit, query.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer result.Close()
+
+	reviews := []Review{}
+	for result.Next() {
+		var review Review
+		if err = scanReview(result, &review); err != nil {
+			return nil, 0, err
+		}
+
+		reviews = append(reviews, review)
+	}
+
+	return reviews, total, result.Err()
+}
+
+// CreateReview inserts or replaces the review of the user and updates the movie rating in one transaction
+func (s *MySQLStore) CreateReview(movieID, userID, rating int, comment string, replace bool) (int, bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	// Serialize reviews of the same movie
+	if err = lockMovie(tx, movieID); err != nil {
+		return 0, false, err
+	}
+
+	// Check for an existing review of the user
+	now := time.Now().UTC().Format(dbTimeLayout)
+	var id int64
+	replaced := false
+	err = tx.QueryRow("SELECT id FROM reviews WHERE movieId = ? AND userId = ? FOR UPDATE", movieID, userID).Scan(&id)
+	if err == nil {
+		if !replace {
+			return 0, false, errDuplicate
+		}
+
+		if _, err = tx.Exec("UPDATE reviews SET rating = ?, comment = ?, updatedAt = ? WHERE id = ?", rating, comment, now, id); err != nil {
+			return 0, false, err
+		}
+		replaced = true
+	} else if err == sql.ErrNoRows {
+		result, err := tx.Exec("INSERT INTO reviews (rating, comment, movieId, userId, createdAt, updatedAt) VALUES (?, ?, ?, ?, ?, ?)", rating, comment, movieID, userID, now, now)
+		if err != nil {
+			return 0, false, err
+		}
+
+		if id, err = result.LastInsertId(); err != nil {
+			return 0, false, err
+		}
+	} else {
+		return 0, false, err
+	}
+
+	if err = updateMovieRating(tx, movieID); err != nil {
+		return 0, false, err
+	}
+
+	return int(id), replaced, tx.Commit()
+}
+
+// Locks a review of the user (or of any user if userID is anyUser) and its movie until the transaction ends, returns the movie ID
+func lockOwnReview(tx *sql.Tx, reviewID, userID int) (int, error) {
+	var movieID, ownerID int
+	err := tx.QueryRow("SELECT movieId FROM reviews WHERE id = ?", reviewID).Scan(&movieID)
+	if err == sql.ErrNoRows {
+		return 0, errNotFound
+	} else if err != nil {
+		return 0, err
+	}
+
+	// Lock the movie first like CreateReview does
+	if err = lockMovie(tx, movieID); err != nil {
+		return 0, err
+	}
+
+	// Reviews of deleted accounts have no owner
+	err = tx.QueryRow("SELECT COALESCE(userId, ?) FROM reviews WHERE id = ? FOR UPDATE", anyUser, reviewID).Scan(&ownerID)
+	if err == sql.ErrNoRows {
+		return 0, errNotFound
+	} else if err != nil {
+		return 0, err
+	}
+
+	if userID != anyUser && ownerID != userID {
+		return 0, errNotOwner
+	}
+
+	return movieID, nil
+}
+
+// GetReview gets a review by ID
+func (s *MySQLStore) GetReview(reviewID int) (*Review, error) {
+	review := new(Review)
+	err := scanReview(s.db.QueryRow("SELECT "+mysqlReviewColumns+" FROM reviews LEFT JOIN users ON userId = users.id WHERE reviews.id = ?", reviewID), review)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return review, nil
+}
+
+// GetUserReviews gets every review of the user, oldest first
+func (s *MySQLStore) GetUserReviews(userID int) ([]UserReview, error) {
+	result, err := s.db.Query("SELECT "+mysqlReviewColumns+", movies.title FROM reviews LEFT JOIN users ON userId = users.id INNER JOIN movies ON movieId = movies.id WHERE userId = ? ORDER BY "+mysqlReviewOrders["oldest"], userID)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	reviews := []UserReview{}
+	for result.Next() {
+		var review UserReview
+		var createdAt, updatedAt []byte
+		err = result.Scan(&review.ID, &review.MovieID, &review.Rating, &review.Comment, &review.Username, &createdAt, &updatedAt, &review.MovieTitle)
+		if err != nil {
+			return nil, err
+		}
+
+		review.CreatedAt = parseDBTime(createdAt)
+		review.UpdatedAt = parseDBTime(updatedAt)
+		reviews = append(reviews, review)
+	}
+
+	return reviews, result.Err()
+}
+
+// UpdateReview changes a review of the user and updates the movie rating in one transaction
+func (s *MySQLStore) UpdateReview(reviewID, userID, rating int, comment string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	movieID, err := lockOwnReview(tx, reviewID, userID)
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec("UPDATE reviews SET rating = ?, comment = ?, updatedAt = ? WHERE id = ?", rating, comment, time.Now().UTC().Format(dbTimeLayout), reviewID); err != nil {
+		return err
+	}
+
+	if err = updateMovieRating(tx, movieID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteReview deletes a review of the user and updates the movie rating in one transaction
+func (s *MySQLStore) DeleteReview(reviewID, userID int) error {
+	return s.deleteReview(reviewID, userID)
+}
+
+// RemoveReview deletes a review of any user and updates the movie rating in one transaction
+func (s *MySQLStore) RemoveReview(reviewID int) error {
+	return s.deleteReview(reviewID, anyUser)
+}
+
+func (s *MySQLStore) deleteReview(reviewID, userID int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	movieID, err := lockOwnReview(tx, reviewID, userID)
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec("DELETE FROM reviews WHERE id = ?", reviewID); err != nil {
+		return err
+	}
+
+	if err = updateMovieRating(tx, movieID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
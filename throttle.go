@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Audit event types
+const (
+	auditLoginLockout = "login_lockout"
+	auditEmailLockout = "email_lockout"
+)
+
+// How failed logins of a key slow down further attempts
+type throttlePolicy struct {
+	Kind         string
+	FreeAttempts int           // Failures before attempts are delayed
+	LockoutAfter int           // Failures that lock the key, every further failure locks it again
+	Lockout      time.Duration // How long a lockout lasts
+	Event        string        // Audit event type of a lockout
+}
+
+// Failures are counted per account and per IP, IPs get more attempts as users behind one address share them
+var (
+	accountThrottle = throttlePolicy{Kind: "account", FreeAttempts: 3, LockoutAfter: 10, Lockout: 15 * time.Minute, Event: auditLoginLockout}
+	ipThrottle      = throttlePolicy{Kind: "ip", FreeAttempts: 20, LockoutAfter: 100, Lockout: time.Hour, Event: auditLoginLockout}
+)
+
+// Requests for password reset and verification emails are counted per address and per IP, every request counts so nobody floods an inbox
+var (
+	emailThrottle   = throttlePolicy{Kind: "email", FreeAttempts: 3, LockoutAfter: 10, Lockout: time.Hour, Event: auditEmailLockout}
+	emailIPThrottle = throttlePolicy{Kind: "email_ip", FreeAttempts: 10, LockoutAfter: 50, Lockout: time.Hour, Event: auditEmailLockout}
+)
+
+// Failures are forgotten after this long without another one
+const loginFailureReset = 24 * time.Hour
+
+// Store key of the value, hashed so any input fits and no emails are stored for unknown accounts
+func (policy throttlePolicy) key(value string) string {
+	hash := sha256.Sum256([]byte(strings.ToLower(value)))
+	return policy.Kind + ":" + hex.EncodeToString(hash[:])
+}
+
+// How long after the last failure the next attempt is allowed, doubling with every failure past the free ones
+func (policy throttlePolicy) delay(failures int) time.Duration {
+	if failures >= policy.LockoutAfter {
+		return policy.Lockout
+	} else if failures <= policy.FreeAttempts {
+		return 0
+	}
+
+	delay := time.Second << uint(failures-policy.FreeAttempts)
+	if delay > policy.Lockout {
+		return policy.Lockout
+	}
+	return delay
+}
+
+// Returns how long until the value may try again, zero if it may now
+func (policy throttlePolicy) retryAfter(value string) (time.Duration, error) {
+	failures, err := store.GetLoginFailures(policy.key(value))
+	if err != nil || failures.Count == 0 {
+		return 0, err
+	}
+
+	wait := time.Until(failures.LastFailureAt.Add(policy.delay(failures.Count)))
+	if wait < 0 {
+		return 0, nil
+	}
+	return wait, nil
+}
+
+// Counts a failed attempt of the value, every lockout and relock is written to the audit log
+func (policy throttlePolicy) fail(value string, userID int, ip string) error {
+	key := policy.key(value)
+	failures, err := store.AddLoginFailure(key, loginFailureReset)
+	if err != nil {
+		return err
+	}
+
+	if failures.Count >= policy.LockoutAfter {
+		// The hashed key and not the value is logged, values are emails and IPs
+		log.Printf("Locked out %s of user %d after %d attempts (%s)\n", key, userID, failures.Count, policy.Event)
+		audit(policy.Event, userID, ip, policy.Kind+" locked out for "+policy.Lockout.String()+" after "+strconv.Itoa(failures.Count)+" attempts")
+	}
+
+	return nil
+}
+
+// Responds to an attempt made while throttled
+func tooManyAttempts(ctx *fiber.Ctx, wait time.Duration) error {
+	ctx.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	return newAPIError(429, "TOO_MANY_ATTEMPTS", "Too many attempts, try again later")
+}
+
+// Writes an audit event, failures are logged
+func audit(eventType string, userID int, ip, detail string) {
+	err := store.CreateAuditEvent(AuditEvent{
+		Type:      eventType,
+		UserID:    userID,
+		IP:        ip,
+		Detail:    detail,
+		CreatedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestThrottleDelay(t *testing.T) {
+	tests := []struct {
+		policy   throttlePolicy
+		failures int
+		want     time.Duration
+	}{
+		{accountThrottle, 0, 0},
+		{accountThrottle, 3, 0},
+		{accountThrottle, 4, 2 * time.Second},
+		{accountThrottle, 5, 4 * time.Second},
+		{accountThrottle, 9, 64 * time.Second},
+		{accountThrottle, 10, 15 * time.Minute},
+		{accountThrottle, 12, 15 * time.Minute},
+		{ipThrottle, 20, 0},
+		{ipThrottle, 21, 2 * time.Second},
+		{ipThrottle, 40, time.Hour},
+		{ipThrottle, 1000, time.Hour},
+		{emailThrottle, 4, 2 * time.Second},
+		{emailThrottle, 10, time.Hour},
+	}
+
+	for _, test := range tests {
+		if delay := test.policy.delay(test.failures); delay != test.want {
+			t.Errorf("%s after %d failures: got %v, want %v", test.policy.Kind, test.failures, delay, test.want)
+		}
+	}
+}
+
+func TestThrottleRetryAfter(t *testing.T) {
+	store = newMemoryStore()
+
+	for i := 1; i <= accountThrottle.FreeAttempts+1; i++ {
+		if wait, err := accountThrottle.retryAfter("Bob@example.com"); err != nil || wait != 0 {
+			t.Fatalf("attempt %d has to wait %v %v", i, wait, err)
+		}
+		if err := accountThrottle.fail("bob@example.com", anyUser, "127.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Keys ignore case and every policy counts on its own
+	if wait, _ := accountThrottle.retryAfter("BOB@example.com"); wait <= time.Second || wait > 2*time.Second {
+		t.Errorf("got wait %v after a failure past the free ones", wait)
+	}
+	if wait, _ := emailThrottle.retryAfter("bob@example.com"); wait != 0 {
+		t.Errorf("email throttle shares the count of the account throttle")
+	}
+}
+
+func TestThrottleLockoutAudit(t *testing.T) {
+	store = newMemoryStore()
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	for i := 0; i < accountThrottle.LockoutAfter+2; i++ {
+		if err := accountThrottle.fail("bob@example.com", 1, "192.0.2.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The lockout and both relocks are audited
+	events := store.(*MemoryStore).auditEvents
+	if len(events) != 3 {
+		t.Fatalf("got audit events %+v", events)
+	}
+	for _, event := range events {
+		if event.Type != auditLoginLockout || event.UserID != 1 || event.IP != "192.0.2.1" {
+			t.Errorf("got audit event %+v", event)
+		}
+	}
+
+	if strings.Contains(logged.String(), "bob@example.com") || !strings.Contains(logged.String(), "of user 1") {
+		t.Errorf("logged %q", logged.String())
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// TOTP parameters (RFC 6238 defaults every authenticator app supports)
+const (
+	totpIssuer = "Movie Rater"
+	totpPeriod = 30
+	totpDigits = 6
+	// Codes of this many steps before and after now are accepted, for clock drift
+	totpSkew = 1
+)
+
+// Number of recovery codes given on enrolment
+const recoveryCodeCount = 10
+
+// Second factor attempts are throttled per user like logins
+var totpThrottle = throttlePolicy{Kind: "totp", FreeAttempts: 3, LockoutAfter: 10, Lockout: 15 * time.Minute, Event: auditLoginLockout}
+
+// Base32 without padding, as otpauth URIs use
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TwoFactorCodeData struct
+type TwoFactorCodeData struct {
+	Code string `json:"code"`
+}
+
+// DisableTwoFactorData struct
+type DisableTwoFactorData struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+// LoginTwoFactorData struct, either code or recoveryCode is required
+type LoginTwoFactorData struct {
+	ChallengeToken string `json:"challengeToken"`
+	Code           string `json:"code"`
+	RecoveryCode   string `json:"recoveryCode"`
+}
+
+// Generates a random 160 bit TOTP secret
+func generateTOTPSecret() (string, error) {
+	bytes := make([]byte, 20)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+
+	return totpEncoding.EncodeToString(bytes), nil
+}
+
+// Computes the code of the secret for the time step (RFC 4226 HOTP)
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// Checks the code against the secret around now, returns the matching time step
+func verifyTOTP(secret, code string) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	now := time.Now().Unix() / totpPeriod
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// Builds the otpauth URI authenticator apps read from a QR code
+func totpURI(secret, account string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", strconv.Itoa(totpDigits))
+	query.Set("period", strconv.Itoa(totpPeriod))
+
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+account) + "?" + query.Encode()
+}
+
+// Normalizes and hashes a recovery code, codes are stored hashed like passwords but need no bcrypt as they are random
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	hash := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(hash[:])
+}
+
+// Generates recovery codes like 1a2b3-c4d5e and their hashes
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		bytes := make([]byte, 5)
+		if _, err := rand.Read(bytes); err != nil {
+			return nil, nil, err
+		}
+
+		code := hex.EncodeToString(bytes)
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashRecoveryCode(code)
+	}
+
+	return codes, hashes, nil
+}
+
+// Checks a TOTP code, or a recovery code if one is given, of the user, throttling failures and rejecting codes that were already used
+func checkSecondFactor(ctx *fiber.Ctx, user *User, code, recoveryCode string) error {
+	value := strconv.Itoa(user.ID)
+	if wait, err := totpThrottle.retryAfter(value); err != nil {
+		return err
+	} else if wait > 0 {
+		return tooManyAttempts(ctx, wait)
+	}
+
+	var err error
+	if recoveryCode != "" {
+		err = store.UseRecoveryCode(user.ID, hashRecoveryCode(recoveryCode))
+	} else if step, ok := verifyTOTP(user.TOTPSecret, strings.TrimSpace(code)); ok {
+		err = store.UseTOTPStep(user.ID, step)
+	} else {
+		err = errNotFound
+	}
+
+	if err == nil {
+		if err = store.ClearLoginFailures(totpThrottle.key(value)); err != nil {
+			log.Println(err.Error())
+		}
+		return nil
+	} else if err != errNotFound && err != errTokenReused {
+		return err
+	}
+
+	if err = totpThrottle.fail(value, user.ID, ctx.IP()); err != nil {
+		log.Println(err.Error())
+	}
+	return newAPIError(401, "INVALID_CODE", "Invalid code")
+}
+
+// SetupTwoFactor starts enrolment with a new secret, 2FA is on once a code of it is confirmed
+func SetupTwoFactor(ctx *fiber.Ctx) error {
+	user, err := currentUser(ctx)
+	if err != nil {
+		return err
+	}
+
+	if user.TOTPEnabled {
+		return errTwoFactorEnabled
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return err
+	}
+
+	if err = store.SetTOTPSecret(user.ID, secret); err != nil {
+		return err
+	}
+
+	return ctx.Status(200).JSON(map[string]string{
+		"secret":     secret,
+		"otpauthUri": totpURI(secret, user.Email),
+	})
+}
+
+// ConfirmTwoFactor turns 2FA on with a code of the pending secret and returns the recovery codes
+func ConfirmTwoFactor(ctx *fiber.Ctx) error {
+	user, err := currentUser(ctx)
+	if err != nil {
+		return err
+	}
+
+	data := new(TwoFactorCodeData)
+	if err := parseBody(ctx, data); err != nil {
+		return err
+	}
+
+	if user.TOTPEnabled {
+		return errTwoFactorEnabled
+	} else if user.TOTPSecret == "" {
+		return newAPIError(400, "TWO_FACTOR_NOT_SET_UP", "Two-factor authentication not set up")
+	}
+
+	if err := checkSecondFactor(ctx, user, data.Code, ""); err != nil {
+		return err
+	}
+
+	return enableTwoFactor(ctx, user)
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes, it requires a code
+func RegenerateRecoveryCodes(ctx *fiber.Ctx) error {
+	user, err := currentUser(ctx)
+	if err != nil {
+		return err
+	}
+
+	data := new(TwoFactorCodeData)
+	if err := parseBody(ctx, data); err != nil {
+		return err
+	}
+
+	if !user.TOTPEnabled {
+		return errTwoFactorNotEnabled
+	}
+
+	if err := checkSecondFactor(ctx, user, data.Code, ""); err != nil {
+		return err
+	}
+
+	return enableTwoFactor(ctx, user)
+}
+
+// Turns 2FA on with new recovery codes and responds with them, they are shown only this once
+func enableTwoFactor(ctx *fiber.Ctx, user *User) error {
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return err
+	}
+
+	if err = store.EnableTOTP(user.ID, hashes); err != nil {
+		return err
+	}
+
+	return ctx.Status(200).JSON(map[string][]string{
+		"recoveryCodes": codes,
+	})
+}
+
+// DisableTwoFactor turns 2FA off, it requires the password and a code
+func DisableTwoFactor(ctx *fiber.Ctx) error {
+	user, err := currentUser(ctx)
+	if err != nil {
+		return err
+	}
+
+	data := new(DisableTwoFactorData)
+	if err := parseBody(ctx, data); err != nil {
+		return err
+	}
+
+	if !user.TOTPEnabled {
+		return errTwoFactorNotEnabled
+	}
+
+	if config.TwoFactorRole != "" && hasRole(user.Role, config.TwoFactorRole) {
+		return newAPIError(403, "TWO_FACTOR_REQUIRED", "Two-factor authentication is required for your role")
+	}
+
+	if !compareHashAndPassword(data.Password, user.Password) {
+		return errWrongPassword
+	}
+
+	if err := checkSecondFactor(ctx, user, data.Code, ""); err != nil {
+		return err
+	}
+
+	if err := store.DisableTOTP(user.ID); err != nil {
+		return err
+	}
+
+	return ctx.SendStatus(204)
+}
+
+// LoginTwoFactor finishes a login of a user with 2FA, the challenge token from Login and a code or recovery code give the tokens
+func LoginTwoFactor(ctx *fiber.Ctx) error {
+	data := new(LoginTwoFactorData)
+	if err := parseBody(ctx, data); err != nil {
+		return err
+	}
+
+	claims, err := parseToken(data.ChallengeToken, mfaChallengeType)
+	if err != nil {
+		return errUnauthorized
+	}
+
+	user, err := store.GetUserByID(int(claims["id"].(float64)))
+	if err == errNotFound || (err == nil && !user.TOTPEnabled) {
+		return errUnauthorized
+	} else if err != nil {
+		return err
+	}
+
+	if err := checkSecondFactor(ctx, user, data.Code, data.RecoveryCode); err != nil {
+		return err
+	}
+
+	if data.RecoveryCode != "" {
+		log.Printf("User %d logged in with a recovery code\n", user.ID)
+	}
+
+	return respondWithTokens(ctx, user)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// Test values of RFC 4226 appendix D
+	secret := []byte("12345678901234567890")
+	codes := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+
+	for step, want := range codes {
+		if code := totpCode(secret, int64(step)); code != want {
+			t.Errorf("step %d: got %s, want %s", step, code, want)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix() / totpPeriod
+
+	tests := []struct {
+		name   string
+		secret string
+		code   string
+		ok     bool
+	}{
+		{"current code", secret, totpCode(key, now), true},
+		{"previous code", secret, totpCode(key, now-1), true},
+		{"next code", secret, totpCode(key, now+1), true},
+		{"too old", secret, totpCode(key, now-3), false},
+		{"too short", secret, totpCode(key, now)[1:], false},
+		{"invalid secret", "not base32!", totpCode(key, now), false},
+	}
+
+	for _, test := range tests {
+		step, ok := verifyTOTP(test.secret, test.code)
+		if ok != test.ok {
+			t.Errorf("%s: got %v, want %v", test.name, ok, test.ok)
+		} else if ok && (step < now-totpSkew || step > now+totpSkew) {
+			t.Errorf("%s: matched step %d, now is %d", test.name, step, now)
+		}
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+		t.Fatalf("got %d codes and %d hashes", len(codes), len(hashes))
+	}
+
+	seen := map[string]bool{}
+	for i, code := range codes {
+		if len(code) != 11 || code[5] != '-' || seen[code] {
+			t.Errorf("code %q is malformed or repeated", code)
+		}
+		seen[code] = true
+
+		// Codes are accepted however they are typed
+		if hashRecoveryCode(code) != hashes[i] || hashRecoveryCode(" "+code[:5]+code[6:]+" ") != hashes[i] {
+			t.Errorf("code %q does not match its hash", code)
+		}
+	}
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	app, _ := newTestApp(t)
+	access, _ := registerTestUser(t, app, "alice")
+
+	response, setup := testRequest(t, app, "POST", "/api/v1/me/2fa/setup", access, nil)
+	if response.StatusCode != 200 {
+		t.Fatalf("setup responded with %d %v", response.StatusCode, setup)
+	}
+	key, err := totpEncoding.DecodeString(setup["secret"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix() / totpPeriod
+
+	// Enrolment uses the previous step so the current one is still free for the login
+	response, confirm := testRequest(t, app, "POST", "/api/v1/me/2fa/confirm", access, map[string]string{"code": totpCode(key, now-1)})
+	if response.StatusCode != 200 {
+		t.Fatalf("confirm responded with %d %v", response.StatusCode, confirm)
+	}
+	recoveryCode := confirm["recoveryCodes"].([]interface{})[0].(string)
+
+	challenge := func() string {
+		response, body := testRequest(t, app, "POST", "/api/v1/login", "", map[string]string{"email": "alice@example.com", "password": "password1"})
+		if response.StatusCode != 200 || body["mfaRequired"] != true || body["accessToken"] != nil {
+			t.Fatalf("login responded with %d %v", response.StatusCode, body)
+		}
+		return body["challengeToken"].(string)
+	}
+
+	// Steps run in order against fresh challenges, codes and recovery codes work once
+	for _, step := range []struct {
+		name   string
+		data   map[string]string
+		status int
+	}{
+		{"wrong code", map[string]string{"code": "000000"}, 401},
+		{"current code", map[string]string{"code": totpCode(key, now)}, 200},
+		{"reused code", map[string]string{"code": totpCode(key, now)}, 401},
+		{"recovery code", map[string]string{"recoveryCode": recoveryCode}, 200},
+		{"reused recovery code", map[string]string{"recoveryCode": recoveryCode}, 401},
+	} {
+		step.data["challengeToken"] = challenge()
+		response, body := testRequest(t, app, "POST", "/api/v1/login/2fa", "", step.data)
+		if response.StatusCode != step.status {
+			t.Errorf("%s: got %d %v, want %d", step.name, response.StatusCode, body, step.status)
+		} else if step.status == 200 && body["accessToken"] == nil {
+			t.Errorf("%s: no access token in %v", step.name, body)
+		}
+	}
+
+	// A challenge token is no access token
+	if response, _ := testRequest(t, app, "GET", "/api/v1/me", challenge(), nil); response.StatusCode != 401 {
+		t.Errorf("challenge token used as access token responded with %d", response.StatusCode)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Request bodies are validated by the tags of their fields:
+//
+//	normalize:"line,lower"  line trims and collapses whitespace and drops control characters,
+//	                        text does the same but keeps line breaks, lower lowercases;
+//	                        every normalized string is also put in Unicode NFC form
+//	validate:"required,max=15"
+//
+// Validation rules, comma separated and checked in order:
+//
+//	required      not empty, for pointers present
+//	omitempty     skip the other rules when empty
+//	min=N, max=N  characters of strings, items of slices, value of numbers
+//	maxbytes=N    bytes of UTF-8 strings, e.g. of passwords as bcrypt ignores what is past 72
+//	email         an email address
+//	url           an http(s) URL
+//	oneof=a b     one of the space separated values
+//	pattern=name  matches the pattern of validationPatterns
+//	dive          the rules after it apply to every item of a slice
+//
+// Bodies whose type has a validate() []FieldError method are checked by it too, for rules tags cannot express.
+// Problems of both are reported together, at most one per field.
+
+// Named patterns of the pattern rule, with what they describe
+var validationPatterns = map[string]struct {
+	Regexp      *regexp.Regexp
+	Description string
+}{
+	"email":    {regexp.MustCompile(`^[\w\.+-]+@[\w\.-]+\.\w{2,}$`), "an email address"},
+	"language": {regexp.MustCompile(`^[a-z]{2}$`), "a two letter ISO 639-1 code"},
+	"imdbId":   {regexp.MustCompile(`^tt[0-9]{7,10}$`), "an IMDb ID (e.g. tt0087182)"},
+}
+
+// Implemented by bodies with rules their tags cannot express, called after the tags were checked
+type selfValidator interface {
+	validate() []FieldError
+}
+
+// Parses the JSON body into data, which must point to a struct, and normalizes and validates it; unknown fields are refused
+func parseBody(ctx *fiber.Ctx, data interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(ctx.Body()))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(data); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			return validationError(typeErr.Field, typeErr.Field+" must be a "+jsonTypeName(typeErr.Type))
+		} else if strings.HasPrefix(err.Error(), "json: unknown field ") {
+			field, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+			return validationError(field, "Unknown field "+field)
+		}
+		return errInvalidJSON
+	} else if _, err = decoder.Token(); err != io.EOF {
+		return errInvalidJSON
+	}
+
+	value := reflect.ValueOf(data).Elem()
+	problems := validateStruct(value)
+	if validator, ok := data.(selfValidator); ok {
+		// Fields the tags already refused keep their first problem
+		refused := map[string]bool{}
+		for _, problem := range problems {
+			refused[problem.Field] = true
+		}
+		for _, problem := range validator.validate() {
+			if !refused[problem.Field] {
+				problems = append(problems, problem)
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return validationErrors(problems)
+	}
+	return nil
+}
+
+// Describes a Go type in JSON terms for error messages
+func jsonTypeName(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "whole number"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Slice:
+		return "list"
+	default:
+		return "object"
+	}
+}
+
+// Normalizes and validates the fields of a struct by their tags, returns every problem
+func validateStruct(value reflect.Value) []FieldError {
+	problems := []FieldError{}
+
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+
+		fieldValue := value.Field(i)
+		normalizeValue(fieldValue, field.Tag.Get("normalize"))
+
+		if problem := validateValue(name, fieldValue, field.Tag.Get("validate")); problem != nil {
+			problems = append(problems, *problem)
+		}
+	}
+
+	return problems
+}
+
+// Normalizes strings, also behind pointers and in slices
+func normalizeValue(value reflect.Value, modes string) {
+	if modes == "" {
+		return
+	}
+
+	switch value.Kind() {
+	case reflect.Ptr:
+		if !value.IsNil() {
+			normalizeValue(value.Elem(), modes)
+		}
+	case reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			normalizeValue(value.Index(i), modes)
+		}
+	case reflect.String:
+		value.SetString(normalizeString(value.String(), modes))
+	}
+}
+
+// Normalizes a string by the comma separated modes of the normalize tag
+func normalizeString(text string, modes string) string {
+	// Composed and decomposed forms of the same text, e.g. of "é", become the same string
+	text = norm.NFC.String(text)
+
+	for _, mode := range strings.Split(modes, ",") {
+		switch mode {
+		case "line", "text":
+			text = strings.ReplaceAll(text, "\r\n", "\n")
+
+			var builder strings.Builder
+			space := false
+			for _, r := range text {
+				if r == '\n' && mode == "text" {
+					builder.WriteRune(r)
+					space = false
+					continue
+				} else if unicode.IsSpace(r) {
+					space = true
+					continue
+				} else if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+					// Invisible characters, e.g. zero width spaces
+					continue
+				}
+
+				if space && builder.Len() > 0 {
+					builder.WriteRune(' ')
+				}
+				space = false
+				builder.WriteRune(r)
+			}
+			text = strings.TrimSpace(builder.String())
+		case "lower":
+			text = strings.ToLower(text)
+		}
+	}
+
+	return text
+}
+
+// Checks a value against the comma separated rules of the validate tag, returns the first problem
+func validateValue(name string, value reflect.Value, rules string) *FieldError {
+	if rules == "" {
+		return nil
+	}
+	problem := func(message string) *FieldError {
+		return &FieldError{Field: name, Message: name + " " + message}
+	}
+
+	// Pointers are checked by what they point to, for them required means present
+	pointer := value.Kind() == reflect.Ptr
+	if pointer {
+		if value.IsNil() {
+			if strings.Contains(","+rules+",", ",required,") {
+				return problem("is required")
+			}
+			return nil
+		}
+		value = value.Elem()
+	}
+
+	for ruleIndex, rule := range strings.Split(rules, ",") {
+		ruleName, argument := rule, ""
+		if i := strings.Index(rule, "="); i >= 0 {
+			ruleName, argument = rule[:i], rule[i+1:]
+		}
+
+		switch ruleName {
+		case "required":
+			if !pointer && (value.IsZero() || (value.Kind() == reflect.Slice && value.Len() == 0)) {
+				return problem("is required")
+			}
+		case "omitempty":
+			if value.IsZero() || (value.Kind() == reflect.Slice && value.Len() == 0) {
+				return nil
+			}
+		case "min", "max":
+			limit, _ := strconv.Atoi(argument)
+			size, unit := 0, ""
+			switch value.Kind() {
+			case reflect.String:
+				size, unit = utf8.RuneCountInString(value.String()), " characters"
+			case reflect.Slice:
+				size, unit = value.Len(), " items"
+			default:
+				size = int(value.Int())
+			}
+
+			if ruleName == "min" && size < limit {
+				return problem("must be at least " + argument + unit)
+			} else if ruleName == "max" && size > limit {
+				return problem("must be at most " + argument + unit)
+			}
+		case "maxbytes":
+			if limit, _ := strconv.Atoi(argument); len(value.String()) > limit {
+				return problem("must be at most " + argument + " bytes")
+			}
+		case "email", "pattern":
+			if ruleName == "email" {
+				argument = "email"
+			}
+			pattern := validationPatterns[argument]
+			if !pattern.Regexp.MatchString(value.String()) {
+				return problem("must be " + pattern.Description)
+			}
+		case "url":
+			parsed, err := url.Parse(value.String())
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				return problem("must be an http(s) URL")
+			}
+		case "oneof":
+			valid := false
+			for _, option := range strings.Fields(argument) {
+				valid = valid || option == value.String()
+			}
+			if !valid {
+				return problem("must be one of " + strings.Join(strings.Fields(argument), ", "))
+			}
+		case "dive":
+			itemRules := strings.Join(strings.Split(rules, ",")[ruleIndex+1:], ",")
+			for i := 0; i < value.Len(); i++ {
+				if itemProblem := validateValue(name+"["+strconv.Itoa(i)+"]", value.Index(i), itemRules); itemProblem != nil {
+					return itemProblem
+				}
+			}
+			return nil
+		}
+	}
+
+	return nil
+}
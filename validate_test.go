@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Parses the body into data through a route, returns the fields with problems or the error code if the body was refused otherwise
+func parseTestBody(t *testing.T, body string, data interface{}) []string {
+	t.Helper()
+
+	app := fiber.New(fiber.Config{ErrorHandler: ErrorHandler})
+	app.Post("/", func(ctx *fiber.Ctx) error {
+		if err := parseBody(ctx, data); err != nil {
+			return err
+		}
+		return ctx.SendStatus(204)
+	})
+
+	request := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	response, err := app.Test(request, -1)
+	if err != nil {
+		t.Fatal(err)
+	} else if response.StatusCode == 204 {
+		return []string{}
+	}
+
+	var apiErr APIError
+	if err = json.NewDecoder(response.Body).Decode(&apiErr); err != nil {
+		t.Fatal(err)
+	}
+	if apiErr.Code != "VALIDATION_FAILED" {
+		return []string{apiErr.Code}
+	}
+
+	fields := []string{}
+	for _, detail := range apiErr.Details {
+		fields = append(fields, detail.Field)
+	}
+	return fields
+}
+
+func TestParseBody(t *testing.T) {
+	rating := func(value int) *int { return &value }
+	name := func(value string) *string { return &value }
+
+	tests := []struct {
+		name     string
+		body     string
+		data     interface{} // Pointer to a new value the body is parsed into
+		problems []string
+		want     interface{} // Value after normalization when there are no problems
+	}{
+		{
+			name: "normalized movie",
+			body: `{"title":"  The\u200b  Godfather\n", "genres":["Crime", "crime ", "Drama"], "originalLanguage":" EN "}`,
+			data: new(NewMovie),
+			want: &NewMovie{Title: "The Godfather", Genres: []string{"crime", "drama"}, OriginalLanguage: "en"},
+		},
+		{
+			name:     "missing title",
+			body:     `{"releaseYear":1984}`,
+			data:     new(NewMovie),
+			problems: []string{"title"},
+		},
+		{
+			name:     "every problem of the tags at once",
+			body:     `{"title":"D", "releaseYear":1800, "posterUrl":"ftp://example.com/a.jpg", "imdbId":"12345", "genres":[""]}`,
+			data:     new(NewMovie),
+			problems: []string{"title", "releaseYear", "genres[0]", "posterUrl", "imdbId"},
+		},
+		{
+			name:     "rule of validate()",
+			body:     `{"title":"Dune", "releaseYear":3000}`,
+			data:     new(NewMovie),
+			problems: []string{"releaseYear"},
+		},
+		{
+			name:     "problems of the tags and of validate() at once",
+			body:     `{"title":"D", "releaseYear":3000}`,
+			data:     new(NewMovie),
+			problems: []string{"title", "releaseYear"},
+		},
+		{
+			name: "NFC form",
+			body: `{"title":"Cafe\u0301 Society", "genres":["Come\u0301die", "com\u00e9die"]}`,
+			data: new(NewMovie),
+			want: &NewMovie{Title: "Caf\u00e9 Society", Genres: []string{"com\u00e9die"}},
+		},
+		{
+			name:     "unknown field",
+			body:     `{"title":"Dune", "rating":5}`,
+			data:     new(NewMovie),
+			problems: []string{"rating"},
+		},
+		{
+			name:     "wrong type",
+			body:     `{"title":1984}`,
+			data:     new(NewMovie),
+			problems: []string{"title"},
+		},
+		{
+			name:     "invalid JSON",
+			body:     `{"title":`,
+			data:     new(NewMovie),
+			problems: []string{"INVALID_JSON"},
+		},
+		{
+			name:     "trailing data",
+			body:     `{"title":"Dune"} {}`,
+			data:     new(NewMovie),
+			problems: []string{"INVALID_JSON"},
+		},
+		{
+			name: "zero rating",
+			body: `{"rating":0, "comment":" Line one\r\nline  two "}`,
+			data: new(NewReview),
+			want: &NewReview{Rating: rating(0), Comment: "Line one\nline two"},
+		},
+		{
+			name:     "missing rating",
+			body:     `{"comment":"Great"}`,
+			data:     new(NewReview),
+			problems: []string{"rating"},
+		},
+		{
+			name:     "rating out of range",
+			body:     `{"rating":6}`,
+			data:     new(NewReview),
+			problems: []string{"rating"},
+		},
+		{
+			name:     "invalid registration",
+			body:     `{"username":"b o", "email":"bob@example", "password":"short"}`,
+			data:     new(RegisterData),
+			problems: []string{"email", "password"},
+		},
+		{
+			name:     "password longer than bcrypt reads",
+			body:     `{"username":"bob", "email":"bob@example.com", "password":"` + strings.Repeat("a", 73) + `"}`,
+			data:     new(RegisterData),
+			problems: []string{"password"},
+		},
+		{
+			name:     "password of more bytes than bcrypt reads",
+			body:     `{"token":"abc", "password":"` + strings.Repeat("\u20ac", 25) + `"}`,
+			data:     new(ResetPasswordData),
+			problems: []string{"password"},
+		},
+		{
+			name: "longest password",
+			body: `{"currentPassword":"password1", "newPassword":"` + strings.Repeat("a", 72) + `"}`,
+			data: new(ChangePasswordData),
+			want: &ChangePasswordData{CurrentPassword: "password1", NewPassword: strings.Repeat("a", 72)},
+		},
+		{
+			name: "optional profile fields",
+			body: `{"username":"  bob  "}`,
+			data: new(UpdateProfileData),
+			want: &UpdateProfileData{Username: name("bob")},
+		},
+		{
+			name:     "unknown API key scope",
+			body:     `{"name":"script", "scopes":["movies:read", "everything"]}`,
+			data:     new(AddAPIKeyData),
+			problems: []string{"scopes"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			problems := parseTestBody(t, test.body, test.data)
+			if test.problems == nil {
+				test.problems = []string{}
+			}
+
+			if !reflect.DeepEqual(problems, test.problems) {
+				t.Errorf("got problems %v, want %v", problems, test.problems)
+			} else if test.want != nil && !reflect.DeepEqual(test.data, test.want) {
+				t.Errorf("got %+v, want %+v", test.data, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Prefix of the routes of the current API version
+const apiV1Prefix = "/api/v1"
+
+// When the unversioned routes were deprecated and when they will be removed
+var (
+	unversionedDeprecatedAt = time.Date(2026, time.October, 17, 0, 0, 0, 0, time.UTC)
+	unversionedSunsetAt     = time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC)
+)
+
+// apiRoutes registers routes of /api/v1 along with the deprecated unversioned routes they replace
+type apiRoutes struct {
+	app *fiber.App
+	v1  fiber.Router
+}
+
+// Registers the handlers at the /api/v1 path and, unless oldPath is empty, at oldPath as a deprecated alias
+func (routes apiRoutes) add(method, path, oldPath string, handlers ...fiber.Handler) {
+	routes.v1.Add(method, path, handlers...)
+	if oldPath != "" {
+		routes.app.Add(method, oldPath, append([]fiber.Handler{Deprecated(apiV1Prefix + path)}, handlers...)...)
+	}
+}
+
+// Deprecated marks responses of an unversioned route with its sunset and the /api/v1 route that replaces it
+func Deprecated(successor string) func(*fiber.Ctx) error {
+	return func(ctx *fiber.Ctx) error {
+		link := pathParamPattern.ReplaceAllStringFunc(successor, func(param string) string {
+			return ctx.Params(param[1:])
+		})
+
+		ctx.Set("Deprecation", "@"+strconv.FormatInt(unversionedDeprecatedAt.Unix(), 10))
+		ctx.Set("Sunset", unversionedSunsetAt.Format(http.TimeFormat))
+		ctx.Set(fiber.HeaderLink, "<"+link+`>; rel="successor-version"`)
+		ctx.Locals("deprecated", true)
+		return ctx.Next()
+	}
+}
+
+// Reports whether the request came through a deprecated unversioned route
+func deprecatedRoute(ctx *fiber.Ctx) bool {
+	return ctx.Locals("deprecated") != nil
+}
+
+// Movie, Review and Suggestion with the field names the unversioned routes wrote, before they had JSON names
+type (
+	legacyMovie struct {
+		ID               int
+		Title            string
+		ReleaseYear      int
+		Runtime          int
+		Synopsis         string
+		OriginalLanguage string
+		Genres           []string
+		PosterURL        string
+		IMDbID           string
+		TMDbID           int
+		AvgRating        float64
+		RaterNum         int
+	}
+	legacyReview struct {
+		ID        int
+		MovieID   int
+		Rating    int
+		Comment   string
+		Username  string
+		CreatedAt time.Time
+		UpdatedAt time.Time
+	}
+	legacySuggestion struct {
+		ID          int
+		Title       string
+		ReleaseYear int
+	}
+	legacyReviewPage struct {
+		Movie legacyMovie `json:"movie"`
+		Page
+	}
+)
+
+// Body as the route writes it, deprecated routes keep the old field names of movies, reviews and suggestions
+func versionedBody(ctx *fiber.Ctx, body interface{}) interface{} {
+	if !deprecatedRoute(ctx) {
+		return body
+	}
+
+	switch body := body.(type) {
+	case *Movie:
+		return legacyMovie(*body)
+	case []Movie:
+		movies := make([]legacyMovie, len(body))
+		for i := range body {
+			movies[i] = legacyMovie(body[i])
+		}
+		return movies
+	case *Review:
+		return legacyReview(*body)
+	case []Review:
+		reviews := make([]legacyReview, len(body))
+		for i := range body {
+			reviews[i] = legacyReview(body[i])
+		}
+		return reviews
+	case []Suggestion:
+		suggestions := make([]legacySuggestion, len(body))
+		for i := range body {
+			suggestions[i] = legacySuggestion(body[i])
+		}
+		return suggestions
+	case Page:
+		body.Data = versionedBody(ctx, body.Data)
+		return body
+	case ReviewPage:
+		return legacyReviewPage{Movie: legacyMovie(*body.Movie), Page: versionedBody(ctx, body.Page).(Page)}
+	default:
+		return body
+	}
+}